@@ -1,23 +1,79 @@
 package main
 
 import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"time"
+
 	"github.com/kelseyhightower/envconfig"
+	"sigs.k8s.io/yaml"
 
 	"github.com/authgear/authgear-deno/pkg/deno"
 )
 
 type Config struct {
-	ListenAddr                      string `envconfig:"LISTEN_ADDR" default:"0.0.0.0:8090"`
-	DisallowGlobalUnicast           bool   `envconfig:"DISALLOW_GLOBAL_UNICAST" default:"false"`
-	DisallowInterfaceLocalMulticast bool   `envconfig:"DISALLOW_INTERFACE_LOCAL_MULTICAST" default:"true"`
-	DisallowLinkLocalUnicast        bool   `envconfig:"DISALLOW_LINK_LOCAL_UNICAST" default:"true"`
-	DisallowLinkLocalMulticast      bool   `envconfig:"DISALLOW_LINK_LOCAL_MULTICAST" default:"true"`
-	DisallowLoopback                bool   `envconfig:"DISALLOW_LOOPBACK" default:"true"`
-	DisallowMulticast               bool   `envconfig:"DISALLOW_MULTICAST" default:"true"`
-	DisallowPrivate                 bool   `envconfig:"DISALLOW_PRIVATE" default:"true"`
-	DisallowUnspecified             bool   `envconfig:"DISALLOW_UNSPECIFIED" default:"true"`
-	RunMaxConcurrency               int    `envconfig:"RUN_MAX_CONCURRENCY" default:"10"`
-	RunnerTimeoutSeconds            int    `envconfig:"RUNNER_TIMEOUT_SECONDS" default:"60"`
+	ListenAddr                      string   `envconfig:"LISTEN_ADDR" default:"0.0.0.0:8090" json:"-"`
+	DisallowGlobalUnicast           bool     `envconfig:"DISALLOW_GLOBAL_UNICAST" default:"false" json:"disallow_global_unicast"`
+	DisallowInterfaceLocalMulticast bool     `envconfig:"DISALLOW_INTERFACE_LOCAL_MULTICAST" default:"true" json:"disallow_interface_local_multicast"`
+	DisallowLinkLocalUnicast        bool     `envconfig:"DISALLOW_LINK_LOCAL_UNICAST" default:"true" json:"disallow_link_local_unicast"`
+	DisallowLinkLocalMulticast      bool     `envconfig:"DISALLOW_LINK_LOCAL_MULTICAST" default:"true" json:"disallow_link_local_multicast"`
+	DisallowLoopback                bool     `envconfig:"DISALLOW_LOOPBACK" default:"true" json:"disallow_loopback"`
+	DisallowMulticast               bool     `envconfig:"DISALLOW_MULTICAST" default:"true" json:"disallow_multicast"`
+	DisallowPrivate                 bool     `envconfig:"DISALLOW_PRIVATE" default:"true" json:"disallow_private"`
+	DisallowUnspecified             bool     `envconfig:"DISALLOW_UNSPECIFIED" default:"true" json:"disallow_unspecified"`
+	DisallowThisNetwork             bool     `envconfig:"DISALLOW_THIS_NETWORK" default:"false" json:"disallow_this_network"`
+	DisallowSharedAddressSpace      bool     `envconfig:"DISALLOW_SHARED_ADDRESS_SPACE" default:"false" json:"disallow_shared_address_space"`
+	DisallowBenchmarking            bool     `envconfig:"DISALLOW_BENCHMARKING" default:"false" json:"disallow_benchmarking"`
+	DisallowDocumentation           bool     `envconfig:"DISALLOW_DOCUMENTATION" default:"false" json:"disallow_documentation"`
+	DisallowSpecialPurpose          bool     `envconfig:"DISALLOW_SPECIAL_PURPOSE" default:"false" json:"disallow_special_purpose"`
+	DisallowMetadata                bool     `envconfig:"DISALLOW_METADATA" default:"true" json:"disallow_metadata"`
+	AllowCIDRs                      []string `envconfig:"ALLOW_CIDRS" json:"allow_cidrs"`
+	DenyCIDRs                       []string `envconfig:"DENY_CIDRS" json:"deny_cidrs"`
+	AllowPorts                      []string `envconfig:"ALLOW_PORTS" default:"80,443" json:"allow_ports"`
+	AllowNetWithoutPort             bool     `envconfig:"ALLOW_NET_WITHOUT_PORT" default:"false" json:"allow_net_without_port"`
+	AllowHosts                      []string `envconfig:"ALLOW_HOSTS" json:"allow_hosts"`
+	DenyHosts                       []string `envconfig:"DENY_HOSTS" json:"deny_hosts"`
+	AllowHrtime                     bool     `envconfig:"ALLOW_HRTIME" default:"false" json:"allow_hrtime"`
+	AllowEnvVariables               []string `envconfig:"ALLOW_ENV_VARIABLES" json:"allow_env_variables"`
+	AllowSysKinds                   []string `envconfig:"ALLOW_SYS_KINDS" json:"allow_sys_kinds"`
+	AllowImportHosts                []string `envconfig:"ALLOW_IMPORT_HOSTS" json:"allow_import_hosts"`
+	DNSServer                       string   `envconfig:"DNS_SERVER" json:"-"`
+	DNSNetwork                      string   `envconfig:"DNS_NETWORK" default:"udp" json:"-"`
+	DNSTimeoutSeconds               int      `envconfig:"DNS_TIMEOUT_SECONDS" default:"5" json:"-"`
+	DNSNegativeCacheSeconds         int      `envconfig:"DNS_NEGATIVE_CACHE_SECONDS" default:"30" json:"-"`
+	PermissionTimeoutSeconds        int      `envconfig:"PERMISSION_TIMEOUT_SECONDS" default:"10" json:"permission_timeout_seconds"`
+	EgressProxyEnabled              bool     `envconfig:"EGRESS_PROXY_ENABLED" default:"true" json:"-"`
+	EgressProxyListenAddr           string   `envconfig:"EGRESS_PROXY_LISTEN_ADDR" default:"127.0.0.1:0" json:"-"`
+	RunMaxConcurrency               int      `envconfig:"RUN_MAX_CONCURRENCY" default:"10" json:"run_max_concurrency"`
+	RunnerTimeoutSeconds            int      `envconfig:"RUNNER_TIMEOUT_SECONDS" default:"60" json:"runner_timeout_seconds"`
+	RunKillGracePeriodSeconds       int      `envconfig:"RUN_KILL_GRACE_PERIOD_SECONDS" default:"1" json:"run_kill_grace_period_seconds"`
+	StdStreamLimitBytes             int64    `envconfig:"STD_STREAM_LIMIT_BYTES" default:"1048576" json:"std_stream_limit_bytes"`
+	RunnerPoolSize                  int      `envconfig:"RUNNER_POOL_SIZE" default:"0" json:"runner_pool_size"`
+	RunnerWorkerMode                bool     `envconfig:"RUNNER_WORKER_MODE" default:"false" json:"runner_worker_mode"`
+	RunMemoryLimitBytes             int64    `envconfig:"RUN_MEMORY_LIMIT_BYTES" default:"0" json:"run_memory_limit_bytes"`
+	RunCPULimitSeconds              int64    `envconfig:"RUN_CPU_LIMIT_SECONDS" default:"0" json:"run_cpu_limit_seconds"`
+	RunOpenFilesLimit               int64    `envconfig:"RUN_OPEN_FILES_LIMIT" default:"0" json:"run_open_files_limit"`
+	RunFileSizeLimitBytes           int64    `envconfig:"RUN_FILE_SIZE_LIMIT_BYTES" default:"0" json:"run_file_size_limit_bytes"`
+	RunProcessesLimit               int64    `envconfig:"RUN_PROCESSES_LIMIT" default:"0" json:"run_processes_limit"`
+	// RunMemoryCgroup is a cgroup v2 directory in which a child cgroup is created for each run.
+	// It is required by RunProcessesLimit.
+	RunMemoryCgroup string `envconfig:"RUN_MEMORY_CGROUP" json:"-"`
+	// ScriptCacheDir is where the scripts and the DENO_DIR are kept. The cache is disabled if it is empty.
+	ScriptCacheDir string `envconfig:"SCRIPT_CACHE_DIR" json:"-"`
+	// ScriptCacheMaxBytes limits the total size of the scripts. The rest of the DENO_DIR is not counted.
+	ScriptCacheMaxBytes int64 `envconfig:"SCRIPT_CACHE_MAX_BYTES" default:"67108864" json:"-"`
+	// ScriptCachePrewarm compiles the scripts in the cache, and in ScriptCachePrewarmDir, at startup.
+	ScriptCachePrewarm    bool   `envconfig:"SCRIPT_CACHE_PREWARM" default:"false" json:"-"`
+	ScriptCachePrewarmDir string `envconfig:"SCRIPT_CACHE_PREWARM_DIR" json:"-"`
+	// PolicyFile is a YAML or JSON file that overrides the fields above that have a JSON name.
+	// It is reloaded on SIGHUP, or when its content changes.
+	PolicyFile            string `envconfig:"POLICY_FILE" json:"-"`
+	PolicyFilePollSeconds int    `envconfig:"POLICY_FILE_POLL_SECONDS" default:"5" json:"-"`
 }
 
 func LoadConfigFromEnv() (*Config, error) {
@@ -29,7 +85,131 @@ func LoadConfigFromEnv() (*Config, error) {
 	return &cfg, nil
 }
 
-func (c *Config) IPPolicies() []deno.IPPolicy {
+// WithPolicyFile returns a copy of c, with the fields present in PolicyFile overridden.
+// A field that cannot be reloaded is an unknown field of the policy file.
+func (c *Config) WithPolicyFile() (*Config, error) {
+	out := *c
+	if c.PolicyFile == "" {
+		return &out, nil
+	}
+
+	b, err := os.ReadFile(c.PolicyFile)
+	if err != nil {
+		return nil, err
+	}
+	// JSON is YAML, so both are accepted.
+	jsonBytes, err := yaml.YAMLToJSON(b)
+	if err != nil {
+		return nil, fmt.Errorf("policy file %v: %w", c.PolicyFile, err)
+	}
+
+	var present map[string]json.RawMessage
+	err = json.Unmarshal(jsonBytes, &present)
+	if err != nil {
+		return nil, fmt.Errorf("policy file %v: %w", c.PolicyFile, err)
+	}
+
+	// Decode into a zero Config so that the slices of c are never overwritten in place.
+	var overlay Config
+	decoder := json.NewDecoder(bytes.NewReader(jsonBytes))
+	decoder.DisallowUnknownFields()
+	err = decoder.Decode(&overlay)
+	if err != nil {
+		return nil, fmt.Errorf("policy file %v: %w", c.PolicyFile, err)
+	}
+
+	outValue := reflect.ValueOf(&out).Elem()
+	overlayValue := reflect.ValueOf(overlay)
+	for i := 0; i < outValue.NumField(); i++ {
+		name, _, _ := strings.Cut(outValue.Type().Field(i).Tag.Get("json"), ",")
+		if _, ok := present[name]; ok && name != "-" {
+			outValue.Field(i).Set(overlayValue.Field(i))
+		}
+	}
+
+	return &out, nil
+}
+
+// Validate checks the fields that are not checked when the Permissioner is built.
+func (c *Config) Validate() error {
+	if c.RunMaxConcurrency <= 0 {
+		return fmt.Errorf("run_max_concurrency must be positive: %v", c.RunMaxConcurrency)
+	}
+	if c.RunnerTimeoutSeconds <= 0 {
+		return fmt.Errorf("runner_timeout_seconds must be positive: %v", c.RunnerTimeoutSeconds)
+	}
+	if c.RunKillGracePeriodSeconds <= 0 {
+		return fmt.Errorf("run_kill_grace_period_seconds must be positive: %v", c.RunKillGracePeriodSeconds)
+	}
+	if c.PermissionTimeoutSeconds <= 0 {
+		return fmt.Errorf("permission_timeout_seconds must be positive: %v", c.PermissionTimeoutSeconds)
+	}
+	if c.StdStreamLimitBytes <= 0 {
+		return fmt.Errorf("std_stream_limit_bytes must be positive: %v", c.StdStreamLimitBytes)
+	}
+	if c.RunMemoryLimitBytes < 0 {
+		return fmt.Errorf("run_memory_limit_bytes must not be negative: %v", c.RunMemoryLimitBytes)
+	}
+	if c.RunCPULimitSeconds < 0 {
+		return fmt.Errorf("run_cpu_limit_seconds must not be negative: %v", c.RunCPULimitSeconds)
+	}
+	if c.RunOpenFilesLimit < 0 {
+		return fmt.Errorf("run_open_files_limit must not be negative: %v", c.RunOpenFilesLimit)
+	}
+	if c.RunFileSizeLimitBytes < 0 {
+		return fmt.Errorf("run_file_size_limit_bytes must not be negative: %v", c.RunFileSizeLimitBytes)
+	}
+	if c.RunProcessesLimit < 0 {
+		return fmt.Errorf("run_processes_limit must not be negative: %v", c.RunProcessesLimit)
+	}
+	if c.RunProcessesLimit > 0 && c.RunMemoryCgroup == "" {
+		return fmt.Errorf("run_processes_limit requires run_memory_cgroup")
+	}
+	if c.RunnerPoolSize < 0 {
+		return fmt.Errorf("runner_pool_size must not be negative: %v", c.RunnerPoolSize)
+	}
+	if len(c.AllowPorts) <= 0 {
+		// Every port is an explicit choice, like 1-65535.
+		return fmt.Errorf("allow_ports must not be empty")
+	}
+	return nil
+}
+
+// ScriptCache returns nil if ScriptCacheDir is empty.
+func (c *Config) ScriptCache() (*deno.ScriptCache, error) {
+	if c.ScriptCacheDir == "" {
+		return nil, nil
+	}
+	return deno.NewScriptCache(c.ScriptCacheDir, c.ScriptCacheMaxBytes)
+}
+
+// PrewarmScripts returns the scripts in ScriptCachePrewarmDir, to be compiled with those in the cache.
+// ok is false if ScriptCachePrewarm is false.
+func (c *Config) PrewarmScripts() (scripts []string, ok bool, err error) {
+	if c.ScriptCacheDir == "" || !c.ScriptCachePrewarm {
+		return nil, false, nil
+	}
+
+	if c.ScriptCachePrewarmDir != "" {
+		entries, err := os.ReadDir(c.ScriptCachePrewarmDir)
+		if err != nil {
+			return nil, false, err
+		}
+		for _, e := range entries {
+			if e.IsDir() {
+				continue
+			}
+			b, err := os.ReadFile(filepath.Join(c.ScriptCachePrewarmDir, e.Name()))
+			if err != nil {
+				return nil, false, err
+			}
+			scripts = append(scripts, string(b))
+		}
+	}
+	return scripts, true, nil
+}
+
+func (c *Config) IPPolicies() ([]deno.IPPolicy, error) {
 	var policies []deno.IPPolicy
 
 	if c.DisallowGlobalUnicast {
@@ -56,6 +236,137 @@ func (c *Config) IPPolicies() []deno.IPPolicy {
 	if c.DisallowUnspecified {
 		policies = append(policies, deno.DisallowUnspecified)
 	}
+	if c.DisallowThisNetwork {
+		policies = append(policies, deno.DisallowThisNetwork)
+	}
+	if c.DisallowSharedAddressSpace {
+		policies = append(policies, deno.DisallowSharedAddressSpace)
+	}
+	if c.DisallowBenchmarking {
+		policies = append(policies, deno.DisallowBenchmarking)
+	}
+	if c.DisallowDocumentation {
+		policies = append(policies, deno.DisallowDocumentation)
+	}
+	if c.DisallowSpecialPurpose {
+		policies = append(policies, deno.DisallowSpecialPurpose)
+	}
+	if c.DisallowMetadata {
+		policies = append(policies, deno.DisallowMetadata)
+	}
+
+	if len(c.AllowCIDRs) > 0 {
+		allow, err := deno.ParseCIDRs(c.AllowCIDRs)
+		if err != nil {
+			return nil, err
+		}
+		// The allowed CIDRs take precedence over the policies above.
+		policies = []deno.IPPolicy{deno.AllowCIDRs(allow, policies...)}
+	}
+
+	if len(c.DenyCIDRs) > 0 {
+		deny, err := deno.ParseCIDRs(c.DenyCIDRs)
+		if err != nil {
+			return nil, err
+		}
+		// The denied CIDRs take precedence over the allowed CIDRs.
+		policies = append([]deno.IPPolicy{deno.DisallowCIDRs(deny...)}, policies...)
+	}
+
+	return policies, nil
+}
+
+// Resolver is the resolver of the system, unless DNS_SERVER is configured.
+func (c *Config) Resolver() deno.IPResolver {
+	if c.DNSServer == "" {
+		return deno.NetResolver{}
+	}
+	return deno.NewDNSResolver(deno.DNSResolverOptions{
+		Server:      c.DNSServer,
+		Network:     c.DNSNetwork,
+		Timeout:     time.Duration(c.DNSTimeoutSeconds) * time.Second,
+		NegativeTTL: time.Duration(c.DNSNegativeCacheSeconds) * time.Second,
+	})
+}
+
+func (c *Config) Permissioner(resolver deno.IPResolver) (deno.Permissioner, error) {
+	netPermissioner, err := c.NetPermissioner(resolver)
+	if err != nil {
+		return nil, err
+	}
+
+	m := deno.PermissionerByName{
+		deno.PermissionNameNet: netPermissioner,
+	}
+
+	if c.AllowHrtime {
+		m[deno.PermissionNameHrtime] = deno.AllowHrtime()
+	}
+	if len(c.AllowEnvVariables) > 0 {
+		m[deno.PermissionNameEnv] = deno.AllowEnv(c.AllowEnvVariables...)
+	}
+	if len(c.AllowSysKinds) > 0 {
+		var kinds []deno.SysKind
+		for _, k := range c.AllowSysKinds {
+			kind, ok := deno.ParseSysKind(k)
+			if !ok || kind == deno.SysKindAll {
+				return nil, fmt.Errorf("invalid sys kind: %v", k)
+			}
+			kinds = append(kinds, kind)
+		}
+		m[deno.PermissionNameSys] = deno.AllowSys(kinds...)
+	}
+	if len(c.AllowImportHosts) > 0 {
+		rules, err := deno.ParseHostRules(c.AllowImportHosts)
+		if err != nil {
+			return nil, err
+		}
+		m[deno.PermissionNameImport] = deno.AllowImport(rules...)
+	}
+
+	// Deny if the decision takes too long, for example, a slow DNS lookup.
+	return deno.WithDeadline(m, time.Duration(c.PermissionTimeoutSeconds)*time.Second), nil
+}
+
+// PortRanges returns the port ranges of AllowPorts.
+// They are also checked by the egress proxy.
+func (c *Config) PortRanges() ([]deno.PortRange, error) {
+	ports, err := deno.ParsePortRanges(c.AllowPorts)
+	if err != nil {
+		return nil, err
+	}
+	return ports, nil
+}
+
+func (c *Config) NetPermissioner(resolver deno.IPResolver) (deno.Permissioner, error) {
+	ports, err := c.PortRanges()
+	if err != nil {
+		return nil, err
+	}
+
+	ipPolicies, err := c.IPPolicies()
+	if err != nil {
+		return nil, err
+	}
+
+	// The port and the host are checked before resolving the host.
+	permissioners := []deno.Permissioner{
+		deno.PortPolicy(ports, c.AllowNetWithoutPort),
+	}
+
+	if len(c.AllowHosts) > 0 || len(c.DenyHosts) > 0 {
+		allow, err := deno.ParseHostRules(c.AllowHosts)
+		if err != nil {
+			return nil, err
+		}
+		deny, err := deno.ParseHostRules(c.DenyHosts)
+		if err != nil {
+			return nil, err
+		}
+		permissioners = append(permissioners, deno.HostPolicy(allow, deny))
+	}
+
+	permissioners = append(permissioners, deno.DisallowIPPolicy(ipPolicies...).WithResolver(resolver))
 
-	return policies
+	return deno.AllOf(permissioners...), nil
 }
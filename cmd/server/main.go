@@ -1,11 +1,20 @@
 package main
 
 import (
+	"context"
+	"expvar"
+	"log/slog"
+	"net"
 	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
 	"time"
 
 	"github.com/authgear/authgear-deno/pkg/deno"
 	"github.com/authgear/authgear-deno/pkg/handler"
+	"github.com/authgear/authgear-deno/pkg/ioutil"
 )
 
 func main() {
@@ -14,10 +23,122 @@ func main() {
 		panic(err)
 	}
 
-	runHandler := handler.NewRunner(&deno.Runner{
-		Permissioner: deno.DisallowIPPolicy(cfg.IPPolicies()...),
-	}, cfg.RunMaxConcurrency, cfg.RunnerTimeoutSeconds)
+	// The resolver is shared so that the cache of DNS_SERVER is shared.
+	resolver := cfg.Resolver()
+
+	// Fail early if the permission prompts of deno are not recognized.
+	denoVersion, err := deno.DetectDenoVersion(context.Background())
+	if err != nil {
+		panic(err)
+	}
+	_, err = deno.NewPromptParser(denoVersion)
+	if err != nil {
+		panic(err)
+	}
+	slog.Info("deno", slog.String("version", denoVersion.String()))
+
+	// The cache is shared by the runners of every snapshot.
+	scriptCache, err := cfg.ScriptCache()
+	if err != nil {
+		panic(err)
+	}
+
+	// The metrics are shared by the pools of every snapshot, and served at /debug/vars.
+	poolMetrics := &deno.PoolMetrics{}
+	expvar.Publish("runner_pool", expvar.Func(func() any {
+		return poolMetrics.Stats()
+	}))
+
+	router := &proxyRouter{}
+	factory := &snapshotFactory{
+		base:        cfg,
+		resolver:    resolver,
+		denoVersion: denoVersion,
+		poolMetrics: poolMetrics,
+		scriptCache: scriptCache,
+		router:      router,
+	}
+
+	if cfg.EgressProxyEnabled {
+		listener, err := net.Listen("tcp", cfg.EgressProxyListenAddr)
+		if err != nil {
+			panic(err)
+		}
+		proxyServer := &http.Server{
+			Handler:           router,
+			ReadHeaderTimeout: 3 * time.Second,
+		}
+		go func() {
+			err := proxyServer.Serve(listener)
+			if err != nil {
+				panic(err)
+			}
+		}()
+		factory.proxyAddr = listener.Addr().String()
+	}
+
+	// Fail early if the policy file is invalid.
+	current, err := factory.New()
+	if err != nil {
+		panic(err)
+	}
+	router.Add(current)
+
+	// The scripts are compiled behind the egress proxy of the snapshot, like a run.
+	prewarmScripts, ok, err := cfg.PrewarmScripts()
+	if err != nil {
+		panic(err)
+	}
+	if ok {
+		err = current.runner.Prewarm(context.Background(), prewarmScripts...)
+		if err != nil {
+			panic(err)
+		}
+	}
+
+	runHandler := handler.NewRunner(current.runner, current.cfg.RunMaxConcurrency, current.cfg.RunnerTimeoutSeconds)
+	runHandler.Resolver = resolver
+
+	var reloadMutex sync.Mutex
+	reload := func() {
+		reloadMutex.Lock()
+		defer reloadMutex.Unlock()
+
+		next, err := factory.New()
+		if err != nil {
+			// Keep the current policy.
+			slog.Error("policy file", slog.String("file", cfg.PolicyFile), slog.Any("error", err))
+			return
+		}
+		router.Add(next)
+		drained := runHandler.Update(next.runner, next.cfg.RunMaxConcurrency, next.cfg.RunnerTimeoutSeconds)
+		previous := current
+		go func() {
+			<-drained
+			router.Retire(previous)
+		}()
+		current = next
+		slog.Info("policy file reloaded", slog.String("file", cfg.PolicyFile))
+	}
+
+	if cfg.PolicyFile != "" {
+		sighup := make(chan os.Signal, 1)
+		signal.Notify(sighup, syscall.SIGHUP)
+		go func() {
+			for range sighup {
+				reload()
+			}
+		}()
+		go ioutil.WatchFile(context.Background(), cfg.PolicyFile, time.Duration(cfg.PolicyFilePollSeconds)*time.Second, reload)
+	}
+
 	http.Handle("/run", runHandler)
+	http.Handle("/run/stream", &handler.StreamRunner{
+		Runner: runHandler,
+	})
+	http.Handle("/permissions/evaluate", &handler.Evaluator{
+		Runner: runHandler,
+	})
 	http.Handle("/check", &handler.Checker{
 		Checker: &deno.Checker{},
 	})
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/authgear/authgear-deno/pkg/deno"
+)
+
+// proxyUsername is the username in the HTTP_PROXY of deno.
+// The password is the ID of the snapshot that the run started with,
+// or the ID of the run if the run has IP policies of its own.
+const proxyUsername = "authgear-deno"
+
+// snapshot is what a run is started with.
+// It is replaced as a whole when the policy file is reloaded,
+// while the runs in flight keep the snapshot they started with.
+type snapshot struct {
+	id     string
+	cfg    *Config
+	runner *deno.Runner
+	// proxy is nil if the egress proxy is disabled.
+	proxy *deno.EgressProxy
+}
+
+// snapshotFactory builds snapshots with what cannot be reloaded.
+type snapshotFactory struct {
+	base        *Config
+	resolver    deno.IPResolver
+	denoVersion deno.DenoVersion
+	poolMetrics *deno.PoolMetrics
+	// scriptCache is nil if the cache is disabled.
+	scriptCache *deno.ScriptCache
+	// proxyAddr is empty if the egress proxy is disabled.
+	proxyAddr string
+	// router routes the connections of the runs that have IP policies of their own.
+	router *proxyRouter
+}
+
+// New reads the policy file, validates it, and builds a snapshot.
+// The pool and the supervisor of the runner of the snapshot are started, and they are closed by proxyRouter.Retire.
+func (f *snapshotFactory) New() (*snapshot, error) {
+	cfg, err := f.base.WithPolicyFile()
+	if err != nil {
+		return nil, err
+	}
+	err = cfg.Validate()
+	if err != nil {
+		return nil, err
+	}
+
+	permissioner, err := cfg.Permissioner(f.resolver)
+	if err != nil {
+		return nil, err
+	}
+
+	id, err := newProxyID()
+	if err != nil {
+		return nil, err
+	}
+
+	runner := &deno.Runner{
+		Permissioner:     permissioner,
+		Logger:           slog.Default(),
+		DenoVersion:      f.denoVersion,
+		StdStreamLimit:   cfg.StdStreamLimitBytes,
+		PoolSize:         cfg.RunnerPoolSize,
+		PoolMetrics:      f.poolMetrics,
+		WorkerMode:       cfg.RunnerWorkerMode,
+		ScriptCache:      f.scriptCache,
+		MemoryLimitBytes: cfg.RunMemoryLimitBytes,
+		MemoryCgroup:     cfg.RunMemoryCgroup,
+		ResourceLimits: deno.ResourceLimits{
+			CPUSeconds:    cfg.RunCPULimitSeconds,
+			OpenFiles:     cfg.RunOpenFilesLimit,
+			FileSizeBytes: cfg.RunFileSizeLimitBytes,
+			Processes:     cfg.RunProcessesLimit,
+		},
+		KillGracePeriod: time.Duration(cfg.RunKillGracePeriodSeconds) * time.Second,
+	}
+
+	var proxy *deno.EgressProxy
+	if f.proxyAddr != "" {
+		ipPolicies, err := cfg.IPPolicies()
+		if err != nil {
+			return nil, err
+		}
+		ports, err := cfg.PortRanges()
+		if err != nil {
+			return nil, err
+		}
+		proxy = &deno.EgressProxy{
+			Resolver:   f.resolver,
+			Disallow:   ipPolicies,
+			AllowPorts: ports,
+		}
+		runner.HTTPProxy = f.proxyURL(id)
+		runner.RunProxy = func(runIPPolicies []deno.IPPolicy, runPorts []deno.PortRange) (string, func(), error) {
+			runID, err := newProxyID()
+			if err != nil {
+				return "", nil, err
+			}
+			// A connection is denied if any of the policies denies it.
+			disallow := append(slices.Clone(ipPolicies), runIPPolicies...)
+			allowPorts := ports
+			if runPorts != nil {
+				allowPorts = deno.IntersectPortRanges(ports, runPorts)
+			}
+			runProxy := &deno.EgressProxy{
+				Resolver:   f.resolver,
+				Disallow:   disallow,
+				AllowPorts: allowPorts,
+			}
+			f.router.add(runID, runProxy)
+			release := func() {
+				f.router.remove(runID)
+				runProxy.CloseIdleConnections()
+			}
+			return f.proxyURL(runID), release, nil
+		}
+	}
+
+	err = runner.Start()
+	if err != nil {
+		return nil, err
+	}
+
+	return &snapshot{
+		id:     id,
+		cfg:    cfg,
+		runner: runner,
+		proxy:  proxy,
+	}, nil
+}
+
+func (f *snapshotFactory) proxyURL(id string) string {
+	proxyURL := url.URL{
+		Scheme: "http",
+		User:   url.UserPassword(proxyUsername, id),
+		Host:   f.proxyAddr,
+	}
+	return proxyURL.String()
+}
+
+func newProxyID() (string, error) {
+	b := make([]byte, 16)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// proxyRouter routes the connections of deno to the EgressProxy of the snapshot that the run started with,
+// or to the EgressProxy of the run if the run has IP policies of its own.
+type proxyRouter struct {
+	mutex   sync.Mutex
+	proxies map[string]*deno.EgressProxy
+}
+
+func (r *proxyRouter) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	// Proxy-Authorization has the same format as Authorization.
+	auth := &http.Request{Header: http.Header{"Authorization": req.Header.Values("Proxy-Authorization")}}
+	username, id, ok := auth.BasicAuth()
+
+	r.mutex.Lock()
+	proxy := r.proxies[id]
+	r.mutex.Unlock()
+
+	if !ok || username != proxyUsername || proxy == nil {
+		w.Header().Set("Proxy-Authenticate", `Basic realm="authgear-deno"`)
+		http.Error(w, "proxy authentication required", http.StatusProxyAuthRequired)
+		return
+	}
+	proxy.ServeHTTP(w, req)
+}
+
+func (r *proxyRouter) Add(s *snapshot) {
+	if s.proxy == nil {
+		return
+	}
+	r.add(s.id, s.proxy)
+}
+
+func (r *proxyRouter) add(id string, proxy *deno.EgressProxy) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if r.proxies == nil {
+		r.proxies = make(map[string]*deno.EgressProxy)
+	}
+	r.proxies[id] = proxy
+}
+
+func (r *proxyRouter) remove(id string) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	delete(r.proxies, id)
+}
+
+// Retire closes the runner of s, and removes the EgressProxy of s.
+// It is called when the runs started with s have ended.
+func (r *proxyRouter) Retire(s *snapshot) {
+	s.runner.Close()
+
+	if s.proxy == nil {
+		return
+	}
+	r.remove(s.id)
+	s.proxy.CloseIdleConnections()
+}
@@ -8,6 +8,8 @@ require (
 	github.com/creack/pty v1.1.21
 	github.com/kelseyhightower/envconfig v1.4.0
 	github.com/smartystreets/goconvey v1.8.1
+	golang.org/x/net v0.58.0
+	sigs.k8s.io/yaml v1.4.0
 )
 
 require (
@@ -0,0 +1,109 @@
+package deno
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"time"
+)
+
+// ErrPromptNotRequested means deno prompted for a permission that runner.ts did not request on the control channel.
+// It happens when the target script uses an API that runner.ts does not know, or when the prompt is forged.
+var ErrPromptNotRequested = errors.New("permission prompt not requested on the control channel")
+
+// ErrorUnrecognizedPrompt means deno prompted for a permission that the PromptParser does not know.
+// It usually means deno has been upgraded to a version that words the prompt differently.
+type ErrorUnrecognizedPrompt struct {
+	Line string
+}
+
+func (e *ErrorUnrecognizedPrompt) Error() string {
+	return fmt.Sprintf("unrecognized permission prompt: %v", e.Line)
+}
+
+// PermissionEvent records the decision of a permission request.
+type PermissionEvent struct {
+	Descriptor  PermissionDescriptor `json:"descriptor"`
+	Granted     bool                 `json:"granted"`
+	Reason      string               `json:"reason,omitempty"`
+	ResolvedIPs []net.IP             `json:"resolved_ips,omitempty"`
+	Timestamp   time.Time            `json:"timestamp"`
+	// Error is the reason of the denial.
+	Error error `json:"-"`
+}
+
+func NewPermissionEvent(d PermissionDescriptor) *PermissionEvent {
+	return &PermissionEvent{
+		Descriptor: d,
+		Timestamp:  time.Now().UTC(),
+	}
+}
+
+func (e *PermissionEvent) Decide(granted bool, err error) {
+	e.Granted = granted
+	e.Error = err
+	if err != nil {
+		e.Reason = err.Error()
+	}
+}
+
+func (e *PermissionEvent) LogAttrs() []slog.Attr {
+	attrs := []slog.Attr{
+		slog.String("name", string(e.Descriptor.Name)),
+		slog.Bool("granted", e.Granted),
+	}
+	if e.Descriptor.Command != "" {
+		attrs = append(attrs, slog.String("command", e.Descriptor.Command))
+	}
+	if e.Descriptor.Path != "" {
+		attrs = append(attrs, slog.String("path", e.Descriptor.Path))
+	}
+	if e.Descriptor.Host != nil {
+		attrs = append(attrs, slog.String("host", e.Descriptor.Host.String()))
+	}
+	if e.Descriptor.Variable != "" {
+		attrs = append(attrs, slog.String("variable", e.Descriptor.Variable))
+	}
+	if e.Descriptor.Kind != SysKindAll {
+		attrs = append(attrs, slog.String("kind", string(e.Descriptor.Kind)))
+	}
+	if e.Reason != "" {
+		attrs = append(attrs, slog.String("reason", e.Reason))
+	}
+	if len(e.ResolvedIPs) > 0 {
+		var ips []string
+		for _, ip := range e.ResolvedIPs {
+			ips = append(ips, ip.String())
+		}
+		attrs = append(attrs, slog.Any("resolved_ips", ips))
+	}
+	return attrs
+}
+
+type permissionEventContextKey struct{}
+
+// WithPermissionEvent lets the Permissioner record what it finds out in e, like the resolved IPs.
+func WithPermissionEvent(ctx context.Context, e *PermissionEvent) context.Context {
+	return context.WithValue(ctx, permissionEventContextKey{}, e)
+}
+
+func recordResolvedIPs(ctx context.Context, ips []net.IP) {
+	e, ok := ctx.Value(permissionEventContextKey{}).(*PermissionEvent)
+	if !ok {
+		return
+	}
+	for _, ip := range ips {
+		seen := false
+		for _, resolved := range e.ResolvedIPs {
+			if resolved.Equal(ip) {
+				seen = true
+				break
+			}
+		}
+		if !seen {
+			e.ResolvedIPs = append(e.ResolvedIPs, ip)
+		}
+	}
+}
@@ -0,0 +1,324 @@
+package deno
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"sync"
+)
+
+// The control channel is a pair of pipes between the Go process and runner.ts.
+// runner.ts writes messages to ControlChannelOut and reads replies from ControlChannelIn.
+// Every message from runner.ts carries the token that runner.ts reads from ControlTokenEnv
+// before the target script is imported, so the target script cannot forge messages.
+//
+// A permission prompt on the pty is answered with the decision of the same permission
+// that runner.ts has asked for on the control channel beforehand.
+// The other prompts are denied, as the target script can write a prompt to the pty by itself.
+// The only exception is the import of remote modules, which deno prompts for while it loads the modules,
+// and which are decided as they appear only while runner.ts has told that the modules are being loaded.
+// That ends before any code of the target script runs.
+const (
+	ControlChannelOut = "/dev/fd/3"
+	ControlChannelIn  = "/dev/fd/4"
+	ControlTokenEnv   = "AUTHGEAR_DENO_CONTROL_TOKEN"
+)
+
+type ControlMessageType string
+
+const (
+	ControlMessageTypePermission ControlMessageType = "permission"
+	ControlMessageTypeStderr     ControlMessageType = "stderr"
+	ControlMessageTypeLog        ControlMessageType = "log"
+	ControlMessageTypeImport     ControlMessageType = "import"
+)
+
+type ControlMessage struct {
+	Token string             `json:"token"`
+	ID    int                `json:"id,omitempty"`
+	Type  ControlMessageType `json:"type"`
+	// permission
+	Descriptor *PermissionDescriptor `json:"descriptor,omitempty"`
+	// stderr
+	Data string `json:"data,omitempty"`
+	// log
+	Log *LogRecord `json:"log,omitempty"`
+	// import
+	Importing bool `json:"importing,omitempty"`
+}
+
+type ControlReply struct {
+	ID      int  `json:"id"`
+	Granted bool `json:"granted"`
+}
+
+// PermissionBroker serves the control channel of a single run.
+type PermissionBroker struct {
+	// Permissioner decides the permission requests received from the control channel.
+	Permissioner Permissioner
+	// Stderr receives what the target script writes to stderr.
+	Stderr io.Writer
+	// StderrLimit is the size of the largest stderr message. StdStreamLimit is used if it is zero.
+	StderrLimit int64
+	// Logs keeps the console calls of the target script, if it is not nil.
+	Logs *LogRecorder
+	// OnEvent is called with each permission event as it is recorded, if it is not nil.
+	// It is called in the order of Events, and must not call the methods of PermissionBroker.
+	OnEvent func(PermissionEvent)
+
+	token     string
+	mutex     sync.Mutex
+	decisions map[string][]bool
+	events    []PermissionEvent
+	// importing is true while deno loads the modules of the target script.
+	importing bool
+}
+
+func NewPermissionBroker(permissioner Permissioner, stderr io.Writer) (*PermissionBroker, error) {
+	b := make([]byte, 32)
+	_, err := rand.Read(b)
+	if err != nil {
+		return nil, err
+	}
+
+	return &PermissionBroker{
+		Permissioner: permissioner,
+		Stderr:       stderr,
+		token:        hex.EncodeToString(b),
+		decisions:    make(map[string][]bool),
+	}, nil
+}
+
+func (b *PermissionBroker) Token() string {
+	return b.token
+}
+
+// Serve reads messages from r and writes replies to w until r reaches EOF.
+func (b *PermissionBroker) Serve(ctx context.Context, r io.Reader, w io.Writer) error {
+	reader := bufio.NewReaderSize(r, 64*1024)
+	// A stderr message can be as large as the stream limit.
+	limit := b.StderrLimit
+	if limit <= 0 {
+		limit = StdStreamLimit
+	}
+	for {
+		line, err := readLine(reader, int(limit)+64*1024)
+		if errors.Is(err, errLineTooLong) {
+			// Like a log record of a huge object, which would not be kept anyway.
+			continue
+		}
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		var msg ControlMessage
+		err = json.Unmarshal(line, &msg)
+		if err != nil {
+			return err
+		}
+		if msg.Token != b.token {
+			// Forged message. Ignore it.
+			continue
+		}
+
+		switch msg.Type {
+		case ControlMessageTypeStderr:
+			if b.Stderr != nil {
+				_, err = io.WriteString(b.Stderr, msg.Data)
+				if err != nil {
+					return err
+				}
+			}
+		case ControlMessageTypeLog:
+			if b.Logs != nil && msg.Log != nil {
+				b.Logs.Record(*msg.Log)
+			}
+		case ControlMessageTypeImport:
+			b.mutex.Lock()
+			b.importing = msg.Importing
+			b.mutex.Unlock()
+			// The reply tells that the prompts to come are decided accordingly.
+			err = json.NewEncoder(w).Encode(ControlReply{
+				ID:      msg.ID,
+				Granted: true,
+			})
+			if err != nil {
+				return err
+			}
+		case ControlMessageTypePermission:
+			granted := false
+			if msg.Descriptor != nil {
+				granted = b.requestPermission(ctx, *msg.Descriptor)
+			}
+			err = json.NewEncoder(w).Encode(ControlReply{
+				ID:      msg.ID,
+				Granted: granted,
+			})
+			if err != nil {
+				return err
+			}
+		}
+	}
+}
+
+var errLineTooLong = errors.New("line too long")
+
+// readLine reads a line of at most max bytes. A longer line is skipped, and errLineTooLong is returned.
+func readLine(r *bufio.Reader, max int) ([]byte, error) {
+	var line []byte
+	tooLong := false
+	for {
+		chunk, err := r.ReadSlice('\n')
+		if !tooLong {
+			if len(line)+len(chunk) > max {
+				tooLong = true
+				line = nil
+			} else {
+				line = append(line, chunk...)
+			}
+		}
+		if errors.Is(err, bufio.ErrBufferFull) {
+			continue
+		}
+		if tooLong {
+			return nil, errLineTooLong
+		}
+		if errors.Is(err, io.EOF) && len(line) > 0 {
+			return line, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		return line, nil
+	}
+}
+
+// Redeem reports whether the permission prompt for d was granted on the control channel.
+// Each decision can be redeemed once.
+// A prompt that runner.ts has not requested is denied with ErrPromptNotRequested,
+// except the import of remote modules while the modules of the target script are being loaded,
+// which is decided with Decide.
+func (b *PermissionBroker) Redeem(ctx context.Context, d PermissionDescriptor) bool {
+	key, err := permissionDescriptorKey(d)
+	if err != nil {
+		return false
+	}
+
+	b.mutex.Lock()
+	decisions := b.decisions[key]
+	if len(decisions) > 0 {
+		// The event of a requested permission has been recorded.
+		defer b.mutex.Unlock()
+		b.decisions[key] = decisions[1:]
+		return decisions[0]
+	}
+	if d.Name == PermissionNameImport && b.importing {
+		b.mutex.Unlock()
+		return b.Decide(ctx, d)
+	}
+	defer b.mutex.Unlock()
+	// So only record the event of a permission that is not requested.
+	event := NewPermissionEvent(d)
+	event.Decide(false, ErrPromptNotRequested)
+	b.appendEvent(*event)
+	return false
+}
+
+// Decide decides d with Permissioner directly.
+// It is for the prompts that runner.ts cannot request beforehand, like the import of remote modules.
+func (b *PermissionBroker) Decide(ctx context.Context, d PermissionDescriptor) bool {
+	event := b.decide(ctx, d)
+
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.appendEvent(*event)
+	return event.Granted
+}
+
+// Record records the decision that deno has made on d by itself, like in a Web Worker.
+// The reason of a denial is the static decision of Permissioner,
+// or ErrNotStatic if Permissioner would have granted d at the time it was requested.
+func (b *PermissionBroker) Record(d PermissionDescriptor, granted bool) {
+	event := NewPermissionEvent(d)
+	switch {
+	case granted:
+		event.Decide(true, nil)
+	case b.Permissioner == nil:
+		event.Decide(false, &ErrorNoPermissioner{Name: d.Name})
+	default:
+		_, err := requestStaticPermission(b.Permissioner, d)
+		if err == nil {
+			err = ErrNotStatic
+		}
+		event.Decide(false, err)
+	}
+
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.appendEvent(*event)
+}
+
+// RecordUnrecognizedPrompt records the denial of a prompt that cannot be parsed.
+func (b *PermissionBroker) RecordUnrecognizedPrompt(line string) {
+	event := NewPermissionEvent(PermissionDescriptor{})
+	event.Decide(false, &ErrorUnrecognizedPrompt{Line: line})
+
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.appendEvent(*event)
+}
+
+// appendEvent must be called with mutex held.
+func (b *PermissionBroker) appendEvent(event PermissionEvent) {
+	b.events = append(b.events, event)
+	if b.OnEvent != nil {
+		b.OnEvent(event)
+	}
+}
+
+// Events returns the permission events in the order of occurrence.
+func (b *PermissionBroker) Events() []PermissionEvent {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return append([]PermissionEvent(nil), b.events...)
+}
+
+func (b *PermissionBroker) decide(ctx context.Context, d PermissionDescriptor) *PermissionEvent {
+	event := NewPermissionEvent(d)
+	if b.Permissioner == nil {
+		event.Decide(false, &ErrorNoPermissioner{Name: d.Name})
+	} else {
+		event.Decide(deny(b.Permissioner.RequestPermission(WithPermissionEvent(ctx, event), d)))
+	}
+	return event
+}
+
+func (b *PermissionBroker) requestPermission(ctx context.Context, d PermissionDescriptor) bool {
+	event := b.decide(ctx, d)
+
+	key, err := permissionDescriptorKey(d)
+	if err != nil {
+		return false
+	}
+
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.appendEvent(*event)
+	b.decisions[key] = append(b.decisions[key], event.Granted)
+	return event.Granted
+}
+
+func permissionDescriptorKey(d PermissionDescriptor) (string, error) {
+	b, err := json.Marshal(d)
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
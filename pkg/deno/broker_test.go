@@ -0,0 +1,168 @@
+package deno_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/authgear/authgear-deno/pkg/deno"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestPermissionBroker(t *testing.T) {
+	Convey("PermissionBroker", t, func() {
+		ctx := context.Background()
+		var stderr bytes.Buffer
+		broker, err := deno.NewPermissionBroker(deno.DisallowIPPolicy(
+			deno.DisallowLoopback,
+		), &stderr)
+		So(err, ShouldBeNil)
+
+		message := func(token string, msg string) string {
+			var m map[string]interface{}
+			_ = json.Unmarshal([]byte(msg), &m)
+			m["token"] = token
+			b, _ := json.Marshal(m)
+			return string(b) + "\n"
+		}
+
+		Convey("grant a ticket which can be redeemed once", func() {
+			in := message(broker.Token(), `{"id":1,"type":"permission","descriptor":{"name":"net","host":"1.1.1.1:443"}}`) +
+				message(broker.Token(), `{"id":2,"type":"permission","descriptor":{"name":"net","host":"127.0.0.1:443"}}`)
+			var out bytes.Buffer
+			err := broker.Serve(ctx, strings.NewReader(in), &out)
+			So(err, ShouldBeNil)
+			So(out.String(), ShouldEqual, `{"id":1,"granted":true}`+"\n"+`{"id":2,"granted":false}`+"\n")
+
+			d, ok := deno.LineToPermissionDescriptor(`Deno requests net access to "1.1.1.1:443".`)
+			So(ok, ShouldBeTrue)
+			So(broker.Redeem(ctx, *d), ShouldBeTrue)
+			So(broker.Redeem(ctx, *d), ShouldBeFalse)
+
+			d, ok = deno.LineToPermissionDescriptor(`Deno requests net access to "127.0.0.1:443".`)
+			So(ok, ShouldBeTrue)
+			So(broker.Redeem(ctx, *d), ShouldBeFalse)
+
+			d, ok = deno.LineToPermissionDescriptor(`Deno requests env access to "PATH".`)
+			So(ok, ShouldBeTrue)
+			So(broker.Redeem(ctx, *d), ShouldBeFalse)
+
+			events := broker.Events()
+			So(events, ShouldHaveLength, 4)
+			for i := range events {
+				So(events[i].Timestamp.IsZero(), ShouldBeFalse)
+				events[i].Timestamp = time.Time{}
+				events[i].Error = nil
+			}
+			b, err := json.Marshal(events)
+			So(err, ShouldBeNil)
+			So(string(b), ShouldEqualJSON, `[
+				{"descriptor":{"name":"net","host":"1.1.1.1:443"},"granted":true,"resolved_ips":["1.1.1.1"],"timestamp":"0001-01-01T00:00:00Z"},
+				{"descriptor":{"name":"net","host":"127.0.0.1:443"},"granted":false,"reason":"loopback: 127.0.0.1","resolved_ips":["127.0.0.1"],"timestamp":"0001-01-01T00:00:00Z"},
+				{"descriptor":{"name":"net","host":"1.1.1.1:443"},"granted":false,"reason":"permission prompt not requested on the control channel","timestamp":"0001-01-01T00:00:00Z"},
+				{"descriptor":{"name":"env","variable":"PATH"},"granted":false,"reason":"permission prompt not requested on the control channel","timestamp":"0001-01-01T00:00:00Z"}
+			]`)
+		})
+
+		Convey("decide the imports only while the modules are being loaded", func() {
+			broker.Permissioner = deno.AllowAll()
+			d := deno.PermissionDescriptor{Name: deno.PermissionNameImport, Host: &deno.HostPort{Host: "1.1.1.1", Port: "443"}}
+			So(broker.Redeem(ctx, d), ShouldBeFalse)
+
+			var out bytes.Buffer
+			err := broker.Serve(ctx, strings.NewReader(message(broker.Token(), `{"id":1,"type":"import","importing":true}`)), &out)
+			So(err, ShouldBeNil)
+			So(out.String(), ShouldEqual, `{"id":1,"granted":true}`+"\n")
+			So(broker.Redeem(ctx, d), ShouldBeTrue)
+			netD := deno.PermissionDescriptor{Name: deno.PermissionNameNet, Host: &deno.HostPort{Host: "1.1.1.1", Port: "443"}}
+			So(broker.Redeem(ctx, netD), ShouldBeFalse)
+
+			err = broker.Serve(ctx, strings.NewReader(message(broker.Token(), `{"id":2,"type":"import"}`)), &out)
+			So(err, ShouldBeNil)
+			So(broker.Redeem(ctx, d), ShouldBeFalse)
+
+			events := broker.Events()
+			So(events, ShouldHaveLength, 4)
+			So(errors.Is(events[0].Error, deno.ErrPromptNotRequested), ShouldBeTrue)
+			So(events[1].Granted, ShouldBeTrue)
+			So(errors.Is(events[2].Error, deno.ErrPromptNotRequested), ShouldBeTrue)
+			So(errors.Is(events[3].Error, deno.ErrPromptNotRequested), ShouldBeTrue)
+		})
+
+		Convey("forward stderr", func() {
+			in := message(broker.Token(), `{"type":"stderr","data":"hello\n"}`)
+			var out bytes.Buffer
+			err := broker.Serve(ctx, strings.NewReader(in), &out)
+			So(err, ShouldBeNil)
+			So(stderr.String(), ShouldEqual, "hello\n")
+		})
+
+		Convey("keep the log records in order", func() {
+			broker.Logs = deno.NewLogRecorder(deno.StdStreamLimit)
+			in := message(broker.Token(), `{"type":"log","log":{"level":"log","timestamp":"2024-01-01T00:00:00Z","message":"a 1","args":["a",1]}}`) +
+				message(broker.Token(), `{"type":"log","log":{"level":"error","timestamp":"2024-01-01T00:00:01Z","message":"b","args":["b"]}}`)
+			var out bytes.Buffer
+			err := broker.Serve(ctx, strings.NewReader(in), &out)
+			So(err, ShouldBeNil)
+
+			b, err := json.Marshal(broker.Logs.Records())
+			So(err, ShouldBeNil)
+			So(string(b), ShouldEqualJSON, `[
+				{"level":"log","timestamp":"2024-01-01T00:00:00Z","message":"a 1","args":["a",1]},
+				{"level":"error","timestamp":"2024-01-01T00:00:01Z","message":"b","args":["b"]}
+			]`)
+			So(broker.Logs.Exceeded(), ShouldBeFalse)
+		})
+
+		Convey("skip the messages that are too large", func() {
+			broker.StderrLimit = 1
+			huge := strings.Repeat("a", 128*1024)
+			in := message(broker.Token(), `{"type":"stderr","data":"`+huge+`"}`) +
+				message(broker.Token(), `{"id":1,"type":"permission","descriptor":{"name":"net","host":"1.1.1.1:443"}}`)
+			var out bytes.Buffer
+			err := broker.Serve(ctx, strings.NewReader(in), &out)
+			So(err, ShouldBeNil)
+			So(stderr.String(), ShouldEqual, "")
+			So(out.String(), ShouldEqual, `{"id":1,"granted":true}`+"\n")
+		})
+
+		Convey("record the decisions of deno", func() {
+			var descriptors []deno.PermissionDescriptor
+			err := json.Unmarshal([]byte(`[
+				{"name":"net","host":"1.1.1.1:443"},
+				{"name":"net","host":"127.0.0.1:443"},
+				{"name":"net","host":"example.com:443"}
+			]`), &descriptors)
+			So(err, ShouldBeNil)
+
+			broker.Record(descriptors[0], true)
+			broker.Record(descriptors[1], false)
+			broker.Record(descriptors[2], false)
+
+			events := broker.Events()
+			So(events, ShouldHaveLength, 3)
+			So(events[0].Granted, ShouldBeTrue)
+			So(events[1].Reason, ShouldEqual, "loopback: 127.0.0.1")
+			So(events[2].Reason, ShouldEqual, "permission cannot be decided statically")
+		})
+
+		Convey("ignore forged messages", func() {
+			in := message("forged", `{"id":1,"type":"permission","descriptor":{"name":"net","host":"1.1.1.1:443"}}`) +
+				message("forged", `{"type":"stderr","data":"hello\n"}`)
+			var out bytes.Buffer
+			err := broker.Serve(ctx, strings.NewReader(in), &out)
+			So(err, ShouldBeNil)
+			So(out.String(), ShouldEqual, "")
+			So(stderr.String(), ShouldEqual, "")
+
+			d, ok := deno.LineToPermissionDescriptor(`Deno requests net access to "1.1.1.1:443".`)
+			So(ok, ShouldBeTrue)
+			So(broker.Redeem(ctx, *d), ShouldBeFalse)
+		})
+	})
+}
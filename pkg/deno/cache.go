@@ -0,0 +1,255 @@
+package deno
+
+import (
+	"container/list"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ScriptCache stores the target scripts under their content hash,
+// so that deno finds the compiled script of a previous run in its DENO_DIR.
+// The least recently used scripts that are not in use are evicted, with their compiled output,
+// when the total size of the scripts exceeds the maximum.
+// Only the scripts count towards the maximum. The rest of DENO_DIR, like the compiled output
+// and the remote modules that the scripts import, is not counted, and the remote modules are never evicted.
+type ScriptCache struct {
+	dir      string
+	maxBytes int64
+
+	mutex   sync.Mutex
+	entries map[string]*list.Element
+	// lru is the entries, the most recently used at the front.
+	lru  *list.List
+	size int64
+}
+
+type scriptCacheEntry struct {
+	hash string
+	size int64
+	// pins is the number of runs that are using the script.
+	pins int
+}
+
+const scriptCacheExt = ".ts"
+
+// NewScriptCache uses dir as the cache. The scripts already in dir are kept,
+// the most recently modified being the most recently used.
+func NewScriptCache(dir string, maxBytes int64) (*ScriptCache, error) {
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return nil, err
+	}
+	c := &ScriptCache{
+		dir:      dir,
+		maxBytes: maxBytes,
+		entries:  make(map[string]*list.Element),
+		lru:      list.New(),
+	}
+
+	for _, d := range []string{c.scriptDir(), c.DenoDir()} {
+		err = os.MkdirAll(d, 0o700)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	dirEntries, err := os.ReadDir(c.scriptDir())
+	if err != nil {
+		return nil, err
+	}
+	var infos []os.FileInfo
+	for _, e := range dirEntries {
+		if e.IsDir() || !strings.HasSuffix(e.Name(), scriptCacheExt) {
+			continue
+		}
+		info, err := e.Info()
+		if err != nil {
+			return nil, err
+		}
+		infos = append(infos, info)
+	}
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].ModTime().After(infos[j].ModTime())
+	})
+	for _, info := range infos {
+		entry := &scriptCacheEntry{
+			hash: strings.TrimSuffix(info.Name(), scriptCacheExt),
+			size: info.Size(),
+		}
+		c.entries[entry.hash] = c.lru.PushBack(entry)
+		c.size += entry.size
+	}
+	c.evict()
+
+	return c, nil
+}
+
+// DenoDir is the DENO_DIR of deno, where the compiled scripts are.
+func (c *ScriptCache) DenoDir() string {
+	return filepath.Join(c.dir, "deno")
+}
+
+func (c *ScriptCache) scriptDir() string {
+	return filepath.Join(c.dir, "scripts")
+}
+
+func (c *ScriptCache) path(hash string) string {
+	return filepath.Join(c.scriptDir(), hash+scriptCacheExt)
+}
+
+// Acquire returns the filename of script, writing it if it is not in the cache.
+// The file is not evicted until release is called.
+func (c *ScriptCache) Acquire(script string) (filename string, release func(), err error) {
+	sum := sha256.Sum256([]byte(script))
+	hash := hex.EncodeToString(sum[:])
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	elem, ok := c.entries[hash]
+	if !ok {
+		err = c.write(hash, script)
+		if err != nil {
+			return "", nil, err
+		}
+		elem = c.lru.PushFront(&scriptCacheEntry{
+			hash: hash,
+			size: int64(len(script)),
+		})
+		c.entries[hash] = elem
+		c.size += int64(len(script))
+	} else {
+		// The modification time is the order of use when the cache is loaded again.
+		now := time.Now()
+		_ = os.Chtimes(c.path(hash), now, now)
+	}
+	c.lru.MoveToFront(elem)
+	entry := elem.Value.(*scriptCacheEntry)
+	entry.pins++
+	c.evict()
+
+	var once sync.Once
+	release = func() {
+		once.Do(func() {
+			c.mutex.Lock()
+			defer c.mutex.Unlock()
+			entry.pins--
+			c.evict()
+		})
+	}
+	return c.path(hash), release, nil
+}
+
+// write writes the file of hash atomically, so that deno never reads a partial script.
+func (c *ScriptCache) write(hash string, script string) error {
+	f, err := os.CreateTemp(c.scriptDir(), "tmp.*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	_, err = f.WriteString(script)
+	if err != nil {
+		f.Close()
+		return err
+	}
+	err = f.Close()
+	if err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), c.path(hash))
+}
+
+// evict removes the least recently used scripts that are not in use until the cache fits in maxBytes.
+func (c *ScriptCache) evict() {
+	for elem := c.lru.Back(); elem != nil && c.size > c.maxBytes; {
+		prev := elem.Prev()
+		entry := elem.Value.(*scriptCacheEntry)
+		if entry.pins <= 0 {
+			c.remove(entry)
+			c.lru.Remove(elem)
+			delete(c.entries, entry.hash)
+			c.size -= entry.size
+		}
+		elem = prev
+	}
+}
+
+func (c *ScriptCache) remove(entry *scriptCacheEntry) {
+	filename := c.path(entry.hash)
+	_ = os.Remove(filename)
+	// deno keeps the compiled output of file:///a/b.ts at gen/file/a/b.ts.*
+	compiled, _ := filepath.Glob(filepath.Join(c.DenoDir(), "gen", "file", filename) + ".*")
+	for _, f := range compiled {
+		_ = os.Remove(f)
+	}
+}
+
+// Len returns the number of scripts in the cache.
+func (c *ScriptCache) Len() int {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.lru.Len()
+}
+
+// Size returns the total size of the scripts in the cache.
+func (c *ScriptCache) Size() int64 {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.size
+}
+
+// prewarm adds scripts to the cache, and compiles every script in the cache with `deno cache`,
+// started with the environment of environ.
+func (c *ScriptCache) prewarm(ctx context.Context, environ func(cmd *exec.Cmd) []string, scripts ...string) error {
+	for _, script := range scripts {
+		_, release, err := c.Acquire(script)
+		if err != nil {
+			return err
+		}
+		release()
+	}
+
+	c.mutex.Lock()
+	var filenames []string
+	var releases []func()
+	for elem := c.lru.Front(); elem != nil; elem = elem.Next() {
+		entry := elem.Value.(*scriptCacheEntry)
+		entry.pins++
+		filenames = append(filenames, c.path(entry.hash))
+		releases = append(releases, func() {
+			c.mutex.Lock()
+			defer c.mutex.Unlock()
+			entry.pins--
+			c.evict()
+		})
+	}
+	c.mutex.Unlock()
+	defer func() {
+		for _, release := range releases {
+			release()
+		}
+	}()
+
+	if len(filenames) <= 0 {
+		return nil
+	}
+
+	args := append([]string{"cache", "--quiet"}, filenames...)
+	cmd := exec.CommandContext(ctx, "deno", args...) //nolint:gosec
+	cmd.Env = environ(cmd)
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%w\n%v", err, string(out))
+	}
+	return nil
+}
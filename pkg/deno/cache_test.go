@@ -0,0 +1,123 @@
+package deno_test
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/authgear/authgear-deno/pkg/deno"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestScriptCache(t *testing.T) {
+	Convey("ScriptCache", t, func() {
+		dir := t.TempDir()
+		cache, err := deno.NewScriptCache(dir, 10)
+		So(err, ShouldBeNil)
+
+		exists := func(filename string) bool {
+			_, err := os.Stat(filename)
+			return err == nil
+		}
+
+		acquire := func(script string) (string, func()) {
+			filename, release, err := cache.Acquire(script)
+			So(err, ShouldBeNil)
+			content, err := os.ReadFile(filename)
+			So(err, ShouldBeNil)
+			So(string(content), ShouldEqual, script)
+			return filename, release
+		}
+
+		Convey("store a script under its content hash", func() {
+			a1, release1 := acquire("aaaa")
+			a2, release2 := acquire("aaaa")
+			release1()
+			release2()
+			So(a1, ShouldEqual, a2)
+			So(filepath.Base(a1), ShouldEqual, "61be55a8e2f6b4e172338bddf184d6dbee29c98853e0a0485ecee7f27b9af0b4.ts")
+			So(cache.Len(), ShouldEqual, 1)
+			So(cache.Size(), ShouldEqual, 4)
+		})
+
+		Convey("evict the least recently used scripts", func() {
+			a, release := acquire("aaaa")
+			release()
+			b, release := acquire("bbbb")
+			release()
+			_, release = acquire("aaaa")
+			release()
+			_, release = acquire("cccc")
+			release()
+
+			So(cache.Len(), ShouldEqual, 2)
+			So(cache.Size(), ShouldEqual, 8)
+			So(exists(a), ShouldBeTrue)
+			So(exists(b), ShouldBeFalse)
+		})
+
+		Convey("never evict the scripts in use", func() {
+			a, releaseA := acquire("aaaa")
+			b, releaseB := acquire("bbbb")
+			c, releaseC := acquire("cccc")
+			So(cache.Size(), ShouldEqual, 12)
+			So(exists(a), ShouldBeTrue)
+
+			releaseA()
+			So(cache.Size(), ShouldEqual, 8)
+			So(exists(a), ShouldBeFalse)
+			So(exists(b), ShouldBeTrue)
+			So(exists(c), ShouldBeTrue)
+
+			// Releasing twice has no effect.
+			releaseA()
+			releaseB()
+			releaseC()
+			So(cache.Size(), ShouldEqual, 8)
+		})
+
+		Convey("prewarm behind the proxy of the runner", func() {
+			var hosts []string
+			proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				hosts = append(hosts, r.Host)
+				w.Header().Set("Content-Type", "application/typescript")
+				_, _ = io.WriteString(w, "export default 1;")
+			}))
+			defer proxy.Close()
+
+			cache, err := deno.NewScriptCache(t.TempDir(), 1024)
+			So(err, ShouldBeNil)
+			runner := &deno.Runner{
+				HTTPProxy:   proxy.URL,
+				ScriptCache: cache,
+			}
+			err = runner.Prewarm(context.Background(), "import a from 'http://prewarm.test/a.ts'; export default a;")
+			So(err, ShouldBeNil)
+			So(hosts, ShouldResemble, []string{"prewarm.test"})
+			So(cache.Len(), ShouldEqual, 1)
+		})
+
+		Convey("keep the scripts across restarts", func() {
+			a, release := acquire("aaaa")
+			release()
+			b, release := acquire("bbbb")
+			release()
+			// The modification time is the order of use.
+			old := time.Now().Add(-time.Hour)
+			err := os.Chtimes(a, old, old)
+			So(err, ShouldBeNil)
+
+			cache, err := deno.NewScriptCache(dir, 4)
+			So(err, ShouldBeNil)
+			So(cache.Len(), ShouldEqual, 1)
+			So(exists(a), ShouldBeFalse)
+			So(exists(b), ShouldBeTrue)
+		})
+	})
+}
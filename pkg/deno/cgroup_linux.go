@@ -0,0 +1,107 @@
+package deno
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"syscall"
+)
+
+// memoryCgroup is a cgroup v2 that limits the memory, and the number of processes, of a deno process.
+type memoryCgroup struct {
+	dir string
+	fd  *os.File
+}
+
+// newMemoryCgroup creates a child of parent with memory.max set to limitBytes, and pids.max set to processes.
+// A limit is set only if it is positive.
+// parent must have the memory and the pids controllers enabled in its cgroup.subtree_control, for the limits that are set.
+func newMemoryCgroup(parent string, limitBytes int64, processes int64) (*memoryCgroup, error) {
+	b := make([]byte, 8)
+	_, err := rand.Read(b)
+	if err != nil {
+		return nil, err
+	}
+
+	dir := filepath.Join(parent, "authgear-deno-"+hex.EncodeToString(b))
+	err = os.Mkdir(dir, 0o755)
+	if err != nil {
+		return nil, err
+	}
+	c := &memoryCgroup{dir: dir}
+
+	values := make(map[string]string)
+	if limitBytes > 0 {
+		values["memory.max"] = strconv.FormatInt(limitBytes, 10)
+		// Swap would let the process exceed the limit silently.
+		values["memory.swap.max"] = "0"
+	}
+	if processes > 0 {
+		// It counts the threads too.
+		values["pids.max"] = strconv.FormatInt(processes, 10)
+	}
+	for name, value := range values {
+		err = os.WriteFile(filepath.Join(dir, name), []byte(value), 0)
+		if err != nil && !(name == "memory.swap.max" && os.IsNotExist(err)) {
+			c.close()
+			return nil, err
+		}
+	}
+
+	c.fd, err = os.Open(dir)
+	if err != nil {
+		c.close()
+		return nil, err
+	}
+	return c, nil
+}
+
+// apply makes cmd start in the cgroup.
+func (c *memoryCgroup) apply(cmd *exec.Cmd) {
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	cmd.SysProcAttr.UseCgroupFD = true
+	cmd.SysProcAttr.CgroupFD = int(c.fd.Fd())
+}
+
+// oomKilled reports whether the kernel has killed a process of the cgroup for out of memory.
+func (c *memoryCgroup) oomKilled() bool {
+	return c.event("memory.events", "oom_kill") > 0
+}
+
+// processesExceeded reports whether a process or a thread of the cgroup has failed to start because of pids.max.
+func (c *memoryCgroup) processesExceeded() bool {
+	return c.event("pids.events", "max") > 0
+}
+
+// event reads the counter key from the events file name of the cgroup. It is 0 if it cannot be read.
+func (c *memoryCgroup) event(name string, key string) int {
+	b, err := os.ReadFile(filepath.Join(c.dir, name))
+	if err != nil {
+		return 0
+	}
+	for _, line := range bytes.Split(b, []byte("\n")) {
+		value, ok := bytes.CutPrefix(line, []byte(key+" "))
+		if ok {
+			n, err := strconv.Atoi(string(value))
+			if err != nil {
+				return 0
+			}
+			return n
+		}
+	}
+	return 0
+}
+
+// close removes the cgroup. It must be called after the process has exited.
+func (c *memoryCgroup) close() {
+	if c.fd != nil {
+		c.fd.Close()
+	}
+	_ = os.Remove(c.dir)
+}
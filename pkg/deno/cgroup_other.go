@@ -0,0 +1,26 @@
+//go:build !linux
+
+package deno
+
+import (
+	"errors"
+	"os/exec"
+)
+
+type memoryCgroup struct{}
+
+func newMemoryCgroup(parent string, limitBytes int64, processes int64) (*memoryCgroup, error) {
+	return nil, errors.New("cgroup v2 is only available on Linux")
+}
+
+func (c *memoryCgroup) apply(cmd *exec.Cmd) {}
+
+func (c *memoryCgroup) oomKilled() bool {
+	return false
+}
+
+func (c *memoryCgroup) processesExceeded() bool {
+	return false
+}
+
+func (c *memoryCgroup) close() {}
@@ -0,0 +1,264 @@
+package deno
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+)
+
+var ErrDenied = errors.New("denied")
+
+type ErrorNoPermissioner struct {
+	Name PermissionName
+}
+
+func (e *ErrorNoPermissioner) Error() string {
+	return fmt.Sprintf("no permissioner for `%v`", e.Name)
+}
+
+// PermissionerFunc is an adapter to allow the use of ordinary functions as Permissioner.
+type PermissionerFunc func(ctx context.Context, pd PermissionDescriptor) (bool, error)
+
+func (f PermissionerFunc) RequestPermission(ctx context.Context, pd PermissionDescriptor) (bool, error) {
+	return f(ctx, pd)
+}
+
+// PermissionerByName routes each permission request to the Permissioner of its name.
+// The request is denied if there is no Permissioner for its name.
+type PermissionerByName map[PermissionName]Permissioner
+
+func (m PermissionerByName) RequestPermission(ctx context.Context, pd PermissionDescriptor) (bool, error) {
+	p, ok := m[pd.Name]
+	if !ok || p == nil {
+		return false, &ErrorNoPermissioner{Name: pd.Name}
+	}
+	return deny(p.RequestPermission(ctx, pd))
+}
+
+func (m PermissionerByName) StaticPermissions() []PermissionDescriptor {
+	var names []string
+	for name := range m {
+		names = append(names, string(name))
+	}
+	sort.Strings(names)
+
+	var out []PermissionDescriptor
+	for _, name := range names {
+		for _, pd := range staticPermissionsOf(m[PermissionName(name)]) {
+			if pd.Name == PermissionName(name) {
+				out = append(out, pd)
+			}
+		}
+	}
+	return out
+}
+
+func (m PermissionerByName) RequestStaticPermission(pd PermissionDescriptor) (bool, error) {
+	p, ok := m[pd.Name]
+	if !ok || p == nil {
+		return false, &ErrorNoPermissioner{Name: pd.Name}
+	}
+	return requestStaticPermission(p, pd)
+}
+
+type AllOfPermissioner struct {
+	permissioners []Permissioner
+}
+
+// AllOf grants a permission request if every Permissioner grants it.
+// The reason of the first denial is returned.
+func AllOf(permissioners ...Permissioner) AllOfPermissioner {
+	return AllOfPermissioner{
+		permissioners: permissioners,
+	}
+}
+
+func (p AllOfPermissioner) RequestPermission(ctx context.Context, pd PermissionDescriptor) (bool, error) {
+	if len(p.permissioners) <= 0 {
+		return false, &ErrorNoPermissioner{Name: pd.Name}
+	}
+	for _, permissioner := range p.permissioners {
+		ok, err := deny(permissioner.RequestPermission(ctx, pd))
+		if !ok {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+func (p AllOfPermissioner) StaticPermissions() []PermissionDescriptor {
+	return staticPermissionsOf(p.permissioners...)
+}
+
+func (p AllOfPermissioner) RequestStaticPermission(pd PermissionDescriptor) (bool, error) {
+	if len(p.permissioners) <= 0 {
+		return false, &ErrorNoPermissioner{Name: pd.Name}
+	}
+	for _, permissioner := range p.permissioners {
+		ok, err := requestStaticPermission(permissioner, pd)
+		if !ok {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+type AnyOfPermissioner struct {
+	permissioners []Permissioner
+}
+
+// AnyOf grants a permission request if any Permissioner grants it.
+// The reasons of all denials are returned if none grants it.
+func AnyOf(permissioners ...Permissioner) AnyOfPermissioner {
+	return AnyOfPermissioner{
+		permissioners: permissioners,
+	}
+}
+
+func (p AnyOfPermissioner) RequestPermission(ctx context.Context, pd PermissionDescriptor) (bool, error) {
+	if len(p.permissioners) <= 0 {
+		return false, &ErrorNoPermissioner{Name: pd.Name}
+	}
+	var errs []error
+	for _, permissioner := range p.permissioners {
+		ok, err := deny(permissioner.RequestPermission(ctx, pd))
+		if ok {
+			return true, nil
+		}
+		errs = append(errs, err)
+	}
+	return false, errors.Join(errs...)
+}
+
+func (p AnyOfPermissioner) StaticPermissions() []PermissionDescriptor {
+	return staticPermissionsOf(p.permissioners...)
+}
+
+func (p AnyOfPermissioner) RequestStaticPermission(pd PermissionDescriptor) (bool, error) {
+	if len(p.permissioners) <= 0 {
+		return false, &ErrorNoPermissioner{Name: pd.Name}
+	}
+	var errs []error
+	for _, permissioner := range p.permissioners {
+		ok, err := requestStaticPermission(permissioner, pd)
+		if ok {
+			return true, nil
+		}
+		// A Permissioner that cannot decide statically may grant it later.
+		if errors.Is(err, ErrNotStatic) {
+			return false, ErrNotStatic
+		}
+		errs = append(errs, err)
+	}
+	return false, errors.Join(errs...)
+}
+
+type FirstMatchPermissioner struct {
+	permissioners []Permissioner
+}
+
+// FirstMatch lets the first Permissioner that handles the name of a permission request decide.
+// A Permissioner does not handle the name if it returns ErrorNameUnmatched.
+func FirstMatch(permissioners ...Permissioner) FirstMatchPermissioner {
+	return FirstMatchPermissioner{
+		permissioners: permissioners,
+	}
+}
+
+func (p FirstMatchPermissioner) RequestPermission(ctx context.Context, pd PermissionDescriptor) (bool, error) {
+	for _, permissioner := range p.permissioners {
+		ok, err := permissioner.RequestPermission(ctx, pd)
+		var unmatched *ErrorNameUnmatched
+		if errors.As(err, &unmatched) {
+			continue
+		}
+		return deny(ok, err)
+	}
+	return false, &ErrorNoPermissioner{Name: pd.Name}
+}
+
+func (p FirstMatchPermissioner) StaticPermissions() []PermissionDescriptor {
+	return staticPermissionsOf(p.permissioners...)
+}
+
+func (p FirstMatchPermissioner) RequestStaticPermission(pd PermissionDescriptor) (bool, error) {
+	for _, permissioner := range p.permissioners {
+		ok, err := requestStaticPermission(permissioner, pd)
+		var unmatched *ErrorNameUnmatched
+		if errors.As(err, &unmatched) {
+			continue
+		}
+		return ok, err
+	}
+	return false, &ErrorNoPermissioner{Name: pd.Name}
+}
+
+type ErrorPermissionTimeout struct {
+	Timeout time.Duration
+}
+
+func (e *ErrorPermissionTimeout) Error() string {
+	return fmt.Sprintf("permission decision timeout after %v", e.Timeout)
+}
+
+type deadlinePermissioner struct {
+	permissioner Permissioner
+	timeout      time.Duration
+}
+
+// WithDeadline denies a permission request if p cannot decide within timeout.
+// The static permissions of p are kept, as they are decided before deno starts.
+func WithDeadline(p Permissioner, timeout time.Duration) Permissioner {
+	return deadlinePermissioner{
+		permissioner: p,
+		timeout:      timeout,
+	}
+}
+
+func (p deadlinePermissioner) RequestPermission(ctx context.Context, pd PermissionDescriptor) (bool, error) {
+	ctx, cancel := context.WithTimeout(ctx, p.timeout)
+	defer cancel()
+
+	type result struct {
+		ok  bool
+		err error
+	}
+	c := make(chan result, 1)
+	go func() {
+		ok, err := p.permissioner.RequestPermission(ctx, pd)
+		c <- result{ok, err}
+	}()
+
+	select {
+	case r := <-c:
+		// p may fail with its own timeout error at the deadline of ctx, like a DNS query,
+		// possibly before ctx itself is done.
+		if deadline, _ := ctx.Deadline(); !r.ok && !time.Now().Before(deadline) {
+			return false, &ErrorPermissionTimeout{Timeout: p.timeout}
+		}
+		return deny(r.ok, r.err)
+	case <-ctx.Done():
+		return false, &ErrorPermissionTimeout{Timeout: p.timeout}
+	}
+}
+
+func (p deadlinePermissioner) StaticPermissions() []PermissionDescriptor {
+	return staticPermissionsOf(p.permissioner)
+}
+
+func (p deadlinePermissioner) RequestStaticPermission(pd PermissionDescriptor) (bool, error) {
+	return requestStaticPermission(p.permissioner, pd)
+}
+
+// deny makes sure that a denial always has a reason.
+func deny(ok bool, err error) (bool, error) {
+	if err != nil {
+		return false, err
+	}
+	if !ok {
+		return false, ErrDenied
+	}
+	return true, nil
+}
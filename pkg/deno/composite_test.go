@@ -0,0 +1,129 @@
+package deno_test
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/authgear/authgear-deno/pkg/deno"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestCompositePermissioner(t *testing.T) {
+	Convey("CompositePermissioner", t, func() {
+		ctx := context.Background()
+
+		grant := deno.PermissionerFunc(func(ctx context.Context, pd deno.PermissionDescriptor) (bool, error) {
+			return true, nil
+		})
+		denySilently := deno.PermissionerFunc(func(ctx context.Context, pd deno.PermissionDescriptor) (bool, error) {
+			return false, nil
+		})
+
+		test := func(p deno.Permissioner, cases []struct {
+			descriptor string
+			expected   bool
+			err        string
+		}) {
+			for _, c := range cases {
+				Convey(c.descriptor, func() {
+					var pd deno.PermissionDescriptor
+					err := json.Unmarshal([]byte(c.descriptor), &pd)
+					So(err, ShouldBeNil)
+					actual, err := p.RequestPermission(ctx, pd)
+					So(actual, ShouldEqual, c.expected)
+					if c.expected {
+						So(err, ShouldBeNil)
+					} else {
+						So(err, ShouldBeError, c.err)
+					}
+				})
+			}
+		}
+
+		Convey("PermissionerByName", func() {
+			p := deno.PermissionerByName{
+				deno.PermissionNameNet:    deno.DisallowIPPolicy(deno.DisallowLoopback),
+				deno.PermissionNameEnv:    deno.AllowEnv("TZ", "AWS_*"),
+				deno.PermissionNameSys:    deno.AllowSys(deno.SysKindHostname),
+				deno.PermissionNameHrtime: deno.AllowHrtime(),
+				deno.PermissionNameRead:   denySilently,
+				deno.PermissionNameImport: deno.AllowImport(deno.HostRule{Host: "jsr.io"}),
+			}
+			test(p, []struct {
+				descriptor string
+				expected   bool
+				err        string
+			}{
+				{`{"name":"net","host":"1.1.1.1"}`, true, ""},
+				{`{"name":"net","host":"127.0.0.1"}`, false, "loopback: 127.0.0.1"},
+				{`{"name":"env","variable":"TZ"}`, true, ""},
+				{`{"name":"env","variable":"PATH"}`, false, "env not allowed: PATH"},
+				{`{"name":"env","variable":"AWS_REGION"}`, true, ""},
+				{`{"name":"env","variable":"AWS"}`, false, "env not allowed: AWS"},
+				{`{"name":"env"}`, false, "env permission without variable is disallowed"},
+				{`{"name":"sys","kind":"hostname"}`, true, ""},
+				{`{"name":"sys","kind":"uid"}`, false, "sys not allowed: uid"},
+				{`{"name":"sys"}`, false, "sys permission without kind is disallowed"},
+				{`{"name":"hrtime"}`, true, ""},
+				{`{"name":"read","path":"/"}`, false, "denied"},
+				{`{"name":"run"}`, false, "no permissioner for `run`"},
+				{`{"name":"import","host":"jsr.io:443"}`, true, ""},
+				{`{"name":"import","host":"example.com:443"}`, false, "import not allowed: example.com:443"},
+				{`{"name":"import"}`, false, "import permission without host is disallowed"},
+			})
+		})
+
+		Convey("AllOf", func() {
+			test(deno.AllOf(grant, deno.AllowEnv("TZ")), []struct {
+				descriptor string
+				expected   bool
+				err        string
+			}{
+				{`{"name":"env","variable":"TZ"}`, true, ""},
+				{`{"name":"env","variable":"PATH"}`, false, "env not allowed: PATH"},
+				{`{"name":"net","host":"1.1.1.1"}`, false, "name unmatched, expected `env`, actual `net`"},
+			})
+			test(deno.AllOf(), []struct {
+				descriptor string
+				expected   bool
+				err        string
+			}{
+				{`{"name":"hrtime"}`, false, "no permissioner for `hrtime`"},
+			})
+		})
+
+		Convey("AnyOf", func() {
+			test(deno.AnyOf(deno.AllowEnv("TZ"), deno.AllowHrtime()), []struct {
+				descriptor string
+				expected   bool
+				err        string
+			}{
+				{`{"name":"env","variable":"TZ"}`, true, ""},
+				{`{"name":"hrtime"}`, true, ""},
+				{`{"name":"env","variable":"PATH"}`, false, "env not allowed: PATH\nname unmatched, expected `hrtime`, actual `env`"},
+			})
+		})
+
+		Convey("FirstMatch", func() {
+			test(deno.FirstMatch(deno.AllowHrtime(), deno.AllowEnv("TZ"), grant), []struct {
+				descriptor string
+				expected   bool
+				err        string
+			}{
+				{`{"name":"hrtime"}`, true, ""},
+				{`{"name":"env","variable":"TZ"}`, true, ""},
+				{`{"name":"env","variable":"PATH"}`, false, "env not allowed: PATH"},
+				{`{"name":"run"}`, true, ""},
+			})
+			test(deno.FirstMatch(deno.AllowHrtime()), []struct {
+				descriptor string
+				expected   bool
+				err        string
+			}{
+				{`{"name":"ffi"}`, false, "no permissioner for `ffi`"},
+			})
+		})
+	})
+}
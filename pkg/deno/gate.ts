@@ -0,0 +1,10 @@
+// gate.ts is imported by entry.ts before the target script.
+// So it is evaluated after deno has loaded every module that the target script imports statically,
+// and before any of them is evaluated. It tells runner.ts that the modules have been loaded.
+// The function is removed before the target script can see it.
+const gate = Symbol.for("authgear-deno.gate");
+// deno-lint-ignore no-explicit-any
+const loaded = (globalThis as any)[gate];
+// deno-lint-ignore no-explicit-any
+delete (globalThis as any)[gate];
+loaded?.();
@@ -0,0 +1,223 @@
+package deno
+
+import (
+	"context"
+	"fmt"
+	"strings"
+)
+
+type ErrorInvalidHostRule struct {
+	Value string
+}
+
+func (e *ErrorInvalidHostRule) Error() string {
+	return fmt.Sprintf("invalid host rule: %v", e.Value)
+}
+
+type ErrorHostDenied struct {
+	Host *HostPort
+	Rule HostRule
+}
+
+func (e *ErrorHostDenied) Error() string {
+	return fmt.Sprintf("host denied: %v by %v", e.Host, e.Rule)
+}
+
+type ErrorHostNotAllowed struct {
+	Host *HostPort
+}
+
+func (e *ErrorHostNotAllowed) Error() string {
+	return fmt.Sprintf("host not allowed: %v", e.Host)
+}
+
+// HostRule matches the host of network permissions.
+//
+// The forms are
+//
+//	example.com          exactly example.com, any port
+//	example.com:443      exactly example.com, port 443
+//	*.example.com        any subdomain of example.com, but not example.com itself, any port
+//	*.example.com:443    any subdomain of example.com, port 443
+//	10.20.0.5            exactly the IP address, any port
+//	[::1]:443            exactly the IP address, port 443
+type HostRule struct {
+	// Host is the lowercased host, without the leading "*.".
+	Host string
+	// Wildcard is true if the rule matches subdomains of Host.
+	Wildcard bool
+	// Port is empty if the rule matches any port.
+	Port string
+}
+
+func ParseHostRule(s string) (*HostRule, error) {
+	wildcard := false
+	rest := s
+	if strings.HasPrefix(rest, "*.") {
+		wildcard = true
+		rest = strings.TrimPrefix(rest, "*.")
+	}
+
+	hostport, err := ParseHostPort(rest)
+	if err != nil {
+		return nil, &ErrorInvalidHostRule{Value: s}
+	}
+	if hostport == nil || hostport.Host == "" || strings.Contains(hostport.Host, "*") {
+		return nil, &ErrorInvalidHostRule{Value: s}
+	}
+	if wildcard && (hostport.IPv4 != nil || hostport.IPv6 != nil) {
+		return nil, &ErrorInvalidHostRule{Value: s}
+	}
+
+	host := normalizeHost(hostport.Host)
+	if hostport.IPv4 != nil {
+		host = hostport.IPv4.String()
+	}
+	if hostport.IPv6 != nil {
+		host = hostport.IPv6.String()
+	}
+
+	return &HostRule{
+		Host:     host,
+		Wildcard: wildcard,
+		Port:     hostport.Port,
+	}, nil
+}
+
+func ParseHostRules(ss []string) ([]HostRule, error) {
+	var rules []HostRule
+	for _, s := range ss {
+		rule, err := ParseHostRule(s)
+		if err != nil {
+			return nil, err
+		}
+		rules = append(rules, *rule)
+	}
+	return rules, nil
+}
+
+func (r HostRule) String() string {
+	host := r.Host
+	if strings.Contains(host, ":") {
+		host = "[" + host + "]"
+	}
+	if r.Wildcard {
+		host = "*." + host
+	}
+	if r.Port == "" {
+		return host
+	}
+	return host + ":" + r.Port
+}
+
+func (r HostRule) matchHost(p *HostPort) bool {
+	host := normalizeHost(p.Host)
+	if p.IPv4 != nil {
+		host = p.IPv4.String()
+	}
+	if p.IPv6 != nil {
+		host = p.IPv6.String()
+	}
+
+	if r.Wildcard {
+		return strings.HasSuffix(host, "."+r.Host)
+	}
+	return host == r.Host
+}
+
+// MatchAllow reports whether p is allowed by r.
+// A request without port is a request for all ports, so it is not allowed by a rule with port.
+func (r HostRule) MatchAllow(p *HostPort) bool {
+	if !r.matchHost(p) {
+		return false
+	}
+	return r.Port == "" || r.Port == p.Port
+}
+
+// MatchDeny reports whether p is denied by r.
+// A request without port is a request for all ports, so it is denied by a rule with port.
+func (r HostRule) MatchDeny(p *HostPort) bool {
+	if !r.matchHost(p) {
+		return false
+	}
+	return r.Port == "" || p.Port == "" || r.Port == p.Port
+}
+
+func normalizeHost(host string) string {
+	return strings.TrimSuffix(strings.ToLower(host), ".")
+}
+
+type HostPermissioner struct {
+	allow []HostRule
+	deny  []HostRule
+}
+
+// HostPolicy grants network permissions by the host.
+// A host matching any of deny is denied.
+// If allow is non-empty, a host must match any of allow.
+func HostPolicy(allow []HostRule, deny []HostRule) HostPermissioner {
+	return HostPermissioner{
+		allow: allow,
+		deny:  deny,
+	}
+}
+
+func (p HostPermissioner) RequestPermission(ctx context.Context, pd PermissionDescriptor) (bool, error) {
+	if pd.Name != PermissionNameNet {
+		return false, &ErrorNameUnmatched{
+			Expected: PermissionNameNet,
+			Actual:   pd.Name,
+		}
+	}
+
+	if pd.Host == nil {
+		return false, ErrAllHost
+	}
+
+	for _, rule := range p.deny {
+		if rule.MatchDeny(pd.Host) {
+			return false, &ErrorHostDenied{
+				Host: pd.Host,
+				Rule: rule,
+			}
+		}
+	}
+
+	if len(p.allow) <= 0 {
+		return true, nil
+	}
+
+	for _, rule := range p.allow {
+		if rule.MatchAllow(pd.Host) {
+			return true, nil
+		}
+	}
+
+	return false, &ErrorHostNotAllowed{
+		Host: pd.Host,
+	}
+}
+
+// StaticPermissions returns the allow rules without wildcard.
+// The deny rules are applied by RequestStaticPermission.
+func (p HostPermissioner) StaticPermissions() []PermissionDescriptor {
+	var out []PermissionDescriptor
+	for _, rule := range p.allow {
+		if rule.Wildcard {
+			continue
+		}
+		hostport, err := ParseHostPort(rule.String())
+		if err != nil || hostport == nil {
+			continue
+		}
+		out = append(out, PermissionDescriptor{
+			Name: PermissionNameNet,
+			Host: hostport,
+		})
+	}
+	return out
+}
+
+func (p HostPermissioner) RequestStaticPermission(pd PermissionDescriptor) (bool, error) {
+	return p.RequestPermission(context.Background(), pd)
+}
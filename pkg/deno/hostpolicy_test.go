@@ -0,0 +1,90 @@
+package deno_test
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/authgear/authgear-deno/pkg/deno"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestParseHostRule(t *testing.T) {
+	Convey("ParseHostRule", t, func() {
+		cases := []struct {
+			rule     string
+			expected *deno.HostRule
+		}{
+			{"api.sendgrid.com", &deno.HostRule{Host: "api.sendgrid.com"}},
+			{"API.Sendgrid.com.", &deno.HostRule{Host: "api.sendgrid.com"}},
+			{"*.stripe.com", &deno.HostRule{Host: "stripe.com", Wildcard: true}},
+			{"*.stripe.com:443", &deno.HostRule{Host: "stripe.com", Wildcard: true, Port: "443"}},
+			{"10.20.0.5", &deno.HostRule{Host: "10.20.0.5"}},
+			{"[::1]:443", &deno.HostRule{Host: "::1", Port: "443"}},
+		}
+		for _, c := range cases {
+			rule, err := deno.ParseHostRule(c.rule)
+			So(err, ShouldBeNil)
+			So(rule, ShouldResemble, c.expected)
+		}
+
+		for _, invalid := range []string{"", "*", "*.", "a.*.com", "*.10.0.0.1", "example.com:port"} {
+			_, err := deno.ParseHostRule(invalid)
+			So(err, ShouldBeError, "invalid host rule: "+invalid)
+		}
+	})
+}
+
+func TestHostPolicy(t *testing.T) {
+	Convey("HostPolicy", t, func() {
+		ctx := context.Background()
+
+		allow, err := deno.ParseHostRules([]string{"*.stripe.com", "api.sendgrid.com:443", "10.20.0.5"})
+		So(err, ShouldBeNil)
+		deny, err := deno.ParseHostRules([]string{"*.internal.example", "evil.stripe.com:443"})
+		So(err, ShouldBeNil)
+
+		cases := []struct {
+			permissioner deno.Permissioner
+			descriptor   string
+			expected     bool
+			err          string
+		}{
+			{deno.HostPolicy(allow, deny), `{"name":"env"}`, false, "name unmatched, expected `net`, actual `env`"},
+			{deno.HostPolicy(allow, deny), `{"name":"net"}`, false, "network permission without host is disallowed"},
+
+			{deno.HostPolicy(allow, deny), `{"name":"net","host":"api.stripe.com"}`, true, ""},
+			{deno.HostPolicy(allow, deny), `{"name":"net","host":"API.STRIPE.COM:443"}`, true, ""},
+			{deno.HostPolicy(allow, deny), `{"name":"net","host":"stripe.com"}`, false, "host not allowed: stripe.com"},
+			{deno.HostPolicy(allow, deny), `{"name":"net","host":"notstripe.com"}`, false, "host not allowed: notstripe.com"},
+			{deno.HostPolicy(allow, deny), `{"name":"net","host":"api.sendgrid.com:443"}`, true, ""},
+			{deno.HostPolicy(allow, deny), `{"name":"net","host":"api.sendgrid.com:25"}`, false, "host not allowed: api.sendgrid.com:25"},
+			{deno.HostPolicy(allow, deny), `{"name":"net","host":"api.sendgrid.com"}`, false, "host not allowed: api.sendgrid.com"},
+			{deno.HostPolicy(allow, deny), `{"name":"net","host":"10.20.0.5:8080"}`, true, ""},
+			{deno.HostPolicy(allow, deny), `{"name":"net","host":"evil.stripe.com:443"}`, false, "host denied: evil.stripe.com:443 by evil.stripe.com:443"},
+			{deno.HostPolicy(allow, deny), `{"name":"net","host":"evil.stripe.com"}`, false, "host denied: evil.stripe.com by evil.stripe.com:443"},
+			{deno.HostPolicy(allow, deny), `{"name":"net","host":"evil.stripe.com:80"}`, true, ""},
+
+			{deno.HostPolicy(nil, deny), `{"name":"net","host":"example.com"}`, true, ""},
+			{deno.HostPolicy(nil, deny), `{"name":"net","host":"db.internal.example"}`, false, "host denied: db.internal.example by *.internal.example"},
+
+			{deno.AllOf(deno.HostPolicy(allow, deny), deno.DisallowIPPolicy(deno.DisallowPrivate)), `{"name":"net","host":"10.20.0.5"}`, false, "private: 10.20.0.5"},
+		}
+
+		for _, c := range cases {
+			Convey(c.descriptor, func() {
+				var pd deno.PermissionDescriptor
+				err := json.Unmarshal([]byte(c.descriptor), &pd)
+				So(err, ShouldBeNil)
+				actual, err := c.permissioner.RequestPermission(ctx, pd)
+				So(actual, ShouldEqual, c.expected)
+				if c.expected {
+					So(err, ShouldBeNil)
+				} else {
+					So(err, ShouldBeError, c.err)
+				}
+			})
+		}
+	})
+}
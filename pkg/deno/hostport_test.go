@@ -57,5 +57,39 @@ func TestHostPort(t *testing.T) {
 			IPv6: net.ParseIP("::1"),
 			Port: "80",
 		})
+
+		// IPv4-mapped IPv6 address is taken as IPv4 address.
+		hostport, err = deno.ParseHostPort("[::ffff:127.0.0.1]:80")
+		So(err, ShouldBeNil)
+		So(hostport, ShouldResemble, &deno.HostPort{
+			Host: "::ffff:127.0.0.1",
+			IPv4: net.IPv4(127, 0, 0, 1).To4(),
+			Port: "80",
+		})
+
+		hostport, err = deno.ParseHostPort("[64:ff9b::7f00:1]:80")
+		So(err, ShouldBeNil)
+		So(hostport, ShouldResemble, &deno.HostPort{
+			Host: "64:ff9b::7f00:1",
+			IPv6: net.ParseIP("64:ff9b::7f00:1"),
+			Port: "80",
+		})
+		So(deno.EmbeddedIPv4(hostport.IPv6), ShouldResemble, []net.IP{net.IPv4(127, 0, 0, 1).To4()})
+
+		hostport, err = deno.ParseHostPort("[2002:a00:1::1]")
+		So(err, ShouldBeNil)
+		So(deno.EmbeddedIPv4(hostport.IPv6), ShouldResemble, []net.IP{net.IPv4(10, 0, 0, 1).To4()})
+
+		// Teredo server 65.54.227.120, client 192.168.1.1 obfuscated as 3f57:fefe.
+		hostport, err = deno.ParseHostPort("[2001:0:4136:e378:8000:63bf:3f57:fefe]")
+		So(err, ShouldBeNil)
+		So(deno.EmbeddedIPv4(hostport.IPv6), ShouldResemble, []net.IP{
+			net.IPv4(65, 54, 227, 120).To4(),
+			net.IPv4(192, 168, 1, 1).To4(),
+		})
+
+		So(deno.EmbeddedIPv4(net.ParseIP("2606:4700::1111")), ShouldBeNil)
+		So(deno.EmbeddedIPv4(net.ParseIP("::1")), ShouldBeNil)
+		So(deno.EmbeddedIPv4(net.ParseIP("127.0.0.1")), ShouldBeNil)
 	})
 }
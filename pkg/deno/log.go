@@ -0,0 +1,76 @@
+package deno
+
+import (
+	"encoding/json"
+	"sync"
+	"time"
+)
+
+// LogLevel is the console method that the target script has called.
+type LogLevel string
+
+const (
+	LogLevelDebug LogLevel = "debug"
+	LogLevelInfo  LogLevel = "info"
+	LogLevelLog   LogLevel = "log"
+	LogLevelWarn  LogLevel = "warn"
+	LogLevelError LogLevel = "error"
+)
+
+// LogRecord is a call of a console method by the target script.
+type LogRecord struct {
+	Level     LogLevel  `json:"level"`
+	Timestamp time.Time `json:"timestamp"`
+	// Message is what the call writes to stdout or stderr, without the newline.
+	Message string `json:"message"`
+	// Args are the arguments of the call.
+	// An argument that cannot be serialized as JSON is a string formatted by Deno.inspect.
+	Args []json.RawMessage `json:"args,omitempty"`
+}
+
+// LogRecorder keeps the log records of a run in the order of the calls,
+// until their total size would exceed the limit.
+type LogRecorder struct {
+	limit    int64
+	mutex    sync.Mutex
+	records  []LogRecord
+	size     int64
+	exceeded bool
+}
+
+func NewLogRecorder(limit int64) *LogRecorder {
+	return &LogRecorder{
+		limit: limit,
+	}
+}
+
+func (l *LogRecorder) Record(r LogRecord) {
+	size := int64(len(r.Message))
+	for _, arg := range r.Args {
+		size += int64(len(arg))
+	}
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	// Once a record is dropped, the later ones are dropped too, so that the kept ones have no gap.
+	if l.exceeded || l.size+size > l.limit {
+		l.exceeded = true
+		return
+	}
+	l.size += size
+	l.records = append(l.records, r)
+}
+
+// Records returns the records that are kept.
+func (l *LogRecorder) Records() []LogRecord {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return append([]LogRecord(nil), l.records...)
+}
+
+// Exceeded reports whether a record has been dropped.
+func (l *LogRecorder) Exceeded() bool {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return l.exceeded
+}
@@ -0,0 +1,26 @@
+package deno_test
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/authgear/authgear-deno/pkg/deno"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestLogRecorder(t *testing.T) {
+	Convey("LogRecorder", t, func() {
+		logs := deno.NewLogRecorder(10)
+
+		logs.Record(deno.LogRecord{Level: deno.LogLevelLog, Message: "a", Args: []json.RawMessage{[]byte(`"a"`)}})
+		So(logs.Records(), ShouldHaveLength, 1)
+		So(logs.Exceeded(), ShouldBeFalse)
+
+		// A record that does not fit is dropped, and so are the records after it.
+		logs.Record(deno.LogRecord{Level: deno.LogLevelLog, Message: "bbbbbbbbbb"})
+		logs.Record(deno.LogRecord{Level: deno.LogLevelLog, Message: "c"})
+		So(logs.Records(), ShouldHaveLength, 1)
+		So(logs.Exceeded(), ShouldBeTrue)
+	})
+}
@@ -0,0 +1,37 @@
+package deno
+
+import (
+	"errors"
+	"regexp"
+	"strconv"
+)
+
+// ErrOutOfMemory means deno was terminated because the run exceeded Runner.MemoryLimitBytes.
+var ErrOutOfMemory = errors.New("run out of memory")
+
+// memoryCgroupOverhead is added to Runner.MemoryLimitBytes for the limit of the cgroup,
+// as deno uses memory outside the V8 heap, like the array buffers.
+const memoryCgroupOverhead int64 = 128 * 1024 * 1024
+
+// outOfMemoryRegexp matches what V8 writes to stderr before it aborts.
+// It must only be matched against what deno itself writes, as the target script can write it too.
+var outOfMemoryRegexp = regexp.MustCompile(`(?:JavaScript heap out of memory|Fatal JavaScript out of memory|Fatal process out of memory)`)
+
+// v8MemoryFlag limits the old space of the V8 heap, in MiB.
+func v8MemoryFlag(limitBytes int64) string {
+	mib := (limitBytes + 1024*1024 - 1) / (1024 * 1024)
+	return "--v8-flags=--max-old-space-size=" + strconv.FormatInt(mib, 10)
+}
+
+// isOutOfMemory reports whether deno has exited because of out of memory.
+// It is told by the memory.events of cgroup, or by the abort of V8 with its message in stderr,
+// which is what deno itself writes to stderr.
+func isOutOfMemory(waitErr error, stderr []byte, cgroup *memoryCgroup) bool {
+	if waitErr == nil {
+		return false
+	}
+	if cgroup != nil && cgroup.oomKilled() {
+		return true
+	}
+	return isAborted(waitErr) && outOfMemoryRegexp.Match(stderr)
+}
@@ -1,7 +1,11 @@
 package deno
 
 import (
+	"bufio"
+	"fmt"
+	"io"
 	"regexp"
+	"strings"
 )
 
 // On deno < 1.31.0
@@ -18,6 +22,18 @@ import (
 // ┌ ⚠️  Deno requests net access to "0.0.0.0:8080".
 // ├ Requested by `Deno.listen()` API
 // ├ Run again with --allow-net to bypass this prompt.
+// └ Allow? [y/n/A] (y = yes, allow; n = no, deny; A = allow all net permissions) >
+//
+// On deno >= 2.0.0
+// The permission prompt looks like
+//
+// ┏ ⚠️  Deno requests net access to "0.0.0.0:8080".
+// ┠─ Requested by `Deno.listen()` API.
+// ┠─ Learn more at: https://docs.deno.com/go/--allow-net
+// ┠─ Run again with --allow-net to bypass this prompt.
+// ┗ Allow? [y/n/A] (y = yes, allow; n = no, deny; A = allow all net permissions) >
+//
+// The first line is the same across versions, so it is the line being parsed.
 
 var accessToRegexp = regexp.MustCompile(`Deno requests (.+) access to "(.+)"\.`)
 var allAccessRegexp = regexp.MustCompile(`Deno requests (.+) access\.`)
@@ -43,3 +59,101 @@ func LineToPermissionDescriptor(line string) (*PermissionDescriptor, bool) {
 
 	return nil, false
 }
+
+// After the prompt is answered, deno replaces the prompt with
+//
+// ✅ Granted net access to "0.0.0.0:8080".
+//
+// or
+//
+// ❌ Denied net access to "0.0.0.0:8080".
+var promptResultRegexp = regexp.MustCompile(`(✅|❌) (Granted|Denied) `)
+
+func IsPermissionPromptResult(line string) bool {
+	return promptResultRegexp.MatchString(line)
+}
+
+// PromptParser parses the permission prompts of a specific version of deno.
+// The zero value knows the permissions of every supported version.
+type PromptParser struct {
+	Version DenoVersion
+}
+
+func NewPromptParser(version DenoVersion) (*PromptParser, error) {
+	if !version.Supported() {
+		return nil, &ErrorUnsupportedDenoVersion{Version: version}
+	}
+	return &PromptParser{Version: version}, nil
+}
+
+// IsPromptStart reports whether line is the first line of a permission prompt.
+func (p *PromptParser) IsPromptStart(line string) bool {
+	return strings.Contains(line, "Deno requests ")
+}
+
+// LineToPermissionDescriptor is LineToPermissionDescriptor
+// that rejects the permissions that Version does not prompt for.
+func (p *PromptParser) LineToPermissionDescriptor(line string) (*PermissionDescriptor, bool) {
+	d, ok := LineToPermissionDescriptor(line)
+	if !ok || !p.knows(d.Name) {
+		return nil, false
+	}
+	return d, true
+}
+
+func (p *PromptParser) knows(name PermissionName) bool {
+	if p.Version == (DenoVersion{}) {
+		return true
+	}
+	switch name {
+	case PermissionNameHrtime:
+		return p.Version.Less(DenoVersion2_0)
+	case PermissionNameImport:
+		return !p.Version.Less(DenoVersion2_1)
+	default:
+		return true
+	}
+}
+
+// ScanPrompts reads the stderr of deno from r until EOF.
+// Each permission prompt is answered on w with what decide returns.
+// decide receives a nil descriptor if the prompt is not recognized.
+// The lines that are not part of a prompt are written to stderr.
+func (p *PromptParser) ScanPrompts(r io.Reader, w io.Writer, stderr io.Writer, decide func(line string, d *PermissionDescriptor) bool) error {
+	scanner := bufio.NewScanner(r)
+	scanner.Split(ScanStderr)
+	inPrompt := false
+	for scanner.Scan() {
+		line := scanner.Text()
+		// Start of permission prompt
+		if p.IsPromptStart(line) {
+			inPrompt = true
+			d, ok := p.LineToPermissionDescriptor(line)
+			if !ok {
+				d = nil
+			}
+			// Never answer "A", which grants all permissions of the same name.
+			answer := "n"
+			if decide(line, d) {
+				answer = "y"
+			}
+			_, err := fmt.Fprintf(w, "%v\n", answer)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		// The prompt is not what the target script prints.
+		if inPrompt {
+			if IsPermissionPromptResult(line) {
+				inPrompt = false
+			}
+			continue
+		}
+		_, err := fmt.Fprintf(stderr, "%v\n", line)
+		if err != nil {
+			return err
+		}
+	}
+	return scanner.Err()
+}
@@ -1,7 +1,11 @@
 package deno_test
 
 import (
+	"bytes"
 	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 
 	"github.com/authgear/authgear-deno/pkg/deno"
@@ -38,6 +42,10 @@ func TestLineToPermissionDescriptor(t *testing.T) {
 			{`Deno requests sys access to "osRelease".`, `{"name":"sys","kind":"osRelease"}`},
 			{`Deno requests sys access to "uid".`, `{"name":"sys","kind":"uid"}`},
 			{`Deno requests sys access to "gid".`, `{"name":"sys","kind":"gid"}`},
+			{`Deno requests sys access to "cpus".`, `{"name":"sys","kind":"cpus"}`},
+			{`Deno requests sys access to "userInfo".`, `{"name":"sys","kind":"userInfo"}`},
+
+			{`Deno requests import access to "example.com:443".`, `{"name":"import","host":"example.com:443"}`},
 		}
 
 		for _, c := range cases {
@@ -50,3 +58,111 @@ func TestLineToPermissionDescriptor(t *testing.T) {
 		}
 	})
 }
+
+func TestPromptParser(t *testing.T) {
+	Convey("PromptParser", t, func() {
+		Convey("rejects the permissions that the version does not prompt for", func() {
+			cases := []struct {
+				version  string
+				line     string
+				expected bool
+			}{
+				{"1.41.3", `Deno requests access to high precision time.`, true},
+				{"2.1.4", `Deno requests access to high precision time.`, false},
+				{"2.0.6", `Deno requests import access to "example.com:443".`, false},
+				{"2.1.4", `Deno requests import access to "example.com:443".`, true},
+				{"0.0.0", `Deno requests import access to "example.com:443".`, true},
+			}
+			for _, c := range cases {
+				Convey(c.version+" "+c.line, func() {
+					version, err := deno.ParseDenoVersion(c.version)
+					So(err, ShouldBeNil)
+					p := &deno.PromptParser{Version: version}
+					_, ok := p.LineToPermissionDescriptor(c.line)
+					So(ok, ShouldEqual, c.expected)
+				})
+			}
+		})
+
+		Convey("rejects unsupported versions", func() {
+			_, err := deno.NewPromptParser(deno.DenoVersion{Major: 3})
+			So(err, ShouldBeError, "unsupported deno version: 3.0.0")
+			_, err = deno.NewPromptParser(deno.DenoVersion{Major: 1, Minor: 29, Patch: 4})
+			So(err, ShouldBeError, "unsupported deno version: 1.29.4")
+			_, err = deno.NewPromptParser(deno.DenoVersion{Major: 1, Minor: 30, Patch: 3})
+			So(err, ShouldBeNil)
+			_, err = deno.NewPromptParser(deno.DenoVersion{Major: 2, Minor: 1, Patch: 4})
+			So(err, ShouldBeNil)
+		})
+
+		Convey("scans the prompts of each supported version", func() {
+			dirs, err := filepath.Glob("./testdata/prompt/*")
+			So(err, ShouldBeNil)
+			So(dirs, ShouldNotBeEmpty)
+
+			for _, dir := range dirs {
+				version, err := deno.ParseDenoVersion(filepath.Base(dir))
+				So(err, ShouldBeNil)
+				parser, err := deno.NewPromptParser(version)
+				So(err, ShouldBeNil)
+
+				stderrs, err := filepath.Glob(filepath.Join(dir, "*.stderr"))
+				So(err, ShouldBeNil)
+				for _, stderrPath := range stderrs {
+					Convey(stderrPath, func() {
+						stderrBytes, err := os.ReadFile(stderrPath)
+						So(err, ShouldBeNil)
+						expectedBytes, err := os.ReadFile(strings.TrimSuffix(stderrPath, ".stderr") + ".json")
+						So(err, ShouldBeNil)
+						expectedStderr, err := os.ReadFile(stderrPath + ".expected")
+						if err != nil {
+							So(os.IsNotExist(err), ShouldBeTrue)
+						}
+
+						var descriptors []*deno.PermissionDescriptor
+						var answers bytes.Buffer
+						var actualStderr bytes.Buffer
+						err = parser.ScanPrompts(bytes.NewReader(stderrBytes), &answers, &actualStderr, func(line string, d *deno.PermissionDescriptor) bool {
+							descriptors = append(descriptors, d)
+							return false
+						})
+						So(err, ShouldBeNil)
+
+						actualBytes, err := json.Marshal(descriptors)
+						So(err, ShouldBeNil)
+						So(string(actualBytes), ShouldEqualJSON, string(expectedBytes))
+						So(answers.String(), ShouldEqual, "n\n")
+						So(actualStderr.String(), ShouldEqual, string(expectedStderr))
+					})
+				}
+			}
+		})
+	})
+}
+
+func TestParseDenoVersion(t *testing.T) {
+	Convey("ParseDenoVersion", t, func() {
+		cases := []struct {
+			input    string
+			expected string
+		}{
+			{"1.41.3", "1.41.3"},
+			{"v2.1.4", "2.1.4"},
+			{"deno 1.41.3 (release, x86_64-unknown-linux-gnu)\nv8 12.3.219.9\ntypescript 5.3.3\n", "1.41.3"},
+			{"deno 2.1.4 (stable, release, aarch64-apple-darwin)\nv8 13.0.245.12-rusty\ntypescript 5.6.2\n", "2.1.4"},
+		}
+		for _, c := range cases {
+			Convey(c.input, func() {
+				v, err := deno.ParseDenoVersion(c.input)
+				So(err, ShouldBeNil)
+				So(v.String(), ShouldEqual, c.expected)
+			})
+		}
+
+		_, err := deno.ParseDenoVersion("deno")
+		So(err, ShouldBeError, "invalid deno version: deno")
+
+		So(deno.DenoVersion{Major: 1, Minor: 41, Patch: 3}.Less(deno.DenoVersion2_0), ShouldBeTrue)
+		So(deno.DenoVersion2_1.Less(deno.DenoVersion2_0), ShouldBeFalse)
+	})
+}
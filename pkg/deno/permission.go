@@ -11,6 +11,7 @@ const (
 	PermissionNameSys    PermissionName = "sys"
 	PermissionNameFfi    PermissionName = "ffi"
 	PermissionNameHrtime PermissionName = "hrtime"
+	PermissionNameImport PermissionName = "import"
 )
 
 type SysKind string
@@ -26,6 +27,15 @@ const (
 	SysKindosUid SysKind = "uid"
 	//nolint:revive
 	SysKindosGid SysKind = "gid"
+	// The following kinds are prompted by the Node.js compatibility layer of deno.
+	SysKindOsUptime    SysKind = "osUptime"
+	SysKindCpus        SysKind = "cpus"
+	SysKindHomedir     SysKind = "homedir"
+	SysKindGetegid     SysKind = "getegid"
+	SysKindStatfs      SysKind = "statfs"
+	SysKindGetPriority SysKind = "getPriority"
+	SysKindSetPriority SysKind = "setPriority"
+	SysKindUserInfo    SysKind = "userInfo"
 )
 
 func ParseSysKind(kind string) (SysKind, bool) {
@@ -46,6 +56,22 @@ func ParseSysKind(kind string) (SysKind, bool) {
 		return SysKindosUid, true
 	case SysKindosGid:
 		return SysKindosGid, true
+	case SysKindOsUptime:
+		return SysKindOsUptime, true
+	case SysKindCpus:
+		return SysKindCpus, true
+	case SysKindHomedir:
+		return SysKindHomedir, true
+	case SysKindGetegid:
+		return SysKindGetegid, true
+	case SysKindStatfs:
+		return SysKindStatfs, true
+	case SysKindGetPriority:
+		return SysKindGetPriority, true
+	case SysKindSetPriority:
+		return SysKindSetPriority, true
+	case SysKindUserInfo:
+		return SysKindUserInfo, true
 	default:
 		return "", false
 	}
@@ -57,7 +83,7 @@ type PermissionDescriptor struct {
 	Command string `json:"command,omitempty"`
 	// read, write, ffi
 	Path string `json:"path,omitempty"`
-	// net
+	// net, import
 	Host *HostPort `json:"host,omitempty"`
 	// env
 	Variable string `json:"variable,omitempty"`
@@ -114,6 +140,15 @@ func ParsePermissionDescriptor(name string, target string) (*PermissionDescripto
 		return &PermissionDescriptor{
 			Name: PermissionNameHrtime,
 		}, true
+	case string(PermissionNameImport):
+		hostport, err := ParseHostPort(target)
+		if err != nil {
+			return nil, false
+		}
+		return &PermissionDescriptor{
+			Name: PermissionNameImport,
+			Host: hostport,
+		}, true
 	default:
 		return nil, false
 	}
@@ -98,21 +98,78 @@ func (e *ErrorUnspecified) Error() string {
 	return fmt.Sprintf("unspecified: %v", e.IP)
 }
 
+type ErrorThisNetwork struct {
+	IP net.IP
+}
+
+func (e *ErrorThisNetwork) Error() string {
+	return fmt.Sprintf("this network: %v", e.IP)
+}
+
+type ErrorSharedAddressSpace struct {
+	IP net.IP
+}
+
+func (e *ErrorSharedAddressSpace) Error() string {
+	return fmt.Sprintf("shared address space: %v", e.IP)
+}
+
+type ErrorBenchmarking struct {
+	IP net.IP
+}
+
+func (e *ErrorBenchmarking) Error() string {
+	return fmt.Sprintf("benchmarking: %v", e.IP)
+}
+
+type ErrorDocumentation struct {
+	IP net.IP
+}
+
+func (e *ErrorDocumentation) Error() string {
+	return fmt.Sprintf("documentation: %v", e.IP)
+}
+
+type ErrorSpecialPurpose struct {
+	IP net.IP
+}
+
+func (e *ErrorSpecialPurpose) Error() string {
+	return fmt.Sprintf("special purpose: %v", e.IP)
+}
+
+type ErrorMetadata struct {
+	IP net.IP
+}
+
+func (e *ErrorMetadata) Error() string {
+	return fmt.Sprintf("metadata: %v", e.IP)
+}
+
+// Permissioner decides a permission request.
+// A denial is explained by the returned error.
 type Permissioner interface {
 	RequestPermission(ctx context.Context, pd PermissionDescriptor) (bool, error)
 }
 
 type IPPolicyPermissioner struct {
-	resolver *net.Resolver
+	resolver IPResolver
 	disallow []IPPolicy
 }
 
 func DisallowIPPolicy(policies ...IPPolicy) IPPolicyPermissioner {
 	return IPPolicyPermissioner{
+		resolver: NetResolver{},
 		disallow: policies,
 	}
 }
 
+// WithResolver returns a copy of p that resolves hosts with resolver.
+func (p IPPolicyPermissioner) WithResolver(resolver IPResolver) IPPolicyPermissioner {
+	p.resolver = resolver
+	return p
+}
+
 func (p IPPolicyPermissioner) RequestPermission(ctx context.Context, pd PermissionDescriptor) (bool, error) {
 	if pd.Name != PermissionNameNet {
 		return false, &ErrorNameUnmatched{
@@ -132,37 +189,126 @@ func (p IPPolicyPermissioner) RequestPermission(ctx context.Context, pd Permissi
 	case pd.Host.IPv6 != nil:
 		ips = append(ips, pd.Host.IPv6)
 	default:
-		addrs, err := p.resolver.LookupHost(ctx, pd.Host.Host)
+		resolved, err := p.resolver.LookupIP(ctx, pd.Host.Host)
 		if err != nil {
 			return false, err
 		}
-		for _, addr := range addrs {
-			ip := net.ParseIP(addr)
-			if ip == nil {
-				return false, &ErrorInvalidIP{
-					Value: addr,
-				}
-			}
-			ips = append(ips, ip)
-		}
+		ips = resolved
 	}
 
-	if len(ips) <= 0 {
-		return false, &ErrorNoIP{
-			Host: pd.Host.Host,
+	recordResolvedIPs(ctx, ips)
+
+	err := checkIPPolicies(ips, p.disallow)
+	if err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+func (p IPPolicyPermissioner) StaticPermissions() []PermissionDescriptor {
+	return nil
+}
+
+// RequestStaticPermission decides the IP addresses only, because a host can be resolved differently over time.
+func (p IPPolicyPermissioner) RequestStaticPermission(pd PermissionDescriptor) (bool, error) {
+	if pd.Name != PermissionNameNet {
+		return false, &ErrorNameUnmatched{
+			Expected: PermissionNameNet,
+			Actual:   pd.Name,
 		}
 	}
+	if pd.Host == nil {
+		return false, ErrAllHost
+	}
+	if pd.Host.IPv4 == nil && pd.Host.IPv6 == nil {
+		return false, ErrNotStatic
+	}
+	return p.RequestPermission(context.Background(), pd)
+}
 
+func checkIPPolicies(ips []net.IP, policies []IPPolicy) error {
 	for _, ip := range ips {
-		for _, policy := range p.disallow {
+		for _, policy := range policies {
 			_, err := policy(ip)
 			if err != nil {
-				return false, err
+				return err
+			}
+			// The IPv4 address embedded in the IPv6 address must be allowed too.
+			for _, embedded := range EmbeddedIPv4(ip) {
+				_, err := policy(embedded)
+				if err != nil {
+					return &ErrorEmbeddedIPv4{
+						IP:    ip,
+						Inner: err,
+					}
+				}
 			}
 		}
 	}
+	return nil
+}
 
-	return true, nil
+type ErrorEmbeddedIPv4 struct {
+	IP    net.IP
+	Inner error
+}
+
+func (e *ErrorEmbeddedIPv4) Error() string {
+	return fmt.Sprintf("embedded in %v: %v", e.IP, e.Inner)
+}
+
+func (e *ErrorEmbeddedIPv4) Unwrap() error {
+	return e.Inner
+}
+
+var (
+	// IPv4-compatible ::/96, deprecated by RFC 4291.
+	ipv4CompatiblePrefix = mustParseCIDR("::/96")
+	// NAT64 64:ff9b::/96, see RFC 6052.
+	nat64Prefix = mustParseCIDR("64:ff9b::/96")
+	// 6to4 2002::/16, see RFC 3056.
+	sixToFourPrefix = mustParseCIDR("2002::/16")
+	// Teredo 2001::/32, see RFC 4380.
+	teredoPrefix = mustParseCIDR("2001::/32")
+)
+
+func mustParseCIDR(s string) *net.IPNet {
+	_, cidr, err := net.ParseCIDR(s)
+	if err != nil {
+		panic(err)
+	}
+	return cidr
+}
+
+// EmbeddedIPv4 returns the IPv4 addresses embedded in the IPv6 address ip.
+// IPv4-mapped addresses like ::ffff:127.0.0.1 are not included because
+// they are taken as IPv4 addresses by net.IP already.
+func EmbeddedIPv4(ip net.IP) []net.IP {
+	if ip.To4() != nil {
+		return nil
+	}
+	ip = ip.To16()
+	if ip == nil {
+		return nil
+	}
+
+	switch {
+	case nat64Prefix.Contains(ip):
+		return []net.IP{net.IPv4(ip[12], ip[13], ip[14], ip[15]).To4()}
+	case sixToFourPrefix.Contains(ip):
+		return []net.IP{net.IPv4(ip[2], ip[3], ip[4], ip[5]).To4()}
+	case teredoPrefix.Contains(ip):
+		// The server, and the client which is obfuscated by flipping all the bits.
+		return []net.IP{
+			net.IPv4(ip[4], ip[5], ip[6], ip[7]).To4(),
+			net.IPv4(ip[12]^0xff, ip[13]^0xff, ip[14]^0xff, ip[15]^0xff).To4(),
+		}
+	case ipv4CompatiblePrefix.Contains(ip) && !ip.IsUnspecified() && !ip.IsLoopback():
+		return []net.IP{net.IPv4(ip[12], ip[13], ip[14], ip[15]).To4()}
+	default:
+		return nil
+	}
 }
 
 type IPPolicy func(ip net.IP) (bool, error)
@@ -222,3 +368,214 @@ func DisallowUnspecified(ip net.IP) (bool, error) {
 	}
 	return true, nil
 }
+
+// The special-purpose address ranges that are not covered by the predicates of net.IP.
+// See https://www.iana.org/assignments/iana-ipv4-special-registry/iana-ipv4-special-registry.xhtml
+// and https://www.iana.org/assignments/iana-ipv6-special-registry/iana-ipv6-special-registry.xhtml
+var (
+	thisNetworkCIDRs = mustParseCIDRs(
+		"0.0.0.0/8",
+	)
+	sharedAddressSpaceCIDRs = mustParseCIDRs(
+		"100.64.0.0/10",
+	)
+	benchmarkingCIDRs = mustParseCIDRs(
+		"198.18.0.0/15",
+		"2001:2::/48",
+	)
+	documentationCIDRs = mustParseCIDRs(
+		"192.0.2.0/24",
+		"198.51.100.0/24",
+		"203.0.113.0/24",
+		"2001:db8::/32",
+		"3fff::/20",
+	)
+	specialPurposeCIDRs = mustParseCIDRs(
+		// IETF Protocol Assignments
+		"192.0.0.0/24",
+		// AS112-v4
+		"192.31.196.0/24",
+		// AMT
+		"192.52.193.0/24",
+		// Deprecated 6to4 Relay Anycast
+		"192.88.99.0/24",
+		// Direct Delegation AS112 Service
+		"192.175.48.0/24",
+		// Reserved
+		"240.0.0.0/4",
+		// Limited Broadcast
+		"255.255.255.255/32",
+		// IPv4-IPv6 Translat.
+		"64:ff9b:1::/48",
+		// Discard-Only Address Block
+		"100::/64",
+		// Dummy IPv6 Prefix
+		"100:0:0:1::/64",
+		// IETF Protocol Assignments
+		"2001::/23",
+		// Direct Delegation AS112 Service
+		"2620:4f:8000::/48",
+		// Segment Routing (SRv6) SIDs
+		"5f00::/16",
+	)
+	metadataCIDRs = mustParseCIDRs(
+		// AWS, GCP, Azure, OpenStack, and many others.
+		"169.254.169.254/32",
+		// AWS ECS task metadata.
+		"169.254.170.2/32",
+		// AWS IMDS over IPv6.
+		"fd00:ec2::254/128",
+		// Alibaba Cloud.
+		"100.100.100.200/32",
+		// Azure WireServer.
+		"168.63.129.16/32",
+	)
+)
+
+func mustParseCIDRs(ss ...string) []*net.IPNet {
+	var cidrs []*net.IPNet
+	for _, s := range ss {
+		cidrs = append(cidrs, mustParseCIDR(s))
+	}
+	return cidrs
+}
+
+func containsIP(cidrs []*net.IPNet, ip net.IP) bool {
+	for _, cidr := range cidrs {
+		if cidr.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// DisallowThisNetwork disallows 0.0.0.0/8.
+func DisallowThisNetwork(ip net.IP) (bool, error) {
+	if containsIP(thisNetworkCIDRs, ip) {
+		return false, &ErrorThisNetwork{ip}
+	}
+	return true, nil
+}
+
+// DisallowSharedAddressSpace disallows 100.64.0.0/10, which is used by carrier-grade NAT.
+func DisallowSharedAddressSpace(ip net.IP) (bool, error) {
+	if containsIP(sharedAddressSpaceCIDRs, ip) {
+		return false, &ErrorSharedAddressSpace{ip}
+	}
+	return true, nil
+}
+
+// DisallowBenchmarking disallows 198.18.0.0/15 and 2001:2::/48.
+func DisallowBenchmarking(ip net.IP) (bool, error) {
+	if containsIP(benchmarkingCIDRs, ip) {
+		return false, &ErrorBenchmarking{ip}
+	}
+	return true, nil
+}
+
+// DisallowDocumentation disallows the address ranges reserved for documentation.
+func DisallowDocumentation(ip net.IP) (bool, error) {
+	if containsIP(documentationCIDRs, ip) {
+		return false, &ErrorDocumentation{ip}
+	}
+	return true, nil
+}
+
+// DisallowSpecialPurpose disallows the rest of the IANA special-purpose address registry.
+func DisallowSpecialPurpose(ip net.IP) (bool, error) {
+	if containsIP(specialPurposeCIDRs, ip) {
+		return false, &ErrorSpecialPurpose{ip}
+	}
+	return true, nil
+}
+
+// DisallowMetadata disallows the well-known instance metadata endpoints of cloud providers.
+func DisallowMetadata(ip net.IP) (bool, error) {
+	if containsIP(metadataCIDRs, ip) {
+		return false, &ErrorMetadata{ip}
+	}
+	return true, nil
+}
+
+type ErrorCIDR struct {
+	IP   net.IP
+	CIDR *net.IPNet
+}
+
+func (e *ErrorCIDR) Error() string {
+	return fmt.Sprintf("cidr %v: %v", e.CIDR, e.IP)
+}
+
+// ParseCIDRs parses CIDRs like 10.0.0.0/8.
+// An IP without prefix length like 10.20.0.5 is taken as a single IP.
+func ParseCIDRs(ss []string) ([]*net.IPNet, error) {
+	var cidrs []*net.IPNet
+	for _, s := range ss {
+		if ip := net.ParseIP(s); ip != nil {
+			bits := 128
+			if v4 := ip.To4(); v4 != nil {
+				ip = v4
+				bits = 32
+			}
+			cidrs = append(cidrs, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, cidr, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, err
+		}
+		cidrs = append(cidrs, cidr)
+	}
+	return cidrs, nil
+}
+
+// DisallowCIDRs disallows IPs in any of cidrs.
+func DisallowCIDRs(cidrs ...*net.IPNet) IPPolicy {
+	return func(ip net.IP) (bool, error) {
+		for _, cidr := range cidrs {
+			if cidr.Contains(ip) {
+				return false, &ErrorCIDR{IP: ip, CIDR: cidr}
+			}
+		}
+		return true, nil
+	}
+}
+
+// AllowCIDRs applies policies to IPs not in any of cidrs.
+// It is used to make exceptions to policies, for example, allowing one private IP.
+func AllowCIDRs(cidrs []*net.IPNet, policies ...IPPolicy) IPPolicy {
+	return func(ip net.IP) (bool, error) {
+		for _, cidr := range cidrs {
+			if cidr.Contains(ip) {
+				return true, nil
+			}
+		}
+		for _, policy := range policies {
+			ok, err := policy(ip)
+			if err != nil {
+				return ok, err
+			}
+		}
+		return true, nil
+	}
+}
+
+type ErrorOutsideCIDRs struct {
+	IP net.IP
+}
+
+func (e *ErrorOutsideCIDRs) Error() string {
+	return fmt.Sprintf("outside allowed cidrs: %v", e.IP)
+}
+
+// DisallowOutsideCIDRs disallows IPs not in any of cidrs.
+func DisallowOutsideCIDRs(cidrs ...*net.IPNet) IPPolicy {
+	return func(ip net.IP) (bool, error) {
+		for _, cidr := range cidrs {
+			if cidr.Contains(ip) {
+				return true, nil
+			}
+		}
+		return false, &ErrorOutsideCIDRs{IP: ip}
+	}
+}
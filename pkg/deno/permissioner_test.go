@@ -61,3 +61,155 @@ func TestAllowRemoteIP(t *testing.T) {
 		}
 	})
 }
+
+func TestCIDRPolicy(t *testing.T) {
+	Convey("CIDRPolicy", t, func() {
+		ctx := context.Background()
+
+		allow, err := deno.ParseCIDRs([]string{"10.20.0.5", "fd00:1::/64"})
+		So(err, ShouldBeNil)
+		deny, err := deno.ParseCIDRs([]string{"203.0.113.0/24", "10.20.0.5/32"})
+		So(err, ShouldBeNil)
+
+		_, err = deno.ParseCIDRs([]string{"10.0.0.0/33"})
+		So(err, ShouldBeError, "invalid CIDR address: 10.0.0.0/33")
+
+		cases := []struct {
+			policies   []deno.IPPolicy
+			descriptor string
+			expected   bool
+			err        string
+		}{
+			{[]deno.IPPolicy{deno.AllowCIDRs(allow, deno.DisallowPrivate)}, `{"name":"net","host":"10.20.0.5"}`, true, ""},
+			{[]deno.IPPolicy{deno.AllowCIDRs(allow, deno.DisallowPrivate)}, `{"name":"net","host":"10.20.0.6"}`, false, "private: 10.20.0.6"},
+			{[]deno.IPPolicy{deno.AllowCIDRs(allow, deno.DisallowPrivate)}, `{"name":"net","host":"[fd00:1::1]"}`, true, ""},
+			{[]deno.IPPolicy{deno.AllowCIDRs(allow, deno.DisallowPrivate)}, `{"name":"net","host":"[fd00:2::1]"}`, false, "private: fd00:2::1"},
+			{[]deno.IPPolicy{deno.DisallowCIDRs(deny...)}, `{"name":"net","host":"203.0.113.10"}`, false, "cidr 203.0.113.0/24: 203.0.113.10"},
+			{[]deno.IPPolicy{deno.DisallowCIDRs(deny...)}, `{"name":"net","host":"1.1.1.1"}`, true, ""},
+			{[]deno.IPPolicy{deno.DisallowCIDRs(deny...), deno.AllowCIDRs(allow, deno.DisallowPrivate)}, `{"name":"net","host":"10.20.0.5:443"}`, false, "cidr 10.20.0.5/32: 10.20.0.5"},
+			{[]deno.IPPolicy{deno.DisallowOutsideCIDRs(allow...)}, `{"name":"net","host":"10.20.0.5:80"}`, true, ""},
+			{[]deno.IPPolicy{deno.DisallowOutsideCIDRs(allow...)}, `{"name":"net","host":"1.1.1.1:80"}`, false, "outside allowed cidrs: 1.1.1.1"},
+		}
+
+		for _, c := range cases {
+			Convey(c.descriptor, func() {
+				var pd deno.PermissionDescriptor
+				err := json.Unmarshal([]byte(c.descriptor), &pd)
+				So(err, ShouldBeNil)
+				actual, err := deno.DisallowIPPolicy(c.policies...).RequestPermission(ctx, pd)
+				So(actual, ShouldEqual, c.expected)
+				if c.expected {
+					So(err, ShouldBeNil)
+				} else {
+					So(err, ShouldBeError, c.err)
+				}
+			})
+		}
+	})
+}
+
+func TestEmbeddedIPv4Policy(t *testing.T) {
+	Convey("EmbeddedIPv4Policy", t, func() {
+		ctx := context.Background()
+
+		p := deno.DisallowIPPolicy(
+			deno.DisallowLinkLocalUnicast,
+			deno.DisallowLoopback,
+			deno.DisallowPrivate,
+			deno.DisallowUnspecified,
+		)
+
+		cases := []struct {
+			descriptor string
+			expected   bool
+			err        string
+		}{
+			{`{"name":"net","host":"[::ffff:127.0.0.1]:80"}`, false, "loopback: 127.0.0.1"},
+			{`{"name":"net","host":"[::ffff:10.0.0.1]:80"}`, false, "private: 10.0.0.1"},
+			{`{"name":"net","host":"[64:ff9b::7f00:1]:80"}`, false, "embedded in 64:ff9b::7f00:1: loopback: 127.0.0.1"},
+			{`{"name":"net","host":"[64:ff9b::a9fe:a9fe]:80"}`, false, "embedded in 64:ff9b::a9fe:a9fe: link local unicast: 169.254.169.254"},
+			{`{"name":"net","host":"[64:ff9b::101:101]:80"}`, true, ""},
+			{`{"name":"net","host":"[2002:a00:1::1]:80"}`, false, "embedded in 2002:a00:1::1: private: 10.0.0.1"},
+			{`{"name":"net","host":"[2002:101:101::1]:80"}`, true, ""},
+			{`{"name":"net","host":"[2001:0:4136:e378:8000:63bf:3f57:fefe]:80"}`, false, "embedded in 2001:0:4136:e378:8000:63bf:3f57:fefe: private: 192.168.1.1"},
+			{`{"name":"net","host":"[2001:0:4136:e378:8000:63bf:fefe:fefe]:80"}`, true, ""},
+			{`{"name":"net","host":"[::7f00:1]:80"}`, false, "embedded in ::7f00:1: loopback: 127.0.0.1"},
+		}
+
+		for _, c := range cases {
+			Convey(c.descriptor, func() {
+				var pd deno.PermissionDescriptor
+				err := json.Unmarshal([]byte(c.descriptor), &pd)
+				So(err, ShouldBeNil)
+				actual, err := p.RequestPermission(ctx, pd)
+				So(actual, ShouldEqual, c.expected)
+				if c.expected {
+					So(err, ShouldBeNil)
+				} else {
+					So(err, ShouldBeError, c.err)
+				}
+			})
+		}
+	})
+}
+
+func TestSpecialPurposePolicy(t *testing.T) {
+	Convey("SpecialPurposePolicy", t, func() {
+		ctx := context.Background()
+
+		p := deno.DisallowIPPolicy(
+			deno.DisallowThisNetwork,
+			deno.DisallowSharedAddressSpace,
+			deno.DisallowBenchmarking,
+			deno.DisallowDocumentation,
+			deno.DisallowSpecialPurpose,
+			deno.DisallowMetadata,
+		)
+
+		cases := []struct {
+			descriptor string
+			expected   bool
+			err        string
+		}{
+			{`{"name":"net","host":"0.1.2.3:80"}`, false, "this network: 0.1.2.3"},
+			{`{"name":"net","host":"100.64.0.1:80"}`, false, "shared address space: 100.64.0.1"},
+			{`{"name":"net","host":"100.127.255.255:80"}`, false, "shared address space: 100.127.255.255"},
+			{`{"name":"net","host":"100.128.0.1:80"}`, true, ""},
+			{`{"name":"net","host":"198.19.0.1:80"}`, false, "benchmarking: 198.19.0.1"},
+			{`{"name":"net","host":"[2001:2::1]:80"}`, false, "benchmarking: 2001:2::1"},
+			{`{"name":"net","host":"192.0.2.1:80"}`, false, "documentation: 192.0.2.1"},
+			{`{"name":"net","host":"198.51.100.1:80"}`, false, "documentation: 198.51.100.1"},
+			{`{"name":"net","host":"203.0.113.1:80"}`, false, "documentation: 203.0.113.1"},
+			{`{"name":"net","host":"[2001:db8::1]:80"}`, false, "documentation: 2001:db8::1"},
+			{`{"name":"net","host":"[3fff::1]:80"}`, false, "documentation: 3fff::1"},
+			{`{"name":"net","host":"192.0.0.170:80"}`, false, "special purpose: 192.0.0.170"},
+			{`{"name":"net","host":"240.0.0.1:80"}`, false, "special purpose: 240.0.0.1"},
+			{`{"name":"net","host":"255.255.255.255:80"}`, false, "special purpose: 255.255.255.255"},
+			{`{"name":"net","host":"[100::1]:80"}`, false, "special purpose: 100::1"},
+			{`{"name":"net","host":"[5f00::1]:80"}`, false, "special purpose: 5f00::1"},
+			{`{"name":"net","host":"169.254.169.254:80"}`, false, "metadata: 169.254.169.254"},
+			{`{"name":"net","host":"169.254.170.2:80"}`, false, "metadata: 169.254.170.2"},
+			{`{"name":"net","host":"[fd00:ec2::254]:80"}`, false, "metadata: fd00:ec2::254"},
+			{`{"name":"net","host":"100.100.100.200:80"}`, false, "shared address space: 100.100.100.200"},
+			{`{"name":"net","host":"168.63.129.16:80"}`, false, "metadata: 168.63.129.16"},
+			{`{"name":"net","host":"[64:ff9b::a9fe:a9fe]:80"}`, false, "embedded in 64:ff9b::a9fe:a9fe: metadata: 169.254.169.254"},
+			{`{"name":"net","host":"1.1.1.1:80"}`, true, ""},
+			{`{"name":"net","host":"[2606:4700:4700::1111]:80"}`, true, ""},
+		}
+
+		for _, c := range cases {
+			Convey(c.descriptor, func() {
+				var pd deno.PermissionDescriptor
+				err := json.Unmarshal([]byte(c.descriptor), &pd)
+				So(err, ShouldBeNil)
+				actual, err := p.RequestPermission(ctx, pd)
+				So(actual, ShouldEqual, c.expected)
+				if c.expected {
+					So(err, ShouldBeNil)
+				} else {
+					So(err, ShouldBeError, c.err)
+				}
+			})
+		}
+	})
+}
@@ -0,0 +1,247 @@
+package deno
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+var ErrAllEnv = errors.New("env permission without variable is disallowed")
+
+var ErrAllSys = errors.New("sys permission without kind is disallowed")
+
+var ErrAllImport = errors.New("import permission without host is disallowed")
+
+type ErrorEnvNotAllowed struct {
+	Variable string
+}
+
+func (e *ErrorEnvNotAllowed) Error() string {
+	return fmt.Sprintf("env not allowed: %v", e.Variable)
+}
+
+type ErrorSysNotAllowed struct {
+	Kind SysKind
+}
+
+func (e *ErrorSysNotAllowed) Error() string {
+	return fmt.Sprintf("sys not allowed: %v", e.Kind)
+}
+
+type EnvPermissioner struct {
+	variables map[string]struct{}
+	prefixes  []string
+}
+
+// AllowEnv grants access to the given environment variables only.
+// Like --allow-env of deno 2, a variable ending with "*", like AWS_*, allows the variables with the prefix.
+func AllowEnv(variables ...string) EnvPermissioner {
+	m := make(map[string]struct{})
+	var prefixes []string
+	for _, v := range variables {
+		if prefix, ok := strings.CutSuffix(v, "*"); ok {
+			prefixes = append(prefixes, prefix)
+			continue
+		}
+		m[v] = struct{}{}
+	}
+	return EnvPermissioner{
+		variables: m,
+		prefixes:  prefixes,
+	}
+}
+
+func (p EnvPermissioner) RequestPermission(ctx context.Context, pd PermissionDescriptor) (bool, error) {
+	if pd.Name != PermissionNameEnv {
+		return false, &ErrorNameUnmatched{
+			Expected: PermissionNameEnv,
+			Actual:   pd.Name,
+		}
+	}
+
+	if pd.Variable == "" {
+		return false, ErrAllEnv
+	}
+
+	if _, ok := p.variables[pd.Variable]; ok {
+		return true, nil
+	}
+	for _, prefix := range p.prefixes {
+		if strings.HasPrefix(pd.Variable, prefix) {
+			return true, nil
+		}
+	}
+
+	return false, &ErrorEnvNotAllowed{
+		Variable: pd.Variable,
+	}
+}
+
+func (p EnvPermissioner) StaticPermissions() []PermissionDescriptor {
+	var variables []string
+	for v := range p.variables {
+		variables = append(variables, v)
+	}
+	sort.Strings(variables)
+
+	var out []PermissionDescriptor
+	for _, v := range variables {
+		out = append(out, PermissionDescriptor{
+			Name:     PermissionNameEnv,
+			Variable: v,
+		})
+	}
+	return out
+}
+
+func (p EnvPermissioner) RequestStaticPermission(pd PermissionDescriptor) (bool, error) {
+	return p.RequestPermission(context.Background(), pd)
+}
+
+type ErrorImportNotAllowed struct {
+	Host *HostPort
+}
+
+func (e *ErrorImportNotAllowed) Error() string {
+	return fmt.Sprintf("import not allowed: %v", e.Host)
+}
+
+type SysPermissioner struct {
+	kinds map[SysKind]struct{}
+}
+
+// AllowSys grants access to the given kinds of system information only.
+func AllowSys(kinds ...SysKind) SysPermissioner {
+	m := make(map[SysKind]struct{})
+	for _, k := range kinds {
+		m[k] = struct{}{}
+	}
+	return SysPermissioner{
+		kinds: m,
+	}
+}
+
+func (p SysPermissioner) RequestPermission(ctx context.Context, pd PermissionDescriptor) (bool, error) {
+	if pd.Name != PermissionNameSys {
+		return false, &ErrorNameUnmatched{
+			Expected: PermissionNameSys,
+			Actual:   pd.Name,
+		}
+	}
+
+	if pd.Kind == SysKindAll {
+		return false, ErrAllSys
+	}
+
+	if _, ok := p.kinds[pd.Kind]; !ok {
+		return false, &ErrorSysNotAllowed{
+			Kind: pd.Kind,
+		}
+	}
+
+	return true, nil
+}
+
+func (p SysPermissioner) StaticPermissions() []PermissionDescriptor {
+	var kinds []string
+	for k := range p.kinds {
+		kinds = append(kinds, string(k))
+	}
+	sort.Strings(kinds)
+
+	var out []PermissionDescriptor
+	for _, k := range kinds {
+		out = append(out, PermissionDescriptor{
+			Name: PermissionNameSys,
+			Kind: SysKind(k),
+		})
+	}
+	return out
+}
+
+func (p SysPermissioner) RequestStaticPermission(pd PermissionDescriptor) (bool, error) {
+	return p.RequestPermission(context.Background(), pd)
+}
+
+type HrtimePermissioner struct{}
+
+// AllowHrtime grants access to high precision time.
+func AllowHrtime() HrtimePermissioner {
+	return HrtimePermissioner{}
+}
+
+func (p HrtimePermissioner) RequestPermission(ctx context.Context, pd PermissionDescriptor) (bool, error) {
+	if pd.Name != PermissionNameHrtime {
+		return false, &ErrorNameUnmatched{
+			Expected: PermissionNameHrtime,
+			Actual:   pd.Name,
+		}
+	}
+	return true, nil
+}
+
+func (p HrtimePermissioner) StaticPermissions() []PermissionDescriptor {
+	return []PermissionDescriptor{{Name: PermissionNameHrtime}}
+}
+
+func (p HrtimePermissioner) RequestStaticPermission(pd PermissionDescriptor) (bool, error) {
+	return p.RequestPermission(context.Background(), pd)
+}
+
+type ImportPermissioner struct {
+	rules []HostRule
+}
+
+// AllowImport grants the import of remote modules from the hosts matching any of rules.
+func AllowImport(rules ...HostRule) ImportPermissioner {
+	return ImportPermissioner{
+		rules: rules,
+	}
+}
+
+func (p ImportPermissioner) RequestPermission(ctx context.Context, pd PermissionDescriptor) (bool, error) {
+	if pd.Name != PermissionNameImport {
+		return false, &ErrorNameUnmatched{
+			Expected: PermissionNameImport,
+			Actual:   pd.Name,
+		}
+	}
+
+	if pd.Host == nil {
+		return false, ErrAllImport
+	}
+
+	for _, rule := range p.rules {
+		if rule.MatchAllow(pd.Host) {
+			return true, nil
+		}
+	}
+
+	return false, &ErrorImportNotAllowed{
+		Host: pd.Host,
+	}
+}
+
+func (p ImportPermissioner) StaticPermissions() []PermissionDescriptor {
+	var out []PermissionDescriptor
+	for _, rule := range p.rules {
+		if rule.Wildcard {
+			continue
+		}
+		hostport, err := ParseHostPort(rule.String())
+		if err != nil || hostport == nil {
+			continue
+		}
+		out = append(out, PermissionDescriptor{
+			Name: PermissionNameImport,
+			Host: hostport,
+		})
+	}
+	return out
+}
+
+func (p ImportPermissioner) RequestStaticPermission(pd PermissionDescriptor) (bool, error) {
+	return p.RequestPermission(context.Background(), pd)
+}
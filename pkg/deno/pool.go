@@ -0,0 +1,564 @@
+package deno
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/creack/pty"
+
+	"github.com/authgear/authgear-deno/pkg/ioutil"
+)
+
+// ControlJob is the first message on ControlChannelIn.
+// runner.ts waits for it after it has set up the control channel,
+// so that deno can be started before the job is known.
+type ControlJob struct {
+	TargetScript string `json:"target_script"`
+	Input        string `json:"input"`
+	Output       string `json:"output"`
+}
+
+// process is a deno process that runs runner.ts.
+// It serves exactly one job.
+type process struct {
+	dir           string
+	job           ControlJob
+	cmd           *exec.Cmd
+	pty           *os.File
+	broker        *PermissionBroker
+	controlReader *os.File
+	replyWriter   *os.File
+	stdoutReader  *os.File
+	stdout        StdStream
+	stderr        StdStream
+	logs          *LogRecorder
+	syncStderr    *ioutil.SyncWriter
+	// denoStderr is what deno itself writes to the pty, without what the target script writes to stderr.
+	denoStderr StdStream
+	// cgroup is nil if Runner.MemoryCgroup is not used.
+	cgroup *memoryCgroup
+	// done is closed when the process has exited, with err set.
+	done chan struct{}
+	err  error
+}
+
+// entryScriptBytes is entry.ts, which imports gate.ts before targetScript.
+// See gate.ts.
+func entryScriptBytes(targetScript string) ([]byte, error) {
+	u := url.URL{
+		Scheme: "file",
+		Path:   "/" + strings.TrimPrefix(filepath.ToSlash(targetScript), "/"),
+	}
+	specifier, err := json.Marshal(u.String())
+	if err != nil {
+		return nil, err
+	}
+	return []byte(fmt.Sprintf("import \"./gate.ts\";\nexport * as target from %s;\n", specifier)), nil
+}
+
+// startProcess starts deno with runner.ts, granting the files of job and static.
+// If job is nil, the files of the job are in the directory of the process.
+// deno is started behind httpProxy, if it is not empty.
+func (r *Runner) startProcess(static []PermissionDescriptor, job *ControlJob, httpProxy string) (*process, error) {
+	p := &process{
+		done: make(chan struct{}),
+	}
+	started := false
+	defer func() {
+		if !started {
+			p.close()
+		}
+	}()
+
+	var err error
+	p.dir, err = os.MkdirTemp("", "authgear-deno-runner.*")
+	if err != nil {
+		return nil, err
+	}
+	p.dir, err = filepath.Abs(p.dir)
+	if err != nil {
+		return nil, err
+	}
+	runnerScript := filepath.Join(p.dir, "runner.ts")
+
+	if job != nil {
+		p.job = *job
+	} else {
+		p.job = ControlJob{
+			TargetScript: filepath.Join(p.dir, "script.ts"),
+			Input:        filepath.Join(p.dir, "input.json"),
+			Output:       filepath.Join(p.dir, "output.json"),
+		}
+	}
+
+	entryScript, err := entryScriptBytes(p.job.TargetScript)
+	if err != nil {
+		return nil, err
+	}
+	err = writeScripts(p.dir, map[string][]byte{
+		"runner.ts":   runnerScriptBytes,
+		"wrappers.ts": wrappersScriptBytes,
+		"gate.ts":     gateScriptBytes,
+		"entry.ts":    entryScript,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	stdStreamLimit := r.stdStreamLimit()
+	p.stdout = ioutil.LimitWriter(&bytes.Buffer{}, stdStreamLimit)
+	p.stderr = ioutil.LimitWriter(&bytes.Buffer{}, stdStreamLimit)
+	p.denoStderr = ioutil.LimitWriter(&bytes.Buffer{}, stdStreamLimit)
+	// stderr is written by both the pty and the control channel.
+	p.syncStderr = &ioutil.SyncWriter{W: p.stderr}
+
+	// The Permissioner is set when the job is known.
+	p.broker, err = NewPermissionBroker(nil, p.syncStderr)
+	if err != nil {
+		return nil, err
+	}
+	p.broker.StderrLimit = stdStreamLimit
+	p.logs = NewLogRecorder(stdStreamLimit)
+	p.broker.Logs = p.logs
+
+	// controlReader is read by us, controlWriter is written by runner.ts.
+	controlReader, controlWriter, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+	p.controlReader = controlReader
+	defer controlWriter.Close()
+	// replyReader is read by runner.ts, replyWriter is written by us.
+	replyReader, replyWriter, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+	p.replyWriter = replyWriter
+	defer replyReader.Close()
+
+	// The permissions of runner.ts itself, and the permissions that are granted statically.
+	permissions := []PermissionDescriptor{
+		{Name: PermissionNameRead, Path: p.job.TargetScript},
+		{Name: PermissionNameRead, Path: filepath.Join(p.dir, "entry.ts")},
+		{Name: PermissionNameRead, Path: filepath.Join(p.dir, "gate.ts")},
+		{Name: PermissionNameRead, Path: p.job.Input},
+		{Name: PermissionNameRead, Path: ControlChannelIn},
+		{Name: PermissionNameWrite, Path: p.job.Output},
+		{Name: PermissionNameWrite, Path: ControlChannelOut},
+		{Name: PermissionNameEnv, Variable: ControlTokenEnv},
+	}
+	permissions = append(permissions, static...)
+
+	args := []string{"run", "--quiet"}
+	if r.MemoryLimitBytes > 0 {
+		args = append(args, v8MemoryFlag(r.MemoryLimitBytes))
+	}
+	args = append(args, PermissionFlags(r.DenoVersion, permissions)...)
+	args = append(args, runnerScript)
+	p.cmd = exec.Command("deno", args...) //nolint:gosec
+
+	if (r.MemoryLimitBytes > 0 || r.ResourceLimits.Processes > 0) && r.MemoryCgroup != "" {
+		var limitBytes int64
+		if r.MemoryLimitBytes > 0 {
+			limitBytes = r.MemoryLimitBytes + memoryCgroupOverhead
+		}
+		p.cgroup, err = newMemoryCgroup(r.MemoryCgroup, limitBytes, r.ResourceLimits.Processes)
+		if err != nil {
+			return nil, err
+		}
+		p.cgroup.apply(p.cmd)
+	}
+
+	p.cmd.Env = append(r.environ(p.cmd, httpProxy), ControlTokenEnv+"="+p.broker.Token())
+
+	// Separate stdout and stderr.
+	// stdout is a pipe of our own, so that Wait does not wait for the descendants of deno that keep it open.
+	stdoutReader, stdoutWriter, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+	p.stdoutReader = stdoutReader
+	defer stdoutWriter.Close()
+	p.cmd.Stdout = stdoutWriter
+
+	// The control channel is fd 3 and fd 4 in deno.
+	p.cmd.ExtraFiles = []*os.File{controlWriter, replyReader}
+
+	// Allocate a pty, connect stdin and stderr to the pty, and start the command.
+	// deno is started in a new session, so it leads a process group of its own.
+	p.pty, err = pty.Start(p.cmd)
+	if err != nil {
+		return nil, err
+	}
+
+	// runner.ts does not import the target script before it has read the job,
+	// so the limits are set before the target script runs.
+	if r.ResourceLimits != (ResourceLimits{}) {
+		err = setResourceLimits(p.cmd.Process.Pid, r.ResourceLimits)
+		if err != nil {
+			p.kill()
+			_ = p.cmd.Wait()
+			return nil, err
+		}
+	}
+
+	started = true
+	go func() {
+		p.err = p.cmd.Wait()
+		// Kill what is left in the process group, like the subprocesses of the target script.
+		p.kill()
+		close(p.done)
+	}()
+
+	// Our copies of the ends used by deno are closed by the deferred calls, so that we can observe EOF.
+	return p, nil
+}
+
+// run sends the job to the process, serves it until it exits, and returns the permission events.
+// The process is terminated when ctx is done. opts only gives the observers of the run.
+func (p *process) run(ctx context.Context, r *Runner, permissioner Permissioner, opts RunFileOptions) ([]PermissionEvent, error) {
+	gracePeriod := r.killGracePeriod()
+	stop := context.AfterFunc(ctx, func() {
+		p.terminate(gracePeriod)
+	})
+	defer stop()
+
+	p.broker.Permissioner = permissioner
+	p.broker.OnEvent = opts.OnPermissionEvent
+
+	// Nothing is written to stdout and stderr before the goroutines below are started.
+	var stdout io.Writer = p.stdout
+	if opts.Stdout != nil {
+		stdout = &ioutil.TeeWriter{W: p.stdout, Tee: ioutil.LimitWriter(opts.Stdout, r.stdStreamLimit())}
+	}
+	if opts.Stderr != nil {
+		p.syncStderr.W = &ioutil.TeeWriter{W: p.stderr, Tee: ioutil.LimitWriter(opts.Stderr, r.stdStreamLimit())}
+	}
+
+	var wg sync.WaitGroup
+
+	// Serve the control channel.
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		_ = p.broker.Serve(ctx, p.controlReader, p.replyWriter)
+		// Drain the remaining messages so that runner.ts never blocks on writing.
+		_, _ = io.Copy(io.Discard, p.controlReader)
+	}()
+
+	// Read stdout
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		_, _ = io.Copy(stdout, p.stdoutReader)
+	}()
+
+	// Read stderr
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		parser := &PromptParser{Version: r.DenoVersion}
+		_ = parser.ScanPrompts(p.pty, p.pty, io.MultiWriter(p.syncStderr, p.denoStderr), func(line string, d *PermissionDescriptor) bool {
+			switch {
+			case d == nil:
+				p.broker.RecordUnrecognizedPrompt(line)
+				return false
+			default:
+				return p.broker.Redeem(ctx, *d)
+			}
+		})
+		// Drain the remaining output so that deno never blocks on writing.
+		_, _ = io.Copy(io.Discard, p.pty)
+	}()
+
+	// The job is written before the broker replies, so they never interleave.
+	// If the process has exited, the error is reported by Wait.
+	_ = json.NewEncoder(p.replyWriter).Encode(p.job)
+
+	<-p.done
+
+	// A descendant of deno that has left the process group can keep the pty and the pipes open.
+	drained := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(drained)
+	}()
+	t := time.NewTimer(gracePeriod)
+	defer t.Stop()
+	select {
+	case <-drained:
+	case <-t.C:
+		p.closeFiles()
+		<-drained
+	}
+
+	if isOutOfMemory(p.err, p.denoStderr.W.Bytes(), p.cgroup) {
+		return p.broker.Events(), fmt.Errorf("%w: %w", ErrOutOfMemory, p.err)
+	}
+	if limit, ok := resourceLimitExceeded(p.err, p.denoStderr.W.Bytes(), r.ResourceLimits, p.cgroup); ok {
+		return p.broker.Events(), &ErrorResourceLimitExceeded{Limit: limit, Inner: p.err}
+	}
+	if p.err != nil {
+		if scriptErr := readScriptError(p.job.Output); scriptErr != nil {
+			return p.broker.Events(), fmt.Errorf("%w: %w", p.err, scriptErr)
+		}
+	}
+	return p.broker.Events(), p.err
+}
+
+// terminate sends SIGTERM to the process group of deno, and SIGKILL if deno has not exited after gracePeriod.
+func (p *process) terminate(gracePeriod time.Duration) {
+	p.signal(syscall.SIGTERM)
+	t := time.NewTimer(gracePeriod)
+	defer t.Stop()
+	select {
+	case <-p.done:
+	case <-t.C:
+		p.kill()
+	}
+}
+
+func (p *process) kill() {
+	p.signal(syscall.SIGKILL)
+}
+
+func (p *process) signal(sig syscall.Signal) {
+	if p.cmd == nil || p.cmd.Process == nil {
+		return
+	}
+	err := signalProcessGroup(p.cmd.Process.Pid, sig)
+	if err != nil && sig == syscall.SIGKILL {
+		_ = p.cmd.Process.Kill()
+	}
+}
+
+func (p *process) exited() bool {
+	select {
+	case <-p.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// close releases the resources of a process that has exited, or has never started.
+func (p *process) close() {
+	p.closeFiles()
+	if p.replyWriter != nil {
+		p.replyWriter.Close()
+	}
+	if p.dir != "" {
+		os.RemoveAll(p.dir)
+	}
+	if p.cgroup != nil {
+		p.cgroup.close()
+	}
+}
+
+// closeFiles closes the files that we read from deno.
+func (p *process) closeFiles() {
+	for _, f := range []*os.File{p.pty, p.controlReader, p.stdoutReader} {
+		if f != nil {
+			f.Close()
+		}
+	}
+}
+
+// PoolStats is a snapshot of PoolMetrics.
+type PoolStats struct {
+	// Size is the number of processes that the pools keep.
+	Size int64 `json:"size"`
+	// Idle is the number of processes that are waiting for a job.
+	Idle int64 `json:"idle"`
+	// Hits is the number of runs that took a waiting process.
+	Hits int64 `json:"hits"`
+	// Misses is the number of runs that started deno themselves.
+	Misses int64 `json:"misses"`
+	// SpawnErrors is the number of processes that failed to start, or exited while waiting.
+	SpawnErrors int64 `json:"spawn_errors"`
+}
+
+// PoolMetrics counts the events of the pools of the Runners that share it.
+type PoolMetrics struct {
+	size        atomic.Int64
+	idle        atomic.Int64
+	hits        atomic.Int64
+	misses      atomic.Int64
+	spawnErrors atomic.Int64
+}
+
+func (m *PoolMetrics) Stats() PoolStats {
+	return PoolStats{
+		Size:        m.size.Load(),
+		Idle:        m.idle.Load(),
+		Hits:        m.hits.Load(),
+		Misses:      m.misses.Load(),
+		SpawnErrors: m.spawnErrors.Load(),
+	}
+}
+
+// pool keeps processes that are waiting for a job.
+type pool struct {
+	runner    *Runner
+	static    []PermissionDescriptor
+	staticKey string
+	metrics   *PoolMetrics
+	size      int
+	// idle is unbuffered. A process is waiting if its filler is blocked on sending it.
+	idle   chan *process
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+// poolRetryInterval is the interval between the attempts of starting a process after a failure.
+const poolRetryInterval = 1 * time.Second
+
+func newPool(r *Runner, size int, metrics *PoolMetrics) (*pool, error) {
+	if metrics == nil {
+		metrics = &PoolMetrics{}
+	}
+	static := StaticPermissionsOf(r.Permissioner)
+	staticKey, err := json.Marshal(static)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	p := &pool{
+		runner:    r,
+		static:    static,
+		staticKey: string(staticKey),
+		metrics:   metrics,
+		size:      size,
+		idle:      make(chan *process),
+		cancel:    cancel,
+	}
+	p.metrics.size.Add(int64(size))
+	for i := 0; i < size; i++ {
+		p.wg.Add(1)
+		go p.fill(ctx)
+	}
+	return p, nil
+}
+
+// take returns a waiting process that was started with static, or nil.
+func (p *pool) take(static []PermissionDescriptor) *process {
+	staticKey, err := json.Marshal(static)
+	if err != nil || string(staticKey) != p.staticKey {
+		p.metrics.misses.Add(1)
+		return nil
+	}
+
+	select {
+	case proc := <-p.idle:
+		if !proc.exited() {
+			p.metrics.hits.Add(1)
+			return proc
+		}
+		proc.close()
+	default:
+	}
+	p.metrics.misses.Add(1)
+	return nil
+}
+
+// fill keeps one process waiting until ctx is done.
+func (p *pool) fill(ctx context.Context) {
+	defer p.wg.Done()
+	for {
+		proc, err := p.runner.startProcess(p.static, nil, p.runner.HTTPProxy)
+		if err != nil {
+			p.metrics.spawnErrors.Add(1)
+			p.logError(ctx, err)
+			if !sleep(ctx, poolRetryInterval) {
+				return
+			}
+			continue
+		}
+
+		p.metrics.idle.Add(1)
+		select {
+		case p.idle <- proc:
+			p.metrics.idle.Add(-1)
+		case <-proc.done:
+			p.metrics.idle.Add(-1)
+			p.metrics.spawnErrors.Add(1)
+			p.logError(ctx, proc.err)
+			proc.close()
+			if !sleep(ctx, poolRetryInterval) {
+				return
+			}
+		case <-ctx.Done():
+			p.metrics.idle.Add(-1)
+			proc.kill()
+			<-proc.done
+			proc.close()
+			return
+		}
+	}
+}
+
+func (p *pool) logError(ctx context.Context, err error) {
+	if p.runner.Logger == nil {
+		return
+	}
+	p.runner.Logger.LogAttrs(ctx, slog.LevelError, "pool", slog.Any("error", err))
+}
+
+// close stops the waiting processes. The processes that have been taken are not affected.
+func (p *pool) close() {
+	p.cancel()
+	p.wg.Wait()
+	p.metrics.size.Add(-int64(p.size))
+}
+
+func sleep(ctx context.Context, d time.Duration) bool {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// linkOrCopy makes dst have the content of src.
+func linkOrCopy(src string, dst string) error {
+	err := os.Link(src, dst)
+	if err == nil {
+		return nil
+	}
+	return copyFile(src, dst)
+}
+
+func copyFile(src string, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o600)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(out, in)
+	if err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
@@ -0,0 +1,176 @@
+package deno
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+var ErrAllPort = errors.New("network permission without port is disallowed")
+
+type ErrorInvalidPortRange struct {
+	Value string
+}
+
+func (e *ErrorInvalidPortRange) Error() string {
+	return fmt.Sprintf("invalid port range: %v", e.Value)
+}
+
+type ErrorPortNotAllowed struct {
+	Port string
+}
+
+func (e *ErrorPortNotAllowed) Error() string {
+	return fmt.Sprintf("port not allowed: %v", e.Port)
+}
+
+// PortRange is an inclusive range of ports.
+type PortRange struct {
+	From int
+	To   int
+}
+
+// DefaultPortRanges allows HTTP and HTTPS only.
+var DefaultPortRanges = []PortRange{
+	{From: 80, To: 80},
+	{From: 443, To: 443},
+}
+
+// ParsePortRange parses a port like 443, or a port range like 8000-8100.
+func ParsePortRange(s string) (*PortRange, error) {
+	fromStr, toStr, isRange := strings.Cut(s, "-")
+	if !isRange {
+		toStr = fromStr
+	}
+
+	from, err := parsePort(fromStr)
+	if err != nil {
+		return nil, &ErrorInvalidPortRange{Value: s}
+	}
+	to, err := parsePort(toStr)
+	if err != nil {
+		return nil, &ErrorInvalidPortRange{Value: s}
+	}
+	if from > to {
+		return nil, &ErrorInvalidPortRange{Value: s}
+	}
+
+	return &PortRange{
+		From: from,
+		To:   to,
+	}, nil
+}
+
+func ParsePortRanges(ss []string) ([]PortRange, error) {
+	var ranges []PortRange
+	for _, s := range ss {
+		r, err := ParsePortRange(s)
+		if err != nil {
+			return nil, err
+		}
+		ranges = append(ranges, *r)
+	}
+	return ranges, nil
+}
+
+func parsePort(s string) (int, error) {
+	port, err := strconv.Atoi(strings.TrimSpace(s))
+	if err != nil {
+		return 0, err
+	}
+	if port < 1 || port > 65535 {
+		return 0, fmt.Errorf("port out of range: %v", port)
+	}
+	return port, nil
+}
+
+// IntersectPortRanges returns the ports that are in both a and b.
+// It is not nil, so that no port is different from every port.
+func IntersectPortRanges(a []PortRange, b []PortRange) []PortRange {
+	out := []PortRange{}
+	for _, ra := range a {
+		for _, rb := range b {
+			r := PortRange{From: max(ra.From, rb.From), To: min(ra.To, rb.To)}
+			if r.From <= r.To {
+				out = append(out, r)
+			}
+		}
+	}
+	return out
+}
+
+func portRangesContain(ranges []PortRange, port int) bool {
+	for _, r := range ranges {
+		if r.Contains(port) {
+			return true
+		}
+	}
+	return false
+}
+
+func (r PortRange) Contains(port int) bool {
+	return r.From <= port && port <= r.To
+}
+
+func (r PortRange) String() string {
+	if r.From == r.To {
+		return strconv.Itoa(r.From)
+	}
+	return fmt.Sprintf("%v-%v", r.From, r.To)
+}
+
+type PortPermissioner struct {
+	ranges           []PortRange
+	allowWithoutPort bool
+}
+
+// PortPolicy grants network permissions to ports in any of ranges.
+// A network permission without port is a permission to all ports,
+// so it is granted only if allowWithoutPort is true.
+func PortPolicy(ranges []PortRange, allowWithoutPort bool) PortPermissioner {
+	return PortPermissioner{
+		ranges:           ranges,
+		allowWithoutPort: allowWithoutPort,
+	}
+}
+
+func (p PortPermissioner) RequestPermission(ctx context.Context, pd PermissionDescriptor) (bool, error) {
+	if pd.Name != PermissionNameNet {
+		return false, &ErrorNameUnmatched{
+			Expected: PermissionNameNet,
+			Actual:   pd.Name,
+		}
+	}
+
+	if pd.Host == nil {
+		return false, ErrAllHost
+	}
+
+	if pd.Host.Port == "" {
+		if p.allowWithoutPort {
+			return true, nil
+		}
+		return false, ErrAllPort
+	}
+
+	port, err := parsePort(pd.Host.Port)
+	if err != nil {
+		return false, &ErrorPortNotAllowed{Port: pd.Host.Port}
+	}
+
+	if portRangesContain(p.ranges, port) {
+		return true, nil
+	}
+
+	return false, &ErrorPortNotAllowed{Port: pd.Host.Port}
+}
+
+func (p PortPermissioner) StaticPermissions() []PermissionDescriptor {
+	return nil
+}
+
+func (p PortPermissioner) RequestStaticPermission(pd PermissionDescriptor) (bool, error) {
+	return p.RequestPermission(context.Background(), pd)
+}
@@ -0,0 +1,81 @@
+package deno_test
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/authgear/authgear-deno/pkg/deno"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestParsePortRange(t *testing.T) {
+	Convey("ParsePortRange", t, func() {
+		r, err := deno.ParsePortRange("443")
+		So(err, ShouldBeNil)
+		So(r, ShouldResemble, &deno.PortRange{From: 443, To: 443})
+
+		r, err = deno.ParsePortRange("8000-8100")
+		So(err, ShouldBeNil)
+		So(r, ShouldResemble, &deno.PortRange{From: 8000, To: 8100})
+
+		for _, invalid := range []string{"", "0", "65536", "http", "8100-8000", "1-"} {
+			_, err := deno.ParsePortRange(invalid)
+			So(err, ShouldBeError, "invalid port range: "+invalid)
+		}
+	})
+}
+
+func TestPortPolicy(t *testing.T) {
+	Convey("PortPolicy", t, func() {
+		ctx := context.Background()
+
+		ranges, err := deno.ParsePortRanges([]string{"80", "443", "8000-8100"})
+		So(err, ShouldBeNil)
+
+		cases := []struct {
+			permissioner deno.Permissioner
+			descriptor   string
+			expected     bool
+			err          string
+		}{
+			{deno.PortPolicy(ranges, false), `{"name":"env"}`, false, "name unmatched, expected `net`, actual `env`"},
+			{deno.PortPolicy(ranges, false), `{"name":"net"}`, false, "network permission without host is disallowed"},
+			{deno.PortPolicy(ranges, false), `{"name":"net","host":"1.1.1.1:80"}`, true, ""},
+			{deno.PortPolicy(ranges, false), `{"name":"net","host":"1.1.1.1:443"}`, true, ""},
+			{deno.PortPolicy(ranges, false), `{"name":"net","host":"1.1.1.1:8050"}`, true, ""},
+			{deno.PortPolicy(ranges, false), `{"name":"net","host":"1.1.1.1:25"}`, false, "port not allowed: 25"},
+			{deno.PortPolicy(ranges, false), `{"name":"net","host":"[::1]:5432"}`, false, "port not allowed: 5432"},
+			{deno.PortPolicy(ranges, false), `{"name":"net","host":"1.1.1.1"}`, false, "network permission without port is disallowed"},
+			{deno.PortPolicy(deno.DefaultPortRanges, true), `{"name":"net","host":"example.com"}`, true, ""},
+			{deno.PortPolicy(deno.DefaultPortRanges, true), `{"name":"net","host":"example.com:8080"}`, false, "port not allowed: 8080"},
+		}
+
+		for _, c := range cases {
+			Convey(c.descriptor, func() {
+				var pd deno.PermissionDescriptor
+				err := json.Unmarshal([]byte(c.descriptor), &pd)
+				So(err, ShouldBeNil)
+				actual, err := c.permissioner.RequestPermission(ctx, pd)
+				So(actual, ShouldEqual, c.expected)
+				if c.expected {
+					So(err, ShouldBeNil)
+				} else {
+					So(err, ShouldBeError, c.err)
+				}
+			})
+		}
+	})
+}
+
+func TestIntersectPortRanges(t *testing.T) {
+	Convey("IntersectPortRanges", t, func() {
+		a := []deno.PortRange{{From: 80, To: 80}, {From: 8000, To: 8100}}
+		b := []deno.PortRange{{From: 8050, To: 9000}, {From: 443, To: 443}}
+		So(deno.IntersectPortRanges(a, b), ShouldResemble, []deno.PortRange{{From: 8050, To: 8100}})
+		So(deno.IntersectPortRanges(a, []deno.PortRange{{From: 1, To: 65535}}), ShouldResemble, a)
+		So(deno.IntersectPortRanges(a, []deno.PortRange{{From: 443, To: 443}}), ShouldNotBeNil)
+		So(deno.IntersectPortRanges(a, []deno.PortRange{{From: 443, To: 443}}), ShouldBeEmpty)
+	})
+}
@@ -0,0 +1,12 @@
+//go:build !unix
+
+package deno
+
+import (
+	"errors"
+	"syscall"
+)
+
+func signalProcessGroup(pid int, sig syscall.Signal) error {
+	return errors.New("process groups are only available on Unix")
+}
@@ -0,0 +1,12 @@
+//go:build unix
+
+package deno
+
+import (
+	"syscall"
+)
+
+// signalProcessGroup sends sig to every process in the process group led by pid.
+func signalProcessGroup(pid int, sig syscall.Signal) error {
+	return syscall.Kill(-pid, sig)
+}
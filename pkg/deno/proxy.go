@@ -0,0 +1,208 @@
+package deno
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+)
+
+type ErrorProxyDenied struct {
+	Host  string
+	Inner error
+}
+
+func (e *ErrorProxyDenied) Error() string {
+	return fmt.Sprintf("proxy denied %v: %v", e.Host, e.Inner)
+}
+
+func (e *ErrorProxyDenied) Unwrap() error {
+	return e.Inner
+}
+
+// hopHeaders are removed when a request is forwarded.
+// See https://www.rfc-editor.org/rfc/rfc9110#section-7.6.1
+var hopHeaders = []string{
+	"Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Proxy-Connection",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// EgressProxy is a HTTP forward proxy that deno is started behind.
+// It resolves the host of each connection once, checks every resolved IP against Disallow,
+// and dials the checked IP, so that the host cannot be resolved to another IP in between.
+// The port of each connection is checked against AllowPorts,
+// as deno grants a network permission without port to every port.
+type EgressProxy struct {
+	// Resolver resolves the host of each connection.
+	// The default resolver of the system is used if it is nil.
+	Resolver IPResolver
+	// Disallow is the IPPolicy chain applied to the IP being dialed.
+	Disallow []IPPolicy
+	// AllowPorts is the ports that can be dialed. Every port can be dialed if it is nil.
+	AllowPorts []PortRange
+
+	transportOnce sync.Once
+	transport     *http.Transport
+}
+
+// DialContext dials addr with the IP that has been checked against Disallow,
+// if the port is in AllowPorts.
+// Both the tunnels of CONNECT and the forwarded requests are dialed with it.
+func (p *EgressProxy) DialContext(ctx context.Context, network string, addr string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	if p.AllowPorts != nil {
+		n, err := parsePort(port)
+		if err != nil || !portRangesContain(p.AllowPorts, n) {
+			return nil, &ErrorProxyDenied{Host: addr, Inner: &ErrorPortNotAllowed{Port: port}}
+		}
+	}
+
+	var ips []net.IP
+	if ip := net.ParseIP(host); ip != nil {
+		ips = append(ips, ip)
+	} else {
+		resolver := p.Resolver
+		if resolver == nil {
+			resolver = NetResolver{}
+		}
+		ips, err = resolver.LookupIP(ctx, host)
+		if err != nil {
+			return nil, &ErrorProxyDenied{Host: addr, Inner: err}
+		}
+	}
+
+	err = checkIPPolicies(ips, p.Disallow)
+	if err != nil {
+		return nil, &ErrorProxyDenied{Host: addr, Inner: err}
+	}
+
+	var dialer net.Dialer
+	var errs []error
+	for _, ip := range ips {
+		conn, err := dialer.DialContext(ctx, network, net.JoinHostPort(ip.String(), port))
+		if err == nil {
+			return conn, nil
+		}
+		errs = append(errs, err)
+	}
+	return nil, errors.Join(errs...)
+}
+
+func (p *EgressProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodConnect {
+		p.serveConnect(w, r)
+		return
+	}
+	p.serveForward(w, r)
+}
+
+func (p *EgressProxy) serveConnect(w http.ResponseWriter, r *http.Request) {
+	upstream, err := p.DialContext(r.Context(), "tcp", r.Host)
+	if err != nil {
+		p.writeError(w, err)
+		return
+	}
+	defer upstream.Close()
+
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "hijacking is not supported", http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	downstream, buf, err := hijacker.Hijack()
+	if err != nil {
+		return
+	}
+	defer downstream.Close()
+
+	// Flush what the client has sent after the CONNECT request.
+	if n := buf.Reader.Buffered(); n > 0 {
+		b, _ := buf.Reader.Peek(n)
+		_, err = upstream.Write(b)
+		if err != nil {
+			return
+		}
+	}
+
+	done := make(chan struct{}, 2)
+	go func() {
+		_, _ = io.Copy(upstream, downstream)
+		done <- struct{}{}
+	}()
+	go func() {
+		_, _ = io.Copy(downstream, upstream)
+		done <- struct{}{}
+	}()
+	<-done
+}
+
+func (p *EgressProxy) serveForward(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Scheme != "http" || r.URL.Host == "" {
+		http.Error(w, "absolute http URL is required", http.StatusBadRequest)
+		return
+	}
+
+	outReq := r.Clone(r.Context())
+	outReq.RequestURI = ""
+	for _, h := range hopHeaders {
+		outReq.Header.Del(h)
+	}
+
+	resp, err := p.getTransport().RoundTrip(outReq)
+	if err != nil {
+		p.writeError(w, err)
+		return
+	}
+	defer resp.Body.Close()
+
+	for _, h := range hopHeaders {
+		resp.Header.Del(h)
+	}
+	for k, vs := range resp.Header {
+		for _, v := range vs {
+			w.Header().Add(k, v)
+		}
+	}
+	w.WriteHeader(resp.StatusCode)
+	_, _ = io.Copy(w, resp.Body)
+}
+
+func (p *EgressProxy) getTransport() *http.Transport {
+	p.transportOnce.Do(func() {
+		p.transport = &http.Transport{
+			DialContext: p.DialContext,
+			// The proxy must not be proxied.
+			Proxy: nil,
+		}
+	})
+	return p.transport
+}
+
+// CloseIdleConnections closes the idle connections kept for forwarding requests.
+func (p *EgressProxy) CloseIdleConnections() {
+	p.getTransport().CloseIdleConnections()
+}
+
+func (p *EgressProxy) writeError(w http.ResponseWriter, err error) {
+	var deniedError *ErrorProxyDenied
+	if errors.As(err, &deniedError) {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	http.Error(w, err.Error(), http.StatusBadGateway)
+}
@@ -0,0 +1,161 @@
+package deno_test
+
+import (
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync/atomic"
+	"testing"
+
+	"github.com/authgear/authgear-deno/pkg/deno"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestEgressProxy(t *testing.T) {
+	Convey("EgressProxy", t, func() {
+		var current atomic.Value
+		current.Store(net.ParseIP("127.0.0.1"))
+		netResolver, _, closeDNS := startDNSServer(func(name string) []net.IP {
+			if name == "upstream.test" {
+				return []net.IP{current.Load().(net.IP)}
+			}
+			return nil
+		}, 0)
+		defer closeDNS()
+		resolver := deno.NetResolver{Resolver: netResolver}
+
+		handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprintf(w, "hello")
+		})
+
+		get := func(proxy *deno.EgressProxy, target string) (int, string) {
+			proxyServer := httptest.NewServer(proxy)
+			defer proxyServer.Close()
+			proxyURL, _ := url.Parse(proxyServer.URL)
+
+			client := &http.Client{
+				Transport: &http.Transport{
+					Proxy: http.ProxyURL(proxyURL),
+					//nolint:gosec
+					TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+				},
+			}
+			resp, err := client.Get(target)
+			if err != nil {
+				return 0, err.Error()
+			}
+			defer resp.Body.Close()
+			b, _ := io.ReadAll(resp.Body)
+			return resp.StatusCode, string(b)
+		}
+
+		Convey("forward http", func() {
+			upstream := httptest.NewServer(handler)
+			defer upstream.Close()
+			_, port, _ := net.SplitHostPort(upstream.Listener.Addr().String())
+			target := "http://upstream.test:" + port + "/"
+
+			status, body := get(&deno.EgressProxy{Resolver: resolver}, target)
+			So(status, ShouldEqual, http.StatusOK)
+			So(body, ShouldEqual, "hello")
+
+			status, body = get(&deno.EgressProxy{Resolver: resolver, Disallow: []deno.IPPolicy{deno.DisallowLoopback}}, target)
+			So(status, ShouldEqual, http.StatusForbidden)
+			So(body, ShouldContainSubstring, "loopback: 127.0.0.1")
+		})
+
+		Convey("tunnel https", func() {
+			upstream := httptest.NewTLSServer(handler)
+			defer upstream.Close()
+			_, port, _ := net.SplitHostPort(upstream.Listener.Addr().String())
+			target := "https://upstream.test:" + port + "/"
+
+			status, body := get(&deno.EgressProxy{Resolver: resolver}, target)
+			So(status, ShouldEqual, http.StatusOK)
+			So(body, ShouldEqual, "hello")
+
+			status, body = get(&deno.EgressProxy{Resolver: resolver, Disallow: []deno.IPPolicy{deno.DisallowLoopback}}, target)
+			So(status, ShouldEqual, 0)
+			So(body, ShouldContainSubstring, "Forbidden")
+		})
+
+		Convey("check the IP that is dialed instead of the IP that was granted", func() {
+			listener, err := net.Listen("tcp", "127.0.0.2:0")
+			So(err, ShouldBeNil)
+			upstream := httptest.NewUnstartedServer(handler)
+			upstream.Listener = listener
+			upstream.Start()
+			defer upstream.Close()
+			_, port, _ := net.SplitHostPort(listener.Addr().String())
+			target := "http://upstream.test:" + port + "/"
+
+			disallow127001 := func(ip net.IP) (bool, error) {
+				if ip.Equal(net.ParseIP("127.0.0.1")) {
+					return false, &deno.ErrorLoopback{IP: ip}
+				}
+				return true, nil
+			}
+
+			current.Store(net.ParseIP("127.0.0.2"))
+			status, _ := get(&deno.EgressProxy{Resolver: resolver, Disallow: []deno.IPPolicy{disallow127001}}, target)
+			So(status, ShouldEqual, http.StatusOK)
+
+			// Rebind
+			current.Store(net.ParseIP("127.0.0.1"))
+			status, body := get(&deno.EgressProxy{Resolver: resolver, Disallow: []deno.IPPolicy{disallow127001}}, target)
+			So(status, ShouldEqual, http.StatusForbidden)
+			So(body, ShouldContainSubstring, "loopback: 127.0.0.1")
+		})
+
+		Convey("check the deny_cidrs of a run in addition to the IP policies of the server", func() {
+			upstream := httptest.NewServer(handler)
+			defer upstream.Close()
+			_, port, _ := net.SplitHostPort(upstream.Listener.Addr().String())
+			target := "http://upstream.test:" + port + "/"
+
+			denyCIDRs, err := deno.ParseCIDRs([]string{"127.0.0.1/32"})
+			So(err, ShouldBeNil)
+			server := []deno.IPPolicy{deno.DisallowMetadata}
+			run := &deno.EgressProxy{Resolver: resolver, Disallow: append(server, deno.DisallowCIDRs(denyCIDRs...))}
+
+			current.Store(net.ParseIP("127.0.0.1"))
+			status, _ := get(&deno.EgressProxy{Resolver: resolver, Disallow: server}, target)
+			So(status, ShouldEqual, http.StatusOK)
+			status, body := get(run, target)
+			So(status, ShouldEqual, http.StatusForbidden)
+			So(body, ShouldContainSubstring, "cidr 127.0.0.1/32: 127.0.0.1")
+		})
+
+		Convey("check the port of both forwarded requests and tunnels", func() {
+			upstream := httptest.NewServer(handler)
+			defer upstream.Close()
+			tlsUpstream := httptest.NewTLSServer(handler)
+			defer tlsUpstream.Close()
+			_, port, _ := net.SplitHostPort(upstream.Listener.Addr().String())
+			_, tlsPort, _ := net.SplitHostPort(tlsUpstream.Listener.Addr().String())
+			target := "http://upstream.test:" + port + "/"
+			tlsTarget := "https://upstream.test:" + tlsPort + "/"
+
+			ports, err := deno.ParsePortRanges([]string{port, tlsPort})
+			So(err, ShouldBeNil)
+			status, _ := get(&deno.EgressProxy{Resolver: resolver, AllowPorts: ports}, target)
+			So(status, ShouldEqual, http.StatusOK)
+			status, _ = get(&deno.EgressProxy{Resolver: resolver, AllowPorts: ports}, tlsTarget)
+			So(status, ShouldEqual, http.StatusOK)
+
+			// Like the allow_ports of a run that does not overlap the ports of the server.
+			none := deno.IntersectPortRanges(ports, deno.DefaultPortRanges)
+			status, body := get(&deno.EgressProxy{Resolver: resolver, AllowPorts: none}, target)
+			So(status, ShouldEqual, http.StatusForbidden)
+			So(body, ShouldContainSubstring, "port not allowed: "+port)
+			status, body = get(&deno.EgressProxy{Resolver: resolver, AllowPorts: none}, tlsTarget)
+			So(status, ShouldEqual, 0)
+			So(body, ShouldContainSubstring, "Forbidden")
+		})
+	})
+}
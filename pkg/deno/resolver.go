@@ -0,0 +1,343 @@
+package deno
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// IPResolver resolves a host to IPs.
+type IPResolver interface {
+	LookupIP(ctx context.Context, host string) ([]net.IP, error)
+}
+
+// NetResolver resolves a host with net.Resolver.
+// The zero value uses the default resolver of the system.
+type NetResolver struct {
+	Resolver *net.Resolver
+}
+
+func (r NetResolver) LookupIP(ctx context.Context, host string) ([]net.IP, error) {
+	var ips []net.IP
+	addrs, err := r.Resolver.LookupHost(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	for _, addr := range addrs {
+		ip := net.ParseIP(addr)
+		if ip == nil {
+			return nil, &ErrorInvalidIP{
+				Value: addr,
+			}
+		}
+		ips = append(ips, ip)
+	}
+
+	if len(ips) <= 0 {
+		return nil, &ErrorNoIP{
+			Host: host,
+		}
+	}
+	return ips, nil
+}
+
+type ErrorDNS struct {
+	Host  string
+	RCode dnsmessage.RCode
+}
+
+func (e *ErrorDNS) Error() string {
+	return fmt.Sprintf("dns %v: %v", e.RCode, e.Host)
+}
+
+type DNSResolverOptions struct {
+	// Server is the address of the DNS server, like 1.1.1.1:53.
+	// The default is the first nameserver in /etc/resolv.conf.
+	Server string
+	// Network is either "udp" or "tcp". The default is "udp".
+	// A truncated answer over UDP is queried again over TCP.
+	Network string
+	// Timeout is the timeout of each query. The default is 5 seconds.
+	Timeout time.Duration
+	// NegativeTTL is how long a failed lookup is cached. The default is 30 seconds.
+	NegativeTTL time.Duration
+	// MaxTTL caps the TTL of the answers. The default is 1 hour.
+	MaxTTL time.Duration
+	// MaxCacheEntries caps the number of cached hosts. The default is 10000.
+	MaxCacheEntries int
+}
+
+type dnsCacheEntry struct {
+	ips     []net.IP
+	err     error
+	expires time.Time
+}
+
+// DNSResolver sends A and AAAA queries to Server.
+// The answers are cached by their TTL, and the failures are cached by NegativeTTL.
+// The expired entries are swept when the cache is full.
+// It is safe to share a DNSResolver.
+type DNSResolver struct {
+	options DNSResolverOptions
+	now     func() time.Time
+
+	mutex sync.Mutex
+	cache map[string]dnsCacheEntry
+}
+
+func NewDNSResolver(options DNSResolverOptions) *DNSResolver {
+	if options.Server == "" {
+		options.Server = systemDNSServer()
+	}
+	if options.Network == "" {
+		options.Network = "udp"
+	}
+	if options.Timeout <= 0 {
+		options.Timeout = 5 * time.Second
+	}
+	if options.NegativeTTL <= 0 {
+		options.NegativeTTL = 30 * time.Second
+	}
+	if options.MaxTTL <= 0 {
+		options.MaxTTL = time.Hour
+	}
+	if options.MaxCacheEntries <= 0 {
+		options.MaxCacheEntries = 10000
+	}
+	return &DNSResolver{
+		options: options,
+		now:     time.Now,
+		cache:   make(map[string]dnsCacheEntry),
+	}
+}
+
+func (r *DNSResolver) LookupIP(ctx context.Context, host string) ([]net.IP, error) {
+	name := strings.ToLower(strings.TrimSuffix(host, ".")) + "."
+
+	r.mutex.Lock()
+	entry, ok := r.cache[name]
+	r.mutex.Unlock()
+	if ok && r.now().Before(entry.expires) {
+		return entry.ips, entry.err
+	}
+
+	ips, ttl, err := r.lookup(ctx, name)
+	if err != nil {
+		// Do not cache the error of our own, like the context being canceled.
+		var dnsError *ErrorDNS
+		var noIPError *ErrorNoIP
+		if !errors.As(err, &dnsError) && !errors.As(err, &noIPError) {
+			return nil, err
+		}
+		ttl = r.options.NegativeTTL
+	}
+	if ttl > r.options.MaxTTL {
+		ttl = r.options.MaxTTL
+	}
+
+	r.mutex.Lock()
+	r.store(name, dnsCacheEntry{
+		ips:     ips,
+		err:     err,
+		expires: r.now().Add(ttl),
+	})
+	r.mutex.Unlock()
+
+	return ips, err
+}
+
+// store must be called with mutex held.
+func (r *DNSResolver) store(name string, entry dnsCacheEntry) {
+	if _, ok := r.cache[name]; !ok && len(r.cache) >= r.options.MaxCacheEntries {
+		now := r.now()
+		for k, v := range r.cache {
+			if !now.Before(v.expires) {
+				delete(r.cache, k)
+			}
+		}
+		// Evict arbitrary entries if none has expired.
+		for k := range r.cache {
+			if len(r.cache) < r.options.MaxCacheEntries {
+				break
+			}
+			delete(r.cache, k)
+		}
+	}
+	r.cache[name] = entry
+}
+
+func (r *DNSResolver) lookup(ctx context.Context, name string) ([]net.IP, time.Duration, error) {
+	var ips []net.IP
+	var ttl time.Duration
+	for _, qtype := range []dnsmessage.Type{dnsmessage.TypeA, dnsmessage.TypeAAAA} {
+		answers, answerTTL, err := r.query(ctx, name, qtype)
+		if err != nil {
+			return nil, 0, err
+		}
+		if len(answers) > 0 && (ttl == 0 || answerTTL < ttl) {
+			ttl = answerTTL
+		}
+		ips = append(ips, answers...)
+	}
+
+	if len(ips) <= 0 {
+		return nil, 0, &ErrorNoIP{
+			Host: strings.TrimSuffix(name, "."),
+		}
+	}
+	return ips, ttl, nil
+}
+
+func (r *DNSResolver) query(ctx context.Context, name string, qtype dnsmessage.Type) ([]net.IP, time.Duration, error) {
+	qname, err := dnsmessage.NewName(name)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	var idBytes [2]byte
+	_, err = rand.Read(idBytes[:])
+	if err != nil {
+		return nil, 0, err
+	}
+	id := binary.BigEndian.Uint16(idBytes[:])
+	query := dnsmessage.Message{
+		Header: dnsmessage.Header{
+			ID:               id,
+			RecursionDesired: true,
+		},
+		Questions: []dnsmessage.Question{
+			{Name: qname, Type: qtype, Class: dnsmessage.ClassINET},
+		},
+	}
+	b, err := query.Pack()
+	if err != nil {
+		return nil, 0, err
+	}
+
+	msg, err := r.send(ctx, r.options.Network, b)
+	if err != nil {
+		return nil, 0, err
+	}
+	if msg.Header.ID != id || !msg.Header.Response {
+		return nil, 0, fmt.Errorf("dns: unexpected response for %v", name)
+	}
+	// The answers do not fit in a UDP message, so they are queried again over TCP.
+	if msg.Header.Truncated && r.options.Network != "tcp" {
+		msg, err = r.send(ctx, "tcp", b)
+		if err != nil {
+			return nil, 0, err
+		}
+		if msg.Header.ID != id || !msg.Header.Response || msg.Header.Truncated {
+			return nil, 0, fmt.Errorf("dns: unexpected response for %v", name)
+		}
+	}
+	if msg.Header.RCode != dnsmessage.RCodeSuccess {
+		return nil, 0, &ErrorDNS{
+			Host:  strings.TrimSuffix(name, "."),
+			RCode: msg.Header.RCode,
+		}
+	}
+
+	var ips []net.IP
+	var ttl time.Duration
+	for _, answer := range msg.Answers {
+		answerTTL := time.Duration(answer.Header.TTL) * time.Second
+		switch body := answer.Body.(type) {
+		case *dnsmessage.AResource:
+			ips = append(ips, net.IP(body.A[:]).To4())
+		case *dnsmessage.AAAAResource:
+			ips = append(ips, net.IP(body.AAAA[:]).To16())
+		default:
+			// CNAME is followed by the server.
+			continue
+		}
+		if len(ips) == 1 || answerTTL < ttl {
+			ttl = answerTTL
+		}
+	}
+	return ips, ttl, nil
+}
+
+// send sends query to Server over network, and unpacks the response.
+func (r *DNSResolver) send(ctx context.Context, network string, query []byte) (*dnsmessage.Message, error) {
+	ctx, cancel := context.WithTimeout(ctx, r.options.Timeout)
+	defer cancel()
+
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, network, r.options.Server)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(deadline)
+	}
+
+	resp, err := exchange(conn, network, query)
+	if err != nil {
+		return nil, err
+	}
+
+	var msg dnsmessage.Message
+	err = msg.Unpack(resp)
+	if err != nil {
+		return nil, err
+	}
+	return &msg, nil
+}
+
+func exchange(conn net.Conn, network string, query []byte) ([]byte, error) {
+	if network == "tcp" {
+		// DNS over TCP prefixes the message with 2-byte length.
+		b := append([]byte{byte(len(query) >> 8), byte(len(query))}, query...)
+		_, err := conn.Write(b)
+		if err != nil {
+			return nil, err
+		}
+		var length [2]byte
+		_, err = io.ReadFull(conn, length[:])
+		if err != nil {
+			return nil, err
+		}
+		resp := make([]byte, int(length[0])<<8|int(length[1]))
+		_, err = io.ReadFull(conn, resp)
+		if err != nil {
+			return nil, err
+		}
+		return resp, nil
+	}
+
+	_, err := conn.Write(query)
+	if err != nil {
+		return nil, err
+	}
+	resp := make([]byte, 65535)
+	n, err := conn.Read(resp)
+	if err != nil {
+		return nil, err
+	}
+	return resp[:n], nil
+}
+
+func systemDNSServer() string {
+	b, err := os.ReadFile("/etc/resolv.conf")
+	if err == nil {
+		for _, line := range strings.Split(string(b), "\n") {
+			fields := strings.Fields(line)
+			if len(fields) >= 2 && fields[0] == "nameserver" {
+				return net.JoinHostPort(fields[1], "53")
+			}
+		}
+	}
+	return "127.0.0.1:53"
+}
@@ -0,0 +1,138 @@
+package deno_test
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/authgear/authgear-deno/pkg/deno"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestDNSResolver(t *testing.T) {
+	Convey("DNSResolver", t, func() {
+		ctx := context.Background()
+
+		var queries atomic.Int64
+		_, addr, closeDNS := startDNSServer(func(name string) []net.IP {
+			queries.Add(1)
+			switch name {
+			case "example.test":
+				return []net.IP{net.ParseIP("1.1.1.1"), net.ParseIP("2606:4700::1111")}
+			case "private.test":
+				return []net.IP{net.ParseIP("10.0.0.1")}
+			default:
+				return nil
+			}
+		}, 1)
+		defer closeDNS()
+
+		resolver := deno.NewDNSResolver(deno.DNSResolverOptions{
+			Server:      addr,
+			NegativeTTL: time.Second,
+		})
+
+		Convey("resolve and cache by TTL", func() {
+			ips, err := resolver.LookupIP(ctx, "example.test")
+			So(err, ShouldBeNil)
+			So(ips, ShouldResemble, []net.IP{net.ParseIP("1.1.1.1").To4(), net.ParseIP("2606:4700::1111")})
+			So(queries.Load(), ShouldEqual, 2)
+
+			_, err = resolver.LookupIP(ctx, "EXAMPLE.test.")
+			So(err, ShouldBeNil)
+			So(queries.Load(), ShouldEqual, 2)
+
+			time.Sleep(1100 * time.Millisecond)
+			_, err = resolver.LookupIP(ctx, "example.test")
+			So(err, ShouldBeNil)
+			So(queries.Load(), ShouldEqual, 4)
+		})
+
+		Convey("cache failures", func() {
+			_, err := resolver.LookupIP(ctx, "nxdomain.test")
+			So(err, ShouldBeError, "dns RCodeNameError: nxdomain.test")
+			So(queries.Load(), ShouldEqual, 1)
+
+			_, err = resolver.LookupIP(ctx, "nxdomain.test")
+			So(err, ShouldBeError, "dns RCodeNameError: nxdomain.test")
+			So(queries.Load(), ShouldEqual, 1)
+		})
+
+		Convey("bound the cache", func() {
+			resolver := deno.NewDNSResolver(deno.DNSResolverOptions{
+				Server:          addr,
+				MaxCacheEntries: 1,
+			})
+
+			_, err := resolver.LookupIP(ctx, "example.test")
+			So(err, ShouldBeNil)
+			_, err = resolver.LookupIP(ctx, "private.test")
+			So(err, ShouldBeNil)
+			So(queries.Load(), ShouldEqual, 4)
+
+			// example.test was evicted for private.test.
+			_, err = resolver.LookupIP(ctx, "example.test")
+			So(err, ShouldBeNil)
+			So(queries.Load(), ShouldEqual, 6)
+		})
+
+		Convey("resolve for IPPolicyPermissioner", func() {
+			p := deno.DisallowIPPolicy(deno.DisallowPrivate).WithResolver(resolver)
+
+			var pd deno.PermissionDescriptor
+			err := json.Unmarshal([]byte(`{"name":"net","host":"example.test:443"}`), &pd)
+			So(err, ShouldBeNil)
+			ok, err := p.RequestPermission(ctx, pd)
+			So(err, ShouldBeNil)
+			So(ok, ShouldBeTrue)
+
+			err = json.Unmarshal([]byte(`{"name":"net","host":"private.test:443"}`), &pd)
+			So(err, ShouldBeNil)
+			ok, err = p.RequestPermission(ctx, pd)
+			So(err, ShouldBeError, "private: 10.0.0.1")
+			So(ok, ShouldBeFalse)
+		})
+	})
+
+	Convey("DNSResolver retries a truncated answer over TCP", t, func() {
+		ctx := context.Background()
+
+		addr, tcpQueries, closeDNS := startTruncatingDNSServer(func(name string) []net.IP {
+			return []net.IP{net.ParseIP("1.1.1.1")}
+		}, 1)
+		defer closeDNS()
+
+		resolver := deno.NewDNSResolver(deno.DNSResolverOptions{
+			Server: addr,
+		})
+		ips, err := resolver.LookupIP(ctx, "example.test")
+		So(err, ShouldBeNil)
+		So(ips, ShouldResemble, []net.IP{net.ParseIP("1.1.1.1").To4()})
+		So(tcpQueries.Load(), ShouldEqual, 2)
+	})
+
+	Convey("WithDeadline", t, func() {
+		ctx := context.Background()
+
+		// A DNS server that never answers.
+		conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+		So(err, ShouldBeNil)
+		defer conn.Close()
+
+		resolver := deno.NewDNSResolver(deno.DNSResolverOptions{
+			Server: conn.LocalAddr().String(),
+		})
+		p := deno.WithDeadline(deno.DisallowIPPolicy().WithResolver(resolver), 100*time.Millisecond)
+
+		var pd deno.PermissionDescriptor
+		err = json.Unmarshal([]byte(`{"name":"net","host":"example.test:443"}`), &pd)
+		So(err, ShouldBeNil)
+		ok, err := p.RequestPermission(ctx, pd)
+		So(err, ShouldBeError, "permission decision timeout after 100ms")
+		So(ok, ShouldBeFalse)
+	})
+}
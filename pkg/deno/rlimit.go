@@ -0,0 +1,67 @@
+package deno
+
+import (
+	"fmt"
+	"regexp"
+)
+
+// ResourceLimit names a limit of ResourceLimits.
+type ResourceLimit string
+
+const (
+	ResourceLimitCPU       ResourceLimit = "cpu"
+	ResourceLimitOpenFiles ResourceLimit = "open_files"
+	ResourceLimitFileSize  ResourceLimit = "file_size"
+	ResourceLimitProcesses ResourceLimit = "processes"
+)
+
+// ResourceLimits are the limits of each deno process. A limit is set only if it is positive.
+type ResourceLimits struct {
+	// CPUSeconds is RLIMIT_CPU, the CPU time of the process in seconds.
+	CPUSeconds int64
+	// OpenFiles is RLIMIT_NOFILE, one more than the largest file descriptor the process can open.
+	OpenFiles int64
+	// FileSizeBytes is RLIMIT_FSIZE, the largest file the process can write.
+	FileSizeBytes int64
+	// Processes is the pids.max of the cgroup of the run, which counts the processes and the threads of the run only,
+	// and deno starts a dozen threads. It is only set if Runner.MemoryCgroup is not empty.
+	Processes int64
+}
+
+// ErrorResourceLimitExceeded means deno has exited because the run exceeded a limit of Runner.ResourceLimits.
+type ErrorResourceLimitExceeded struct {
+	Limit ResourceLimit
+	Inner error
+}
+
+func (e *ErrorResourceLimitExceeded) Error() string {
+	return fmt.Sprintf("resource limit exceeded: %v: %v", e.Limit, e.Inner)
+}
+
+func (e *ErrorResourceLimitExceeded) Unwrap() error {
+	return e.Inner
+}
+
+// openFilesRegexp matches the error of EMFILE that deno writes to stderr.
+var openFilesRegexp = regexp.MustCompile(`Too many open files`)
+
+// resourceLimitExceeded reports which limit deno has exceeded, if it has exited because of one.
+// The limits of CPU time and file size are enforced by signals.
+// The limit of processes is told by the pids.events of cgroup.
+// The others make a system call fail, so they are told from the error that deno itself writes to stderr.
+// An error thrown to the target script is an ErrorScript instead, as runner.ts reports it on the control channel.
+func resourceLimitExceeded(waitErr error, stderr []byte, limits ResourceLimits, cgroup *memoryCgroup) (ResourceLimit, bool) {
+	if waitErr == nil {
+		return "", false
+	}
+	if limit, ok := resourceLimitSignaled(waitErr, limits); ok {
+		return limit, true
+	}
+	if limits.OpenFiles > 0 && openFilesRegexp.Match(stderr) {
+		return ResourceLimitOpenFiles, true
+	}
+	if limits.Processes > 0 && cgroup != nil && cgroup.processesExceeded() {
+		return ResourceLimitProcesses, true
+	}
+	return "", false
+}
@@ -0,0 +1,61 @@
+package deno
+
+import (
+	"errors"
+	"os/exec"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+// setResourceLimits sets the rlimits of the process pid with prlimit(2).
+// The soft limit of CPU time sends SIGXCPU, and the hard limit one second later sends SIGKILL.
+func setResourceLimits(pid int, limits ResourceLimits) error {
+	for _, l := range []struct {
+		resource int
+		value    int64
+		extra    uint64
+	}{
+		{syscall.RLIMIT_CPU, limits.CPUSeconds, 1},
+		{syscall.RLIMIT_NOFILE, limits.OpenFiles, 0},
+		{syscall.RLIMIT_FSIZE, limits.FileSizeBytes, 0},
+	} {
+		if l.value <= 0 {
+			continue
+		}
+		rlimit := syscall.Rlimit{
+			Cur: uint64(l.value),
+			Max: uint64(l.value) + l.extra,
+		}
+		_, _, errno := syscall.RawSyscall6(syscall.SYS_PRLIMIT64, uintptr(pid), uintptr(l.resource), uintptr(unsafe.Pointer(&rlimit)), 0, 0, 0)
+		if errno != 0 {
+			return errno
+		}
+	}
+	return nil
+}
+
+// resourceLimitSignaled reports which limit deno has exceeded, if it was killed by the signal of the limit.
+func resourceLimitSignaled(waitErr error, limits ResourceLimits) (ResourceLimit, bool) {
+	var exitError *exec.ExitError
+	if !errors.As(waitErr, &exitError) {
+		return "", false
+	}
+	status, ok := exitError.Sys().(syscall.WaitStatus)
+	if !ok || !status.Signaled() {
+		return "", false
+	}
+	switch status.Signal() {
+	case syscall.SIGXCPU:
+		return ResourceLimitCPU, true
+	case syscall.SIGXFSZ:
+		return ResourceLimitFileSize, true
+	case syscall.SIGKILL:
+		// SIGKILL is also sent when the run is canceled, so the CPU time tells them apart.
+		cpu := exitError.UserTime() + exitError.SystemTime()
+		if limits.CPUSeconds > 0 && cpu >= time.Duration(limits.CPUSeconds)*time.Second {
+			return ResourceLimitCPU, true
+		}
+	}
+	return "", false
+}
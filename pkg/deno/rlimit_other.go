@@ -0,0 +1,15 @@
+//go:build !linux
+
+package deno
+
+import (
+	"errors"
+)
+
+func setResourceLimits(pid int, limits ResourceLimits) error {
+	return errors.New("resource limits are only available on Linux")
+}
+
+func resourceLimitSignaled(waitErr error, limits ResourceLimits) (ResourceLimit, bool) {
+	return "", false
+}
@@ -1,19 +1,17 @@
 package deno
 
 import (
-	"bufio"
 	"bytes"
 	"context"
 	_ "embed"
 	"encoding/json"
-	"fmt"
 	"io"
+	"log/slog"
 	"os"
 	"os/exec"
 	"path/filepath"
 	"strings"
-
-	"github.com/creack/pty"
+	"time"
 
 	"github.com/authgear/authgear-deno/pkg/ioutil"
 )
@@ -21,28 +19,46 @@ import (
 //go:embed runner.ts
 var runnerScriptBytes []byte
 
+//go:embed wrappers.ts
+var wrappersScriptBytes []byte
+
+//go:embed gate.ts
+var gateScriptBytes []byte
+
 type StdStream = *ioutil.LimitedWriter[*bytes.Buffer]
 
-// StdStreamLimit is 1MiB.
+// StdStreamLimit is 1MiB. It is the default of Runner.StdStreamLimit.
 const StdStreamLimit int64 = 1 * 1024 * 1024
 
+// KillGracePeriod is 1 second. It is the default of Runner.KillGracePeriod.
+const KillGracePeriod = 1 * time.Second
+
 type RunFileResult struct {
-	Stdout StdStream
-	Stderr StdStream
+	Stdout           StdStream
+	Stderr           StdStream
+	Logs             *LogRecorder
+	PermissionEvents []PermissionEvent
+	ResourceUsage    ResourceUsage
 }
 
 func (r *RunFileResult) Wrap(err error) error {
 	return &RunFileError{
-		Inner:  err,
-		Stdout: r.Stdout,
-		Stderr: r.Stderr,
+		Inner:            err,
+		Stdout:           r.Stdout,
+		Stderr:           r.Stderr,
+		Logs:             r.Logs,
+		PermissionEvents: r.PermissionEvents,
+		ResourceUsage:    r.ResourceUsage,
 	}
 }
 
 type RunFileError struct {
-	Inner  error
-	Stdout StdStream
-	Stderr StdStream
+	Inner            error
+	Stdout           StdStream
+	Stderr           StdStream
+	Logs             *LogRecorder
+	PermissionEvents []PermissionEvent
+	ResourceUsage    ResourceUsage
 }
 
 func (e *RunFileError) Error() string {
@@ -60,12 +76,31 @@ type RunFileOptions struct {
 	Input string
 	// Output is the filename of the output.
 	Output string
+	// Permissioner further restricts the permissions of this run.
+	// A permission is granted only if both Runner.Permissioner and Permissioner grant it.
+	Permissioner Permissioner
+	// Stdout and Stderr receive what the target script writes, as it is written, if they are not nil.
+	// They are limited like RunFileResult.Stdout and RunFileResult.Stderr.
+	// They must not block, as deno waits for them.
+	Stdout io.Writer
+	Stderr io.Writer
+	// OnPermissionEvent is called with each permission event as it is decided, if it is not nil.
+	// See PermissionBroker.OnEvent.
+	OnPermissionEvent func(PermissionEvent)
+	// IPPolicies and AllowPorts further restrict the IPs and the ports that this run connects to,
+	// if Runner.RunProxy is not nil.
+	// They are checked by the proxy when it dials, so a host that resolves again to another IP is checked again.
+	IPPolicies []IPPolicy
+	AllowPorts []PortRange
 }
 
 type RunGoValueResult struct {
-	Output interface{}
-	Stdout StdStream
-	Stderr StdStream
+	Output           interface{}
+	Stdout           StdStream
+	Stderr           StdStream
+	Logs             *LogRecorder
+	PermissionEvents []PermissionEvent
+	ResourceUsage    ResourceUsage
 }
 
 type RunGoValueOptions struct {
@@ -73,32 +108,96 @@ type RunGoValueOptions struct {
 	TargetScript string
 	// Input is the input.
 	Input interface{}
+	// Permissioner further restricts the permissions of this run.
+	// See RunFileOptions.Permissioner.
+	Permissioner Permissioner
+	// Stdout, Stderr and OnPermissionEvent observe the run as it happens.
+	// See RunFileOptions.Stdout.
+	Stdout            io.Writer
+	Stderr            io.Writer
+	OnPermissionEvent func(PermissionEvent)
+	// IPPolicies and AllowPorts further restrict the IPs and the ports that this run connects to.
+	// See RunFileOptions.IPPolicies.
+	IPPolicies []IPPolicy
+	AllowPorts []PortRange
+}
+
+type EvaluatePermissionsOptions struct {
+	// Descriptors are the permissions to decide.
+	Descriptors []PermissionDescriptor
+	// Permissioner further restricts the permissions.
+	// See RunFileOptions.Permissioner.
+	Permissioner Permissioner
 }
 
 type Runner struct {
 	// Permissioner manages the permissions of the target script.
+	// If it is a StaticPermissioner, the permissions it grants statically are passed to deno as --allow-* flags.
+	// deno does not prompt for them, so they are not in the permission events.
 	Permissioner Permissioner
+	// HTTPProxy is the URL of the proxy that deno is started behind, usually an EgressProxy.
+	// It is not used if it is empty.
+	HTTPProxy string
+	// RunProxy returns the URL of a proxy that checks ipPolicies and allowPorts in addition to those of HTTPProxy,
+	// and a function that releases it after the run, if it is not nil.
+	// It is called for each run that has RunFileOptions.IPPolicies or AllowPorts, which then starts deno behind the proxy,
+	// rather than taking a process of the pool or running in a worker.
+	RunProxy func(ipPolicies []IPPolicy, allowPorts []PortRange) (httpProxy string, release func(), err error)
+	// Logger logs the permission events of each run, if it is not nil.
+	Logger *slog.Logger
+	// DenoVersion is the version of deno, usually from DetectDenoVersion.
+	// It also decides which static permissions can be passed as flags.
+	// The permission prompts of every supported version are recognized if it is the zero value.
+	DenoVersion DenoVersion
+	// StdStreamLimit is the maximum number of bytes kept from stdout and from stderr.
+	// The package-level StdStreamLimit is used if it is zero.
+	StdStreamLimit int64
+	// PoolSize is the number of deno processes that are started by Start before they are needed.
+	// Each process serves one run, and is replaced as soon as it is taken.
+	// A run takes a process only if it has the same static permissions as Permissioner,
+	// that is, if the Permissioner of the run does not narrow them.
+	PoolSize int
+	// PoolMetrics counts the events of the pool. It can be shared by Runners.
+	PoolMetrics *PoolMetrics
+	// WorkerMode makes RunGoValue run the target script in a Web Worker of a long-lived deno process,
+	// which is started by Start and started again whenever it exits.
+	// A worker has the static permissions of the run, and deno never prompts,
+	// so a permission that cannot be decided statically is denied.
+	// RunFile always starts deno.
+	WorkerMode bool
+	// MemoryLimitBytes limits the V8 heap of each run with --max-old-space-size, if it is positive.
+	// A run that exceeds it fails with ErrOutOfMemory.
+	MemoryLimitBytes int64
+	// MemoryCgroup is a cgroup v2 directory with the memory controller enabled in its cgroup.subtree_control,
+	// and the pids controller if ResourceLimits.Processes is set.
+	// If it is not empty, each deno process is started in a child cgroup of it,
+	// whose memory.max is MemoryLimitBytes plus 128MiB for the memory outside the V8 heap,
+	// and whose pids.max is ResourceLimits.Processes.
+	// It is not used in WorkerMode, where the workers share a process.
+	// There is no address space limit instead, as V8 reserves far more address space than it uses.
+	MemoryCgroup string
+	// ResourceLimits are the rlimits of each deno process, set as soon as deno has started,
+	// and the limit of processes, which is set in the cgroup of MemoryCgroup.
+	// A run that is killed for exceeding one of them fails with ErrorResourceLimitExceeded.
+	// The CPU time of a process of the pool includes the startup of deno.
+	// They are only available on Linux, and they are not used in WorkerMode, where the workers share a process.
+	ResourceLimits ResourceLimits
+	// KillGracePeriod is how long deno has to exit after the run is canceled.
+	// The process group of deno is sent SIGTERM, and SIGKILL after KillGracePeriod.
+	// It also bounds the wait for the output of the descendants of deno that have left the process group.
+	// The package-level KillGracePeriod is used if it is zero.
+	KillGracePeriod time.Duration
+	// ScriptCache keeps the target scripts of RunGoValue, and is the DENO_DIR of deno, if it is not nil.
+	// The same script is then compiled once, unless the run takes a process of the pool,
+	// which reads the script from a path of its own.
+	// It can be shared by Runners.
+	ScriptCache *ScriptCache
+
+	pool       *pool
+	supervisor *supervisor
 }
 
 func (r *Runner) RunFile(ctx context.Context, opts RunFileOptions) (*RunFileResult, error) {
-	runnerScriptFile, err := os.CreateTemp("", "authgear-deno-runner.*.ts")
-	if err != nil {
-		return nil, err
-	}
-	defer os.Remove(runnerScriptFile.Name())
-	runnerScript, err := filepath.Abs(runnerScriptFile.Name())
-	if err != nil {
-		return nil, err
-	}
-	_, err = io.Copy(runnerScriptFile, bytes.NewReader(runnerScriptBytes))
-	if err != nil {
-		return nil, err
-	}
-	err = runnerScriptFile.Close()
-	if err != nil {
-		return nil, err
-	}
-
 	targetScript, err := filepath.Abs(opts.TargetScript)
 	if err != nil {
 		return nil, err
@@ -112,78 +211,127 @@ func (r *Runner) RunFile(ctx context.Context, opts RunFileOptions) (*RunFileResu
 		return nil, err
 	}
 
-	cmd := exec.CommandContext( //nolint:gosec
-		ctx,
-		"deno",
-		"run",
-		"--quiet",
-		fmt.Sprintf("--allow-read=%v,%v", targetScript, input),
-		fmt.Sprintf("--allow-write=%v", output),
-		runnerScript,
-		targetScript,
-		input,
-		output,
-	)
-
-	// Tell deno not to output ASCII escape code.
-	cmd.Env = append(cmd.Environ(), "NO_COLOR=1")
-
-	stdout := ioutil.LimitWriter(&bytes.Buffer{}, StdStreamLimit)
-	stderr := ioutil.LimitWriter(&bytes.Buffer{}, StdStreamLimit)
+	permissioner := r.permissioner(opts.Permissioner)
+	static := StaticPermissionsOf(permissioner)
 
-	// Separate stdout and stderr.
-	cmd.Stdout = stdout
+	httpProxy := r.HTTPProxy
+	runProxy := r.usesRunProxy(opts.IPPolicies, opts.AllowPorts)
+	if runProxy {
+		var release func()
+		httpProxy, release, err = r.RunProxy(opts.IPPolicies, opts.AllowPorts)
+		if err != nil {
+			return nil, err
+		}
+		defer release()
+	}
 
-	// Allocate a pty, connect stdin and stderr to the pty, and start the command.
-	f, err := pty.Start(cmd)
-	if err != nil {
-		return nil, err
+	var p *process
+	if r.pool != nil && !runProxy {
+		p = r.pool.take(static)
 	}
-	defer f.Close()
-
-	// Read stderr
-	go func() {
-		scanner := bufio.NewScanner(io.TeeReader(f, stderr))
-		scanner.Split(ScanStderr)
-		for scanner.Scan() {
-			line := scanner.Text()
-			// Start of permission prompt
-			if strings.Contains(line, "Deno requests ") {
-				var granted bool
-				d, ok := LineToPermissionDescriptor(line)
-				if ok {
-					granted = r.askPermission(ctx, *d)
-				}
-				if granted {
-					fmt.Fprintf(f, "y\n")
-				} else {
-					fmt.Fprintf(f, "n\n")
-				}
-			}
+	if p != nil {
+		err = linkOrCopy(targetScript, p.job.TargetScript)
+		if err == nil {
+			err = linkOrCopy(input, p.job.Input)
 		}
-	}()
+		if err != nil {
+			p.kill()
+			<-p.done
+			p.close()
+			return nil, err
+		}
+	} else {
+		p, err = r.startProcess(static, &ControlJob{
+			TargetScript: targetScript,
+			Input:        input,
+			Output:       output,
+		}, httpProxy)
+		if err != nil {
+			return nil, err
+		}
+	}
+	defer p.close()
+
+	start := time.Now()
+	events, err := p.run(ctx, r, permissioner, opts)
+	usage := newResourceUsage(time.Since(start), p.cmd.ProcessState)
+	r.logPermissionEvents(ctx, opts.TargetScript, events)
+	r.logResourceUsage(ctx, opts.TargetScript, usage, err)
+	if err == nil && p.job.Output != output {
+		err = copyFile(p.job.Output, output)
+	}
 
-	err = cmd.Wait()
 	if err != nil {
 		return nil, &RunFileError{
-			Inner:  err,
-			Stdout: stdout,
-			Stderr: stderr,
+			Inner:            err,
+			Stdout:           p.stdout,
+			Stderr:           p.stderr,
+			Logs:             p.logs,
+			PermissionEvents: events,
+			ResourceUsage:    usage,
 		}
 	}
 
 	return &RunFileResult{
-		Stdout: stdout,
-		Stderr: stderr,
+		Stdout:           p.stdout,
+		Stderr:           p.stderr,
+		Logs:             p.logs,
+		PermissionEvents: events,
+		ResourceUsage:    usage,
 	}, nil
 }
 
+// Start starts the pool of Runner if PoolSize is positive, and the supervisor if WorkerMode is true.
+// It must be called before Runner is used concurrently,
+// and the fields of Runner must not be changed afterwards.
+func (r *Runner) Start() error {
+	if r.PoolSize > 0 && r.pool == nil {
+		pool, err := newPool(r, r.PoolSize, r.PoolMetrics)
+		if err != nil {
+			return err
+		}
+		r.pool = pool
+	}
+	if r.WorkerMode && r.supervisor == nil {
+		r.supervisor = newSupervisor(r)
+	}
+	return nil
+}
+
+// Close stops the processes that are waiting in the pool, and the supervisor after its runs in flight.
+// The runs in flight are not affected. The runs to come start deno themselves,
+// except that the runs of WorkerMode fail with ErrSupervisorClosed.
+func (r *Runner) Close() {
+	if r.pool != nil {
+		r.pool.close()
+	}
+	if r.supervisor != nil {
+		r.supervisor.close()
+	}
+}
+
+// Prewarm adds scripts to ScriptCache, and compiles every script in it with `deno cache`.
+// deno is started behind HTTPProxy like a run, as it downloads the remote modules that the scripts import.
+// It does nothing if ScriptCache is nil.
+func (r *Runner) Prewarm(ctx context.Context, scripts ...string) error {
+	if r.ScriptCache == nil {
+		return nil
+	}
+	return r.ScriptCache.prewarm(ctx, func(cmd *exec.Cmd) []string {
+		return r.environ(cmd, r.HTTPProxy)
+	}, scripts...)
+}
+
 func (r *Runner) RunGoValue(ctx context.Context, opts RunGoValueOptions) (*RunGoValueResult, error) {
-	targetScript, err := os.CreateTemp("", "authgear-deno-script.*.ts")
+	if r.supervisor != nil && !r.usesRunProxy(opts.IPPolicies, opts.AllowPorts) {
+		return r.supervisor.run(ctx, opts)
+	}
+
+	targetScript, release, err := r.writeTargetScript(opts.TargetScript)
 	if err != nil {
 		return nil, err
 	}
-	defer os.Remove(targetScript.Name())
+	defer release()
 
 	input, err := os.CreateTemp("", "authgear-deno-input.*.json")
 	if err != nil {
@@ -197,15 +345,6 @@ func (r *Runner) RunGoValue(ctx context.Context, opts RunGoValueOptions) (*RunGo
 	}
 	defer os.Remove(output.Name())
 
-	_, err = io.Copy(targetScript, strings.NewReader(opts.TargetScript))
-	if err != nil {
-		return nil, err
-	}
-	err = targetScript.Close()
-	if err != nil {
-		return nil, err
-	}
-
 	err = json.NewEncoder(input).Encode(opts.Input)
 	if err != nil {
 		return nil, err
@@ -216,9 +355,15 @@ func (r *Runner) RunGoValue(ctx context.Context, opts RunGoValueOptions) (*RunGo
 	}
 
 	runFileResult, err := r.RunFile(ctx, RunFileOptions{
-		TargetScript: targetScript.Name(),
-		Input:        input.Name(),
-		Output:       output.Name(),
+		TargetScript:      targetScript,
+		Input:             input.Name(),
+		Output:            output.Name(),
+		Permissioner:      opts.Permissioner,
+		Stdout:            opts.Stdout,
+		Stderr:            opts.Stderr,
+		OnPermissionEvent: opts.OnPermissionEvent,
+		IPPolicies:        opts.IPPolicies,
+		AllowPorts:        opts.AllowPorts,
 	})
 	if err != nil {
 		return nil, err
@@ -235,19 +380,135 @@ func (r *Runner) RunGoValue(ctx context.Context, opts RunGoValueOptions) (*RunGo
 	}
 
 	return &RunGoValueResult{
-		Output: out,
-		Stdout: runFileResult.Stdout,
-		Stderr: runFileResult.Stderr,
+		Output:           out,
+		Stdout:           runFileResult.Stdout,
+		Stderr:           runFileResult.Stderr,
+		Logs:             runFileResult.Logs,
+		PermissionEvents: runFileResult.PermissionEvents,
+		ResourceUsage:    runFileResult.ResourceUsage,
 	}, nil
 }
 
-func (r *Runner) askPermission(ctx context.Context, d PermissionDescriptor) bool {
+// writeTargetScript writes script to a file, which is removed or released by release.
+func (r *Runner) writeTargetScript(script string) (filename string, release func(), err error) {
+	if r.ScriptCache != nil {
+		return r.ScriptCache.Acquire(script)
+	}
+
+	f, err := os.CreateTemp("", "authgear-deno-script.*.ts")
+	if err != nil {
+		return "", nil, err
+	}
+	release = func() {
+		os.Remove(f.Name())
+	}
+
+	_, err = io.Copy(f, strings.NewReader(script))
+	if err != nil {
+		f.Close()
+		release()
+		return "", nil, err
+	}
+	err = f.Close()
+	if err != nil {
+		release()
+		return "", nil, err
+	}
+	return f.Name(), release, nil
+}
+
+// EvaluatePermissions decides the permissions as if the target script requested them, without starting deno.
+func (r *Runner) EvaluatePermissions(ctx context.Context, opts EvaluatePermissionsOptions) ([]PermissionEvent, error) {
+	broker, err := NewPermissionBroker(r.permissioner(opts.Permissioner), nil)
+	if err != nil {
+		return nil, err
+	}
+	for _, d := range opts.Descriptors {
+		broker.Decide(ctx, d)
+	}
+	return broker.Events(), nil
+}
+
+func (r *Runner) killGracePeriod() time.Duration {
+	if r.KillGracePeriod <= 0 {
+		return KillGracePeriod
+	}
+	return r.KillGracePeriod
+}
+
+func (r *Runner) stdStreamLimit() int64 {
+	if r.StdStreamLimit <= 0 {
+		return StdStreamLimit
+	}
+	return r.StdStreamLimit
+}
+
+// environ returns the environment of deno.
+// usesRunProxy tells if a run with ipPolicies and allowPorts is started behind a proxy of its own.
+func (r *Runner) usesRunProxy(ipPolicies []IPPolicy, allowPorts []PortRange) bool {
+	return r.RunProxy != nil && (len(ipPolicies) > 0 || allowPorts != nil)
+}
+
+// environ is the environment of deno started behind httpProxy.
+func (r *Runner) environ(cmd *exec.Cmd, httpProxy string) []string {
+	// Tell deno not to output ASCII escape code.
+	env := append(cmd.Environ(), "NO_COLOR=1")
+	if r.ScriptCache != nil {
+		env = append(env, "DENO_DIR="+r.ScriptCache.DenoDir())
+	}
+	if httpProxy != "" {
+		// Make sure every request goes through the proxy.
+		for _, name := range []string{"HTTP_PROXY", "HTTPS_PROXY", "http_proxy", "https_proxy"} {
+			env = append(env, name+"="+httpProxy)
+		}
+		env = append(env, "NO_PROXY=", "no_proxy=")
+	}
+	return env
+}
+
+// writeScripts writes the embedded scripts into dir, so that they can import each other.
+func writeScripts(dir string, scripts map[string][]byte) error {
+	for name, b := range scripts {
+		err := os.WriteFile(filepath.Join(dir, name), b, 0o600)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *Runner) permissioner(permissioner Permissioner) Permissioner {
 	if r.Permissioner == nil {
-		return false
+		return nil
+	}
+	if permissioner == nil {
+		return r.Permissioner
+	}
+	return AllOf(r.Permissioner, permissioner)
+}
+
+func (r *Runner) logPermissionEvents(ctx context.Context, script string, events []PermissionEvent) {
+	if r.Logger == nil {
+		return
+	}
+	for _, event := range events {
+		level := slog.LevelInfo
+		if !event.Granted {
+			level = slog.LevelWarn
+		}
+		attrs := append([]slog.Attr{slog.String("script", script)}, event.LogAttrs()...)
+		r.Logger.LogAttrs(ctx, level, "permission", attrs...)
+	}
+}
+
+// logResourceUsage logs the resource usage of a run, whether it has succeeded or not.
+func (r *Runner) logResourceUsage(ctx context.Context, script string, usage ResourceUsage, err error) {
+	if r.Logger == nil {
+		return
 	}
-	ok, err := r.Permissioner.RequestPermission(ctx, d)
+	attrs := append([]slog.Attr{slog.String("script", script)}, usage.LogAttrs()...)
 	if err != nil {
-		return false
+		attrs = append(attrs, slog.Any("error", err))
 	}
-	return ok
+	r.Logger.LogAttrs(ctx, slog.LevelInfo, "run", attrs...)
 }
@@ -1,15 +1,182 @@
-const filename = Deno.args[0];
-const input = JSON.parse(await Deno.readTextFile(Deno.args[1]));
-const m = await import(filename);
-if (typeof m.default !== "function") {
-  console.error(
-    "The hook must export a default function. Check that you have `export default async function(...) { ... }` in your script.",
-  );
+import {
+  format,
+  installConsoleWrappers,
+  installPermissionWrappers,
+  serializeError,
+} from "./wrappers.ts";
+
+// The control channel must be set up before the target script is imported.
+// See broker.go for the protocol.
+const controlTokenEnv = "AUTHGEAR_DENO_CONTROL_TOKEN";
+const controlChannelOut = "/dev/fd/3";
+const controlChannelIn = "/dev/fd/4";
+
+const token = Deno.env.get(controlTokenEnv) ?? "";
+Deno.env.delete(controlTokenEnv);
+const controlOut = Deno.openSync(controlChannelOut, { write: true });
+const controlIn = Deno.openSync(controlChannelIn, { read: true });
+Deno.permissions.revokeSync({ name: "env", variable: controlTokenEnv });
+Deno.permissions.revokeSync({ name: "write", path: controlChannelOut });
+Deno.permissions.revokeSync({ name: "read", path: controlChannelIn });
+
+const encoder = new TextEncoder();
+const replyDecoder = new TextDecoder();
+let replyBuffer = "";
+let nextID = 1;
+
+function send(message: Record<string, unknown>) {
+  const bytes = encoder.encode(JSON.stringify({ token, ...message }) + "\n");
+  let written = 0;
+  while (written < bytes.length) {
+    written += controlOut.writeSync(bytes.subarray(written));
+  }
+}
+
+function receive<T>(): T {
+  const chunk = new Uint8Array(4096);
+  for (;;) {
+    const i = replyBuffer.indexOf("\n");
+    if (i >= 0) {
+      const line = replyBuffer.slice(0, i);
+      replyBuffer = replyBuffer.slice(i + 1);
+      return JSON.parse(line);
+    }
+    const n = controlIn.readSync(chunk);
+    if (n === null) {
+      throw new Error("control channel is closed");
+    }
+    replyBuffer += replyDecoder.decode(chunk.subarray(0, n), { stream: true });
+  }
+}
+
+// Everything the target script writes to stderr goes through the control channel,
+// so that the pty only carries the permission prompts of deno.
+function writeStderr(data: string) {
+  send({ type: "stderr", data });
+}
+
+console.error = (...args: unknown[]) => writeStderr(format(args) + "\n");
+console.warn = (...args: unknown[]) => writeStderr(format(args) + "\n");
+// Both the instance and its prototype are replaced, and the other ways to write to the pty,
+// so that the target script cannot write what looks like a prompt to the pty.
+// A forged prompt would still be denied, see broker.go.
+const stderrPrototype = Object.getPrototypeOf(Deno.stderr);
+for (const stderr of [Deno.stderr, stderrPrototype]) {
+  stderr.write = (p: Uint8Array) => {
+    writeStderr(new TextDecoder().decode(p));
+    return Promise.resolve(p.length);
+  };
+  stderr.writeSync = (p: Uint8Array) => {
+    writeStderr(new TextDecoder().decode(p));
+    return p.length;
+  };
+}
+Object.defineProperty(stderrPrototype, "writable", {
+  get: () =>
+    new WritableStream<Uint8Array>({
+      write(p) {
+        writeStderr(new TextDecoder().decode(p));
+      },
+    }),
+});
+// Deno.write and Deno.writeSync are only in deno 1. 2 is the resource ID of stderr.
+// deno-lint-ignore no-explicit-any
+const deno1 = Deno as any;
+for (const method of ["write", "writeSync"] as const) {
+  const original = deno1[method];
+  if (typeof original === "function") {
+    deno1[method] = (rid: number, p: Uint8Array) =>
+      rid === 2 ? Deno.stderr[method](p) : original(rid, p);
+  }
+}
+
+// The console calls are also sent as log records, which keep the order of stdout and stderr.
+installConsoleWrappers((log) => send({ type: "log", log }));
+
+// Ask for the permission on the control channel before deno prompts for it.
+// The prompt is answered with "y" only if the control channel has granted it.
+const permissions = Deno.permissions;
+const querySync = permissions.querySync.bind(permissions);
+const requestSync = permissions.requestSync.bind(permissions);
+
+function requestPermission(
+  descriptor: Deno.PermissionDescriptor,
+): Deno.PermissionStatus {
+  const status = querySync(descriptor);
+  if (status.state !== "prompt") {
+    return status;
+  }
+  const id = nextID++;
+  send({ type: "permission", id, descriptor });
+  const reply = receive<{ id: number; granted: boolean }>();
+  if (reply.id !== id) {
+    throw new Error("control channel is out of sync");
+  }
+  return requestSync(descriptor);
+}
+
+installPermissionWrappers(requestPermission);
+
+// deno prompts for the import of remote modules by itself while it loads the modules of the target script.
+// The prompts are decided as they appear only until gate.ts is evaluated, before any code of the target script runs,
+// so the target script cannot forge them.
+function setImporting(importing: boolean) {
+  const id = nextID++;
+  send({ type: "import", id, importing });
+  const reply = receive<{ id: number }>();
+  if (reply.id !== id) {
+    throw new Error("control channel is out of sync");
+  }
+}
+// deno-lint-ignore no-explicit-any
+(globalThis as any)[Symbol.for("authgear-deno.gate")] = () =>
+  setImporting(false);
+
+// The job is the first message on the control channel, see ControlJob in pool.go.
+// deno may have been started before the job is known.
+type Job = { target_script: string; input: string; output: string };
+const job = receive<Job>();
+const input = JSON.parse(await Deno.readTextFile(job.input));
+// The error thrown by the target script is written to the output, see scripterror.go.
+// The URL of the target script is replaced by FILE, like the stderr of Checker.
+const replacements = {
+  [new URL(job.target_script, "file:///").href]: "FILE",
+  [new URL(".", import.meta.url).href]: "",
+};
+function fail(err: unknown): never {
+  const error = serializeError(err, replacements);
+  Deno.writeTextFileSync(job.output, JSON.stringify({ error }) + "\n");
+  console.error("error: Uncaught (in promise)", err);
   Deno.exit(1);
 }
-const output = await Promise.resolve(m.default(input));
-let content = JSON.stringify(output);
-if (content === undefined) {
-  content = "null";
+// The errors thrown later, like in a timer, are reported the same way,
+// so that what deno itself writes to stderr never includes what the target script has thrown.
+globalThis.addEventListener("error", (e) => {
+  e.preventDefault();
+  fail(e.error);
+});
+globalThis.addEventListener("unhandledrejection", (e) => {
+  e.preventDefault();
+  fail(e.reason);
+});
+try {
+  // entry.ts imports gate.ts before the target script, see startProcess in pool.go.
+  setImporting(true);
+  const { target: m } = await import(
+    new URL("./entry.ts", import.meta.url).href
+  );
+  if (typeof m.default !== "function") {
+    console.error(
+      "The hook must export a default function. Check that you have `export default async function(...) { ... }` in your script.",
+    );
+    Deno.exit(1);
+  }
+  const output = await Promise.resolve(m.default(input));
+  let content = JSON.stringify(output);
+  if (content === undefined) {
+    content = "null";
+  }
+  await Deno.writeTextFile(job.output, content + "\n");
+} catch (err) {
+  fail(err);
 }
-await Deno.writeTextFile(Deno.args[2], content + "\n");
@@ -1,13 +1,20 @@
 package deno_test
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
 	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/authgear/authgear-deno/pkg/deno"
 
@@ -42,7 +49,7 @@ func TestRunner(t *testing.T) {
 			So(errors.As(err, &runError), ShouldBeTrue)
 			So(errors.As(err, &exitError), ShouldBeTrue)
 			So(exitError.ExitCode(), ShouldEqual, 1)
-			So(runError.Stderr.W.String(), ShouldEqual, "The hook must export a default function. Check that you have `export default async function(...) { ... }` in your script.\r\n")
+			So(runError.Stderr.W.String(), ShouldEqual, "The hook must export a default function. Check that you have `export default async function(...) { ... }` in your script.\n")
 		})
 
 		Convey("RunFile", func() {
@@ -65,6 +72,9 @@ func TestRunner(t *testing.T) {
 					expectedStdout, err := os.ReadFile(changeExtension(p, ".stdout"))
 					So(err, ShouldBeNil)
 					So(string(actualStdout), ShouldEqual, string(expectedStdout))
+
+					So(result.ResourceUsage.WallTime, ShouldBeGreaterThan, 0)
+					So(result.ResourceUsage.UserTime+result.ResourceUsage.SystemTime, ShouldBeGreaterThan, 0)
 				})
 			}
 
@@ -124,5 +134,381 @@ func TestRunner(t *testing.T) {
 				})
 			}
 		})
+
+		Convey("observe the run as it happens", func() {
+			var stdout bytes.Buffer
+			var events []deno.PermissionEvent
+			result, err := runner.RunGoValue(ctx, deno.RunGoValueOptions{
+				TargetScript: "export default async function () { console.log('hello'); Deno.env.get('TZ'); }",
+				Stdout:       &stdout,
+				OnPermissionEvent: func(e deno.PermissionEvent) {
+					events = append(events, e)
+				},
+			})
+			So(err, ShouldBeNil)
+			So(stdout.String(), ShouldEqual, "hello\n")
+			So(events, ShouldResemble, result.PermissionEvents)
+		})
+
+		Convey("capture the console calls in order", func() {
+			result, err := runner.RunGoValue(ctx, deno.RunGoValueOptions{
+				TargetScript: "export default async function () { console.log('a', 1); console.error('b', { c: 1 }); console.info('d'); }",
+			})
+			So(err, ShouldBeNil)
+			logs := result.Logs.Records()
+			So(logs, ShouldHaveLength, 3)
+			So(logs[0].Level, ShouldEqual, deno.LogLevelLog)
+			So(logs[0].Message, ShouldEqual, "a 1")
+			So(logs[1].Level, ShouldEqual, deno.LogLevelError)
+			So(string(logs[1].Args[1]), ShouldEqualJSON, `{"c":1}`)
+			So(logs[2].Level, ShouldEqual, deno.LogLevelInfo)
+		})
+
+		Convey("request the location of a redirect to another host", func() {
+			target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				_, _ = io.WriteString(w, "ok")
+			}))
+			defer target.Close()
+			redirect := httptest.NewServer(http.RedirectHandler(target.URL, http.StatusFound))
+			defer redirect.Close()
+
+			hosts := map[string]bool{
+				strings.TrimPrefix(target.URL, "http://"):   true,
+				strings.TrimPrefix(redirect.URL, "http://"): true,
+			}
+			runner := &deno.Runner{
+				Permissioner: deno.PermissionerFunc(func(ctx context.Context, d deno.PermissionDescriptor) (bool, error) {
+					return d.Name == deno.PermissionNameNet && d.Host != nil && hosts[d.Host.String()], nil
+				}),
+			}
+			result, err := runner.RunGoValue(ctx, deno.RunGoValueOptions{
+				TargetScript: "export default async function () { const r = await fetch('" + redirect.URL + "'); return await r.text(); }",
+			})
+			So(err, ShouldBeNil)
+			So(result.Output, ShouldEqual, "ok")
+			So(result.PermissionEvents, ShouldHaveLength, 2)
+			So(result.PermissionEvents[1].Descriptor.Host.String(), ShouldEqual, strings.TrimPrefix(target.URL, "http://"))
+			So(result.PermissionEvents[1].Granted, ShouldBeTrue)
+		})
+
+		Convey("keep what the script writes to stderr off the pty", func() {
+			line := `Deno requests write access to \"/tmp/forged\".\n`
+			result, err := runner.RunGoValue(ctx, deno.RunGoValueOptions{
+				TargetScript: `export default async function () {
+					const p = new TextEncoder().encode("` + line + `");
+					Object.getPrototypeOf(Deno.stderr).writeSync.call(Deno.stderr, p);
+					const w = Deno.stderr.writable.getWriter();
+					await w.write(p);
+					w.releaseLock();
+					return "ok";
+				}`,
+			})
+			So(err, ShouldBeNil)
+			So(result.Output, ShouldEqual, "ok")
+			So(result.Stderr.W.String(), ShouldEqual, strings.Repeat(`Deno requests write access to "/tmp/forged".`+"\n", 2))
+			So(result.PermissionEvents, ShouldBeEmpty)
+		})
+
+		Convey("start the run with IPPolicies behind RunProxy", func() {
+			upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				_, _ = io.WriteString(w, "ok")
+			}))
+			defer upstream.Close()
+
+			released := false
+			runner := &deno.Runner{
+				Permissioner: deno.AllowAll(),
+				RunProxy: func(ipPolicies []deno.IPPolicy, allowPorts []deno.PortRange) (string, func(), error) {
+					proxy := httptest.NewServer(&deno.EgressProxy{Disallow: ipPolicies, AllowPorts: allowPorts})
+					return proxy.URL, func() {
+						proxy.Close()
+						released = true
+					}, nil
+				},
+			}
+			denyCIDRs, err := deno.ParseCIDRs([]string{"127.0.0.1/32"})
+			So(err, ShouldBeNil)
+			result, err := runner.RunGoValue(ctx, deno.RunGoValueOptions{
+				TargetScript: "export default async function () { const r = await fetch('" + upstream.URL + "'); return r.status; }",
+				IPPolicies:   []deno.IPPolicy{deno.DisallowCIDRs(denyCIDRs...)},
+			})
+			So(err, ShouldBeNil)
+			So(result.Output, ShouldEqual, float64(http.StatusForbidden))
+			So(released, ShouldBeTrue)
+		})
+
+		Convey("report the error thrown by the script", func() {
+			_, err := runner.RunGoValue(ctx, deno.RunGoValueOptions{
+				TargetScript: "export default async function () { throw new TypeError('a', { cause: new Error('b') }); }",
+			})
+			var scriptError *deno.ErrorScript
+			var exitError *exec.ExitError
+			So(errors.As(err, &scriptError), ShouldBeTrue)
+			So(errors.As(err, &exitError), ShouldBeTrue)
+			So(scriptError.Error(), ShouldEqual, "TypeError: a")
+			So(scriptError.Stack, ShouldContainSubstring, "FILE")
+			So(scriptError.Stack, ShouldNotContainSubstring, os.TempDir())
+			So(scriptError.Cause.Error(), ShouldEqual, "Error: b")
+		})
+
+		Convey("MemoryLimitBytes", func() {
+			runner := &deno.Runner{
+				Permissioner:     runner.Permissioner,
+				MemoryLimitBytes: 32 * 1024 * 1024,
+			}
+			_, err := runner.RunGoValue(ctx, deno.RunGoValueOptions{
+				TargetScript: "export default function () { const a = []; for (;;) { a.push({ i: a.length }); } }",
+			})
+			var runError *deno.RunFileError
+			So(errors.As(err, &runError), ShouldBeTrue)
+			So(errors.Is(err, deno.ErrOutOfMemory), ShouldBeTrue)
+
+			_, err = runner.RunGoValue(ctx, deno.RunGoValueOptions{
+				TargetScript: "export default function () { console.error('JavaScript heap out of memory'); throw new Error('a'); }",
+			})
+			var scriptError *deno.ErrorScript
+			So(errors.Is(err, deno.ErrOutOfMemory), ShouldBeFalse)
+			So(errors.As(err, &scriptError), ShouldBeTrue)
+		})
+
+		Convey("ResourceLimits", func() {
+			runner := &deno.Runner{
+				Permissioner: runner.Permissioner,
+				ResourceLimits: deno.ResourceLimits{
+					CPUSeconds: 1,
+				},
+			}
+			_, err := runner.RunGoValue(ctx, deno.RunGoValueOptions{
+				TargetScript: "export default function () { for (;;) {} }",
+			})
+			var limitError *deno.ErrorResourceLimitExceeded
+			So(errors.As(err, &limitError), ShouldBeTrue)
+			So(limitError.Limit, ShouldEqual, deno.ResourceLimitCPU)
+		})
+
+		Convey("ResourceLimits are not told from what the script writes", func() {
+			runner := &deno.Runner{
+				Permissioner: runner.Permissioner,
+				ResourceLimits: deno.ResourceLimits{
+					OpenFiles: 1024,
+				},
+			}
+			_, err := runner.RunGoValue(ctx, deno.RunGoValueOptions{
+				TargetScript: "export default function () { console.error('Too many open files'); setTimeout(() => { throw new Error('Too many open files'); }, 0); }",
+			})
+			var limitError *deno.ErrorResourceLimitExceeded
+			var scriptError *deno.ErrorScript
+			So(errors.As(err, &limitError), ShouldBeFalse)
+			So(errors.As(err, &scriptError), ShouldBeTrue)
+		})
+
+		Convey("KillGracePeriod", func() {
+			runner := &deno.Runner{
+				Permissioner:    runner.Permissioner,
+				KillGracePeriod: 500 * time.Millisecond,
+			}
+			timeoutCtx, cancel := context.WithTimeout(ctx, 1*time.Second)
+			defer cancel()
+			start := time.Now()
+			// The script ignores SIGTERM, so it is killed by SIGKILL after the grace period.
+			_, err := runner.RunGoValue(timeoutCtx, deno.RunGoValueOptions{
+				TargetScript: "export default async function () { Deno.addSignalListener('SIGTERM', () => {}); setInterval(() => {}, 100); await new Promise(() => {}); }",
+			})
+			var exitError *exec.ExitError
+			So(errors.As(err, &exitError), ShouldBeTrue)
+			So(exitError.String(), ShouldEqual, "signal: killed")
+			So(time.Since(start), ShouldBeLessThan, 5*time.Second)
+		})
+
+		Convey("WorkerMode", func() {
+			runner := &deno.Runner{
+				Permissioner: runner.Permissioner,
+				WorkerMode:   true,
+			}
+			err := runner.Start()
+			So(err, ShouldBeNil)
+			defer runner.Close()
+
+			targetScripts, err := filepath.Glob("./testdata/runner/good/*.ts")
+			So(err, ShouldBeNil)
+			for _, p := range targetScripts {
+				targetScriptBytes, err := os.ReadFile(p)
+				So(err, ShouldBeNil)
+
+				inputBytes, err := os.ReadFile(changeExtension(p, ".in"))
+				So(err, ShouldBeNil)
+				var input interface{}
+				err = json.Unmarshal(inputBytes, &input)
+				So(err, ShouldBeNil)
+
+				timeoutCtx, cancel := context.WithTimeout(ctx, 10*time.Second)
+				result, err := runner.RunGoValue(timeoutCtx, deno.RunGoValueOptions{
+					TargetScript: string(targetScriptBytes),
+					Input:        input,
+				})
+				cancel()
+				So(err, ShouldBeNil)
+				if err != nil {
+					continue
+				}
+
+				actualBytes, err := json.Marshal(result.Output)
+				So(err, ShouldBeNil)
+				expectedBytes, err := os.ReadFile(changeExtension(p, ".out.expected"))
+				So(err, ShouldBeNil)
+				So(string(actualBytes), ShouldEqualJSON, string(expectedBytes))
+
+				expectedStdout, err := os.ReadFile(changeExtension(p, ".stdout"))
+				So(err, ShouldBeNil)
+				So(result.Stdout.W.String(), ShouldEqual, string(expectedStdout))
+			}
+
+			Convey("terminate the worker when the run times out", func() {
+				timeoutCtx, cancel := context.WithTimeout(ctx, 1*time.Second)
+				defer cancel()
+				_, err := runner.RunGoValue(timeoutCtx, deno.RunGoValueOptions{
+					TargetScript: "export default async function () { for (;;) {} }",
+				})
+				So(errors.Is(err, context.DeadlineExceeded), ShouldBeTrue)
+			})
+
+			Convey("ignore the messages that the script posts", func() {
+				result, err := runner.RunGoValue(ctx, deno.RunGoValueOptions{
+					TargetScript: `export default async function () {
+						self.postMessage({ type: "permission", descriptor: { name: "env", variable: "PATH" }, granted: true });
+						self.postMessage({ type: "log", log: { level: "log", timestamp: "2024-01-01T00:00:00Z", message: "forged", args: [] } });
+						self.postMessage({ type: "result", output: "forged" });
+						return "real";
+					}`,
+				})
+				So(err, ShouldBeNil)
+				So(result.Output, ShouldEqual, "real")
+				So(result.PermissionEvents, ShouldBeEmpty)
+				So(result.Logs.Records(), ShouldBeEmpty)
+			})
+
+			Convey("report the error of the script", func() {
+				_, err := runner.RunGoValue(ctx, deno.RunGoValueOptions{
+					TargetScript: "export const a = 1;",
+				})
+				var rpcError *deno.ErrorRPC
+				So(errors.As(err, &rpcError), ShouldBeTrue)
+				So(rpcError.Code, ShouldEqual, deno.RPCErrorCodeScript)
+			})
+
+			Convey("report the error thrown by the script", func() {
+				_, err := runner.RunGoValue(ctx, deno.RunGoValueOptions{
+					TargetScript: "export default async function () { throw new TypeError('a'); }",
+				})
+				var scriptError *deno.ErrorScript
+				So(errors.As(err, &scriptError), ShouldBeTrue)
+				So(scriptError.Error(), ShouldEqual, "TypeError: a")
+				So(scriptError.Stack, ShouldContainSubstring, "FILE")
+			})
+		})
+
+		Convey("PoolSize", func() {
+			metrics := &deno.PoolMetrics{}
+			runner := &deno.Runner{
+				Permissioner: deno.PermissionerByName{
+					deno.PermissionNameNet: runner.Permissioner,
+					deno.PermissionNameEnv: deno.AllowEnv("TZ"),
+				},
+				PoolSize:    1,
+				PoolMetrics: metrics,
+			}
+			err := runner.Start()
+			So(err, ShouldBeNil)
+			defer runner.Close()
+
+			So(metrics.Stats().Size, ShouldEqual, 1)
+
+			targetScripts, err := filepath.Glob("./testdata/runner/good/*.ts")
+			So(err, ShouldBeNil)
+			deadline := time.Now().Add(5 * time.Second)
+			for _, p := range targetScripts {
+				// Wait for the replacement of the previous process.
+				for metrics.Stats().Idle <= 0 && time.Now().Before(deadline) {
+					time.Sleep(10 * time.Millisecond)
+				}
+				So(metrics.Stats().Idle, ShouldEqual, 1)
+				opts := deno.RunFileOptions{
+					TargetScript: p,
+					Input:        changeExtension(p, ".in"),
+					Output:       changeExtension(p, ".out"),
+				}
+				_, err := runner.RunFile(ctx, opts)
+				So(err, ShouldBeNil)
+				So(opts.Output, shouldEqualContent, opts.Output+".expected")
+			}
+			So(metrics.Stats().Hits, ShouldEqual, len(targetScripts))
+
+			Convey("a run that narrows the static permissions starts deno itself", func() {
+				p := targetScripts[0]
+				_, err := runner.RunFile(ctx, deno.RunFileOptions{
+					TargetScript: p,
+					Input:        changeExtension(p, ".in"),
+					Output:       changeExtension(p, ".out"),
+					Permissioner: deno.AllowEnv("LANG"),
+				})
+				So(err, ShouldBeNil)
+				So(metrics.Stats().Misses, ShouldEqual, 1)
+			})
+		})
+	})
+}
+
+func TestRunnerEvaluatePermissions(t *testing.T) {
+	Convey("Runner.EvaluatePermissions", t, func() {
+		ctx := context.Background()
+
+		netResolver, _, closeDNS := startDNSServer(func(name string) []net.IP {
+			if name == "private.test" {
+				return []net.IP{net.ParseIP("10.0.0.1")}
+			}
+			return nil
+		}, 60)
+		defer closeDNS()
+
+		runner := &deno.Runner{
+			Permissioner: deno.PermissionerByName{
+				deno.PermissionNameNet: deno.DisallowIPPolicy(deno.DisallowPrivate).WithResolver(deno.NetResolver{Resolver: netResolver}),
+				deno.PermissionNameEnv: deno.AllowEnv("TZ"),
+			},
+		}
+
+		var descriptors []deno.PermissionDescriptor
+		err := json.Unmarshal([]byte(`[
+			{"name":"net","host":"private.test:443"},
+			{"name":"net","host":"1.1.1.1:443"},
+			{"name":"env","variable":"TZ"},
+			{"name":"read","path":"/"}
+		]`), &descriptors)
+		So(err, ShouldBeNil)
+
+		events, err := runner.EvaluatePermissions(ctx, deno.EvaluatePermissionsOptions{
+			Descriptors: descriptors,
+		})
+		So(err, ShouldBeNil)
+		So(events, ShouldHaveLength, 4)
+		So(events[0].Granted, ShouldBeFalse)
+		So(events[0].Reason, ShouldEqual, "private: 10.0.0.1")
+		So(events[0].ResolvedIPs, ShouldHaveLength, 1)
+		So(events[0].ResolvedIPs[0].String(), ShouldEqual, "10.0.0.1")
+		So(events[1].Granted, ShouldBeTrue)
+		So(events[2].Granted, ShouldBeTrue)
+		So(events[3].Granted, ShouldBeFalse)
+		So(events[3].Reason, ShouldEqual, "no permissioner for `read`")
+
+		Convey("with the permissioner of the run", func() {
+			events, err := runner.EvaluatePermissions(ctx, deno.EvaluatePermissionsOptions{
+				Descriptors:  descriptors[2:3],
+				Permissioner: deno.AllowEnv("LANG"),
+			})
+			So(err, ShouldBeNil)
+			So(events, ShouldHaveLength, 1)
+			So(events[0].Granted, ShouldBeFalse)
+			So(events[0].Reason, ShouldEqual, "env not allowed: TZ")
+		})
 	})
 }
@@ -0,0 +1,16 @@
+package deno
+
+import (
+	"os"
+	"syscall"
+)
+
+// maxRSSBytes returns the peak resident set size of a process that has exited.
+func maxRSSBytes(state *os.ProcessState) int64 {
+	rusage, ok := state.SysUsage().(*syscall.Rusage)
+	if !ok {
+		return 0
+	}
+	// ru_maxrss is in KiB on Linux.
+	return rusage.Maxrss * 1024
+}
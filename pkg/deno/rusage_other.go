@@ -0,0 +1,11 @@
+//go:build !linux
+
+package deno
+
+import (
+	"os"
+)
+
+func maxRSSBytes(state *os.ProcessState) int64 {
+	return 0
+}
@@ -2,8 +2,14 @@ package deno
 
 import (
 	"bytes"
+	"regexp"
 )
 
+// promptRegexp matches the end of the permission prompt,
+// which is either "(y = yes, allow; n = no, deny) > "
+// or "(y = yes, allow; n = no, deny; A = allow all net permissions) > ".
+var promptRegexp = regexp.MustCompile(`\(y = yes, allow; n = no, deny(?:; A = allow all [^)]*)?\) > `)
+
 // dropCR is from bufio.
 func dropCR(data []byte) []byte {
 	if len(data) > 0 && data[len(data)-1] == '\r' {
@@ -15,8 +21,6 @@ func dropCR(data []byte) []byte {
 // ScanStderr is the extended version of ScanLines.
 // It additionally treats the deno permission prompt as a line.
 func ScanStderr(data []byte, atEOF bool) (advance int, token []byte, err error) {
-	prompt := []byte("(y = yes, allow; n = no, deny) > ")
-
 	if atEOF && len(data) == 0 {
 		return 0, nil, nil
 	}
@@ -25,8 +29,8 @@ func ScanStderr(data []byte, atEOF bool) (advance int, token []byte, err error)
 		return i + 1, dropCR(data[0:i]), nil
 	}
 
-	if i := bytes.Index(data, prompt); i >= 0 {
-		return i + len(prompt), dropCR(data[0 : i+len(prompt)]), nil
+	if loc := promptRegexp.FindIndex(data); loc != nil {
+		return loc[1], dropCR(data[0:loc[1]]), nil
 	}
 
 	if atEOF {
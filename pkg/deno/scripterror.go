@@ -0,0 +1,50 @@
+package deno
+
+import (
+	"encoding/json"
+	"os"
+)
+
+// ErrorScript is the error thrown by the target script, when it is imported or when its default export is called.
+// The URL of the target script in Message and Stack is replaced by FILE, like the stderr of Checker.
+type ErrorScript struct {
+	Name    string       `json:"name,omitempty"`
+	Message string       `json:"message"`
+	Stack   string       `json:"stack,omitempty"`
+	Cause   *ErrorScript `json:"cause,omitempty"`
+}
+
+func (e *ErrorScript) Error() string {
+	if e.Name == "" {
+		return e.Message
+	}
+	return e.Name + ": " + e.Message
+}
+
+func (e *ErrorScript) Unwrap() error {
+	// Return an untyped nil instead of a nil *ErrorScript.
+	if e.Cause == nil {
+		return nil
+	}
+	return e.Cause
+}
+
+// scriptErrorOutput is what runner.ts writes to the output when the target script throws.
+type scriptErrorOutput struct {
+	Error *ErrorScript `json:"error"`
+}
+
+// readScriptError reads the error of the target script from the output of a failed run.
+// It returns nil if deno has exited for another reason.
+func readScriptError(output string) *ErrorScript {
+	b, err := os.ReadFile(output)
+	if err != nil {
+		return nil
+	}
+	var o scriptErrorOutput
+	err = json.Unmarshal(b, &o)
+	if err != nil {
+		return nil
+	}
+	return o.Error
+}
@@ -0,0 +1,7 @@
+//go:build !unix
+
+package deno
+
+func isAborted(waitErr error) bool {
+	return false
+}
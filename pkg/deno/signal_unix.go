@@ -0,0 +1,27 @@
+//go:build unix
+
+package deno
+
+import (
+	"errors"
+	"os/exec"
+	"syscall"
+)
+
+// isAborted reports whether the process has been terminated by the signal of an abort,
+// which is how V8 terminates deno when it runs out of memory.
+func isAborted(waitErr error) bool {
+	var exitError *exec.ExitError
+	if !errors.As(waitErr, &exitError) {
+		return false
+	}
+	status, ok := exitError.Sys().(syscall.WaitStatus)
+	if !ok || !status.Signaled() {
+		return false
+	}
+	switch status.Signal() {
+	case syscall.SIGABRT, syscall.SIGTRAP, syscall.SIGILL:
+		return true
+	}
+	return false
+}
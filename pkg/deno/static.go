@@ -0,0 +1,204 @@
+package deno
+
+import (
+	"context"
+	"errors"
+	"strings"
+)
+
+// ErrNotStatic means the permission can only be decided when it is requested.
+var ErrNotStatic = errors.New("permission cannot be decided statically")
+
+// StaticPermissioner is a Permissioner that can decide some permissions before deno starts.
+// The permissions that are granted statically are passed to deno as --allow-* flags,
+// so deno never prompts for them.
+type StaticPermissioner interface {
+	Permissioner
+	// StaticPermissions returns the permissions that may be granted statically, like the allowed hosts.
+	StaticPermissions() []PermissionDescriptor
+	// RequestStaticPermission decides pd with nothing but pd.
+	// It must not perform I/O, and it returns ErrNotStatic if it cannot decide.
+	RequestStaticPermission(pd PermissionDescriptor) (bool, error)
+}
+
+// StaticPermissionsOf returns the permissions that p grants statically.
+func StaticPermissionsOf(p Permissioner) []PermissionDescriptor {
+	sp, ok := p.(StaticPermissioner)
+	if !ok {
+		return nil
+	}
+
+	var out []PermissionDescriptor
+	seen := make(map[string]struct{})
+	for _, pd := range sp.StaticPermissions() {
+		key, err := permissionDescriptorKey(pd)
+		if err != nil {
+			continue
+		}
+		if _, ok := seen[key]; ok {
+			continue
+		}
+		seen[key] = struct{}{}
+
+		granted, err := sp.RequestStaticPermission(pd)
+		if granted && err == nil {
+			out = append(out, pd)
+		}
+	}
+	return out
+}
+
+// requestStaticPermission is RequestStaticPermission of any Permissioner.
+func requestStaticPermission(p Permissioner, pd PermissionDescriptor) (bool, error) {
+	sp, ok := p.(StaticPermissioner)
+	if !ok {
+		return false, ErrNotStatic
+	}
+	return deny(sp.RequestStaticPermission(pd))
+}
+
+func staticPermissionsOf(permissioners ...Permissioner) []PermissionDescriptor {
+	var out []PermissionDescriptor
+	for _, p := range permissioners {
+		if sp, ok := p.(StaticPermissioner); ok {
+			out = append(out, sp.StaticPermissions()...)
+		}
+	}
+	return out
+}
+
+type AllPermissioner struct{}
+
+// AllowAll grants every permission request.
+// It is useful as the last Permissioner of FirstMatch.
+func AllowAll() AllPermissioner {
+	return AllPermissioner{}
+}
+
+func (p AllPermissioner) RequestPermission(ctx context.Context, pd PermissionDescriptor) (bool, error) {
+	return true, nil
+}
+
+func (p AllPermissioner) StaticPermissions() []PermissionDescriptor {
+	return nil
+}
+
+func (p AllPermissioner) RequestStaticPermission(pd PermissionDescriptor) (bool, error) {
+	return true, nil
+}
+
+// PermissionFlags turns permissions into the --allow-* flags of deno.
+// A permission without target, like {"name":"net"}, becomes a flag without value.
+// The permissions that version cannot take as a flag are left out.
+func PermissionFlags(version DenoVersion, permissions []PermissionDescriptor) []string {
+	order := []PermissionName{
+		PermissionNameRead,
+		PermissionNameWrite,
+		PermissionNameNet,
+		PermissionNameEnv,
+		PermissionNameSys,
+		PermissionNameRun,
+		PermissionNameFfi,
+		PermissionNameHrtime,
+		PermissionNameImport,
+	}
+
+	values := make(map[PermissionName][]string)
+	all := make(map[PermissionName]bool)
+	for _, pd := range permissions {
+		if !supportsPermissionFlag(version, pd.Name) {
+			continue
+		}
+		value := permissionFlagValue(pd)
+		if value == "" {
+			all[pd.Name] = true
+			continue
+		}
+		// The values of a flag are separated by comma.
+		if strings.Contains(value, ",") {
+			continue
+		}
+		values[pd.Name] = append(values[pd.Name], value)
+	}
+
+	var flags []string
+	for _, name := range order {
+		switch {
+		case all[name]:
+			flags = append(flags, "--allow-"+string(name))
+		case len(values[name]) > 0:
+			flags = append(flags, "--allow-"+string(name)+"="+strings.Join(values[name], ","))
+		}
+	}
+	return flags
+}
+
+// WorkerPermissions turns permissions into the permissions option of a Web Worker.
+// A permission that is not in permissions is false, so that the worker does not inherit it.
+func WorkerPermissions(version DenoVersion, permissions []PermissionDescriptor) map[string]interface{} {
+	out := make(map[string]interface{})
+	for _, name := range []PermissionName{
+		PermissionNameRead,
+		PermissionNameWrite,
+		PermissionNameNet,
+		PermissionNameEnv,
+		PermissionNameSys,
+		PermissionNameRun,
+		PermissionNameFfi,
+		PermissionNameHrtime,
+		PermissionNameImport,
+	} {
+		if supportsPermissionFlag(version, name) {
+			out[string(name)] = false
+		}
+	}
+
+	for _, pd := range permissions {
+		if !supportsPermissionFlag(version, pd.Name) {
+			continue
+		}
+		value := permissionFlagValue(pd)
+		if value == "" {
+			out[string(pd.Name)] = true
+			continue
+		}
+		switch values := out[string(pd.Name)].(type) {
+		case bool:
+			if !values {
+				out[string(pd.Name)] = []string{value}
+			}
+		case []string:
+			out[string(pd.Name)] = append(values, value)
+		}
+	}
+	return out
+}
+
+func supportsPermissionFlag(version DenoVersion, name PermissionName) bool {
+	unknown := version == (DenoVersion{})
+	switch name {
+	case PermissionNameHrtime:
+		return !unknown && version.Less(DenoVersion2_0)
+	case PermissionNameImport:
+		return !unknown && !version.Less(DenoVersion2_1)
+	default:
+		return true
+	}
+}
+
+func permissionFlagValue(pd PermissionDescriptor) string {
+	switch pd.Name {
+	case PermissionNameRun:
+		return pd.Command
+	case PermissionNameRead, PermissionNameWrite, PermissionNameFfi:
+		return pd.Path
+	case PermissionNameNet, PermissionNameImport:
+		return pd.Host.String()
+	case PermissionNameEnv:
+		return pd.Variable
+	case PermissionNameSys:
+		return string(pd.Kind)
+	default:
+		return ""
+	}
+}
@@ -0,0 +1,149 @@
+package deno_test
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/authgear/authgear-deno/pkg/deno"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestStaticPermissionsOf(t *testing.T) {
+	Convey("StaticPermissionsOf", t, func() {
+		hostRules := func(ss ...string) []deno.HostRule {
+			rules, err := deno.ParseHostRules(ss)
+			So(err, ShouldBeNil)
+			return rules
+		}
+		ports, err := deno.ParsePortRanges([]string{"443"})
+		So(err, ShouldBeNil)
+
+		test := func(p deno.Permissioner, expected string) {
+			actual, err := json.Marshal(deno.StaticPermissionsOf(p))
+			So(err, ShouldBeNil)
+			So(string(actual), ShouldEqualJSON, expected)
+		}
+
+		Convey("leaves", func() {
+			test(deno.AllowHrtime(), `[{"name":"hrtime"}]`)
+			test(deno.AllowEnv("TZ"), `[{"name":"env","variable":"TZ"}]`)
+			test(deno.AllowEnv("AWS_*"), `null`)
+			test(deno.AllowSys(deno.SysKindHostname), `[{"name":"sys","kind":"hostname"}]`)
+			test(deno.HostPolicy(hostRules("example.com:443", "*.example.com", "deny.example.com"), hostRules("deny.example.com")), `[{"name":"net","host":"example.com:443"}]`)
+			test(deno.AllowImport(hostRules("jsr.io:443")...), `[{"name":"import","host":"jsr.io:443"}]`)
+			test(deno.DisallowIPPolicy(deno.DisallowLoopback), `null`)
+			test(deno.AllowAll(), `null`)
+		})
+
+		Convey("AllOf", func() {
+			test(deno.AllOf(
+				deno.PortPolicy(ports, false),
+				deno.HostPolicy(hostRules("example.com:443", "example.com:80", "example.com"), nil),
+			), `[{"name":"net","host":"example.com:443"}]`)
+
+			test(deno.AllOf(
+				deno.HostPolicy(hostRules("example.com:443", "127.0.0.1:443", "1.1.1.1:443"), nil),
+				deno.DisallowIPPolicy(deno.DisallowLoopback),
+			), `[{"name":"net","host":"1.1.1.1:443"}]`)
+
+			test(deno.AllOf(
+				deno.HostPolicy(hostRules("example.com:443"), nil),
+				deno.PermissionerFunc(nil),
+			), `null`)
+		})
+
+		Convey("PermissionerByName", func() {
+			test(deno.PermissionerByName{
+				deno.PermissionNameEnv: deno.AllowEnv("TZ"),
+				deno.PermissionNameSys: deno.AllowEnv("TZ"),
+			}, `[{"name":"env","variable":"TZ"}]`)
+		})
+
+		Convey("FirstMatch", func() {
+			test(deno.AllOf(
+				deno.AllowEnv("TZ", "LANG"),
+				deno.FirstMatch(deno.AllOf(deno.PortPolicy(ports, false)), deno.AllowEnv("TZ"), deno.AllowAll()),
+			), `[{"name":"env","variable":"TZ"}]`)
+
+			test(deno.AllOf(
+				deno.AllowHrtime(),
+				deno.FirstMatch(deno.AllowEnv("TZ"), deno.AllowAll()),
+			), `[{"name":"hrtime"}]`)
+
+			test(deno.AllOf(
+				deno.AllowHrtime(),
+				deno.FirstMatch(deno.PermissionerFunc(nil), deno.AllowAll()),
+			), `null`)
+		})
+
+		Convey("AnyOf", func() {
+			test(deno.AnyOf(deno.AllowHrtime(), deno.AllowEnv("TZ")), `[{"name":"hrtime"},{"name":"env","variable":"TZ"}]`)
+		})
+
+		Convey("WithDeadline", func() {
+			test(deno.WithDeadline(deno.AllowHrtime(), time.Second), `[{"name":"hrtime"}]`)
+		})
+	})
+}
+
+func TestPermissionFlags(t *testing.T) {
+	Convey("PermissionFlags", t, func() {
+		parse := func(ss ...string) []deno.PermissionDescriptor {
+			var out []deno.PermissionDescriptor
+			for _, s := range ss {
+				var pd deno.PermissionDescriptor
+				err := json.Unmarshal([]byte(s), &pd)
+				So(err, ShouldBeNil)
+				out = append(out, pd)
+			}
+			return out
+		}
+
+		permissions := parse(
+			`{"name":"read","path":"/a"}`,
+			`{"name":"read","path":"/b"}`,
+			`{"name":"net","host":"example.com:443"}`,
+			`{"name":"net","host":"[::1]:8080"}`,
+			`{"name":"env","variable":"TZ"}`,
+			`{"name":"env","variable":"A,B"}`,
+			`{"name":"sys","kind":"hostname"}`,
+			`{"name":"hrtime"}`,
+			`{"name":"import","host":"jsr.io:443"}`,
+		)
+
+		So(deno.PermissionFlags(deno.DenoVersion{Major: 1, Minor: 41, Patch: 3}, permissions), ShouldResemble, []string{
+			"--allow-read=/a,/b",
+			"--allow-net=example.com:443,[::1]:8080",
+			"--allow-env=TZ",
+			"--allow-sys=hostname",
+			"--allow-hrtime",
+		})
+
+		So(deno.PermissionFlags(deno.DenoVersion{Major: 2, Minor: 1, Patch: 4}, permissions), ShouldResemble, []string{
+			"--allow-read=/a,/b",
+			"--allow-net=example.com:443,[::1]:8080",
+			"--allow-env=TZ",
+			"--allow-sys=hostname",
+			"--allow-import=jsr.io:443",
+		})
+
+		workerPermissions, err := json.Marshal(deno.WorkerPermissions(deno.DenoVersion{Major: 2, Minor: 1, Patch: 4}, permissions))
+		So(err, ShouldBeNil)
+		So(string(workerPermissions), ShouldEqualJSON, `{
+			"read": ["/a", "/b"],
+			"write": false,
+			"net": ["example.com:443", "[::1]:8080"],
+			"env": ["TZ", "A,B"],
+			"sys": ["hostname"],
+			"run": false,
+			"ffi": false,
+			"import": ["jsr.io:443"]
+		}`)
+
+		So(deno.PermissionFlags(deno.DenoVersion{}, parse(`{"name":"net","host":"example.com"}`, `{"name":"net"}`, `{"name":"hrtime"}`)), ShouldResemble, []string{
+			"--allow-net",
+		})
+	})
+}
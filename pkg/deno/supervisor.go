@@ -0,0 +1,549 @@
+package deno
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	_ "embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/authgear/authgear-deno/pkg/ioutil"
+)
+
+//go:embed supervisor.ts
+var supervisorScriptBytes []byte
+
+//go:embed worker.ts
+var workerScriptBytes []byte
+
+// The supervisor speaks JSON-RPC 2.0 on the control channel, one message per line.
+//
+// Requests from the Go process:
+//   - run, with RPCRunParams. The result is RPCRunResult.
+//
+// Notifications from the Go process:
+//   - cancel, with RPCCancelParams. The worker of the run is terminated, and the run has no response.
+//
+// Notifications from the supervisor, with RPCNotificationParams:
+//   - stdout and stderr, with Data.
+//   - permission, with Descriptor and Granted.
+//   - log, with Log.
+const (
+	RPCMethodRun        = "run"
+	RPCMethodCancel     = "cancel"
+	RPCMethodStdout     = "stdout"
+	RPCMethodStderr     = "stderr"
+	RPCMethodPermission = "permission"
+	RPCMethodLog        = "log"
+)
+
+// The error codes of the supervisor.
+const (
+	// RPCErrorCodeScript means the target script has thrown, or has no default export.
+	RPCErrorCodeScript = -32000
+	// RPCErrorCodeWorker means the worker cannot be created, or has crashed.
+	RPCErrorCodeWorker = -32001
+)
+
+// ErrSupervisorExited means the supervisor exited before the run finished.
+var ErrSupervisorExited = errors.New("supervisor exited")
+
+// ErrorSupervisorExited is logged when supervisor.ts exits unexpectedly.
+type ErrorSupervisorExited struct {
+	Stderr string
+}
+
+func (e *ErrorSupervisorExited) Error() string {
+	return "supervisor exited: " + e.Stderr
+}
+
+func (e *ErrorSupervisorExited) Unwrap() error {
+	return ErrSupervisorExited
+}
+
+// ErrSupervisorClosed means the run was started after Runner.Close.
+var ErrSupervisorClosed = errors.New("supervisor closed")
+
+// ErrorRPC is the error of a JSON-RPC response.
+type ErrorRPC struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+	// Data is the ErrorScript of an error of RPCErrorCodeScript, if the target script has thrown.
+	Data *ErrorScript `json:"data,omitempty"`
+}
+
+func (e *ErrorRPC) Error() string {
+	return e.Message
+}
+
+func (e *ErrorRPC) Unwrap() error {
+	// Return an untyped nil instead of a nil *ErrorScript.
+	if e.Data == nil {
+		return nil
+	}
+	return e.Data
+}
+
+type RPCMessage struct {
+	JSONRPC string          `json:"jsonrpc"`
+	ID      *int            `json:"id,omitempty"`
+	Method  string          `json:"method,omitempty"`
+	Params  json.RawMessage `json:"params,omitempty"`
+	Result  json.RawMessage `json:"result,omitempty"`
+	Error   *ErrorRPC       `json:"error,omitempty"`
+}
+
+type RPCRunParams struct {
+	Script string      `json:"script"`
+	Input  interface{} `json:"input"`
+	// Permissions is the permissions option of the worker. See WorkerPermissions.
+	Permissions map[string]interface{} `json:"permissions"`
+}
+
+type RPCRunResult struct {
+	Output interface{} `json:"output"`
+}
+
+type RPCCancelParams struct {
+	ID int `json:"id"`
+}
+
+type RPCNotificationParams struct {
+	// ID is the ID of the run request.
+	ID         int                   `json:"id"`
+	Data       string                `json:"data,omitempty"`
+	Descriptor *PermissionDescriptor `json:"descriptor,omitempty"`
+	Granted    bool                  `json:"granted,omitempty"`
+	Log        *LogRecord            `json:"log,omitempty"`
+}
+
+// supervisor keeps a deno process that runs supervisor.ts, and restarts it when it exits.
+type supervisor struct {
+	runner *Runner
+	cancel context.CancelFunc
+
+	mutex  sync.Mutex
+	closed bool
+	conn   *supervisorConn
+	// ready is closed when conn is set.
+	ready chan struct{}
+	// inflight is the runs that have not finished.
+	inflight sync.WaitGroup
+}
+
+// supervisorConn is a started supervisor.ts.
+type supervisorConn struct {
+	cmd           *exec.Cmd
+	dir           string
+	controlReader *os.File
+	replyWriter   *os.File
+	// stderr is what supervisor.ts itself writes to stderr.
+	stderr StdStream
+	// done is closed when the process has exited.
+	done chan struct{}
+	// err is the error of Wait. It is set before done is closed.
+	err error
+
+	writeMutex sync.Mutex
+
+	mutex  sync.Mutex
+	nextID int
+	runs   map[int]*workerRun
+}
+
+type workerRun struct {
+	stdout StdStream
+	stderr StdStream
+	// stdoutWriter and stderrWriter write to stdout and stderr, and to the observers of the run.
+	stdoutWriter io.Writer
+	stderrWriter io.Writer
+	logs         *LogRecorder
+	broker       *PermissionBroker
+	result       chan RPCMessage
+}
+
+func newSupervisor(r *Runner) *supervisor {
+	ctx, cancel := context.WithCancel(context.Background())
+	s := &supervisor{
+		runner: r,
+		cancel: cancel,
+		ready:  make(chan struct{}),
+	}
+	go s.loop(ctx)
+	return s
+}
+
+// loop starts supervisor.ts, and starts it again when it exits, until ctx is done.
+func (s *supervisor) loop(ctx context.Context) {
+	for {
+		conn, err := s.runner.startSupervisor()
+		if err != nil {
+			s.logError(ctx, err)
+			if !sleep(ctx, poolRetryInterval) {
+				return
+			}
+			continue
+		}
+
+		s.mutex.Lock()
+		s.conn = conn
+		close(s.ready)
+		s.mutex.Unlock()
+
+		select {
+		case <-conn.done:
+			s.mutex.Lock()
+			s.conn = nil
+			s.ready = make(chan struct{})
+			s.mutex.Unlock()
+			s.logError(ctx, &ErrorSupervisorExited{Stderr: conn.stderr.W.String()})
+			conn.close()
+			if !sleep(ctx, poolRetryInterval) {
+				return
+			}
+		case <-ctx.Done():
+			// Let the runs in flight finish.
+			s.inflight.Wait()
+			conn.kill()
+			<-conn.done
+			conn.close()
+			return
+		}
+	}
+}
+
+func (s *supervisor) logError(ctx context.Context, err error) {
+	if s.runner.Logger == nil {
+		return
+	}
+	s.runner.Logger.LogAttrs(ctx, slog.LevelError, "supervisor", slog.Any("error", err))
+}
+
+// close stops the supervisor after the runs in flight have finished. It does not wait for them.
+func (s *supervisor) close() {
+	s.mutex.Lock()
+	s.closed = true
+	s.mutex.Unlock()
+	s.cancel()
+}
+
+// wait returns the started supervisor.ts.
+func (s *supervisor) wait(ctx context.Context) (*supervisorConn, error) {
+	for {
+		s.mutex.Lock()
+		conn, ready := s.conn, s.ready
+		s.mutex.Unlock()
+		if conn != nil {
+			return conn, nil
+		}
+		select {
+		case <-ready:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+func (s *supervisor) run(ctx context.Context, opts RunGoValueOptions) (*RunGoValueResult, error) {
+	s.mutex.Lock()
+	if s.closed {
+		s.mutex.Unlock()
+		return nil, ErrSupervisorClosed
+	}
+	s.inflight.Add(1)
+	s.mutex.Unlock()
+	defer s.inflight.Done()
+
+	conn, err := s.wait(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	permissioner := s.runner.permissioner(opts.Permissioner)
+	broker, err := NewPermissionBroker(permissioner, nil)
+	if err != nil {
+		return nil, err
+	}
+	broker.OnEvent = opts.OnPermissionEvent
+	stdStreamLimit := s.runner.stdStreamLimit()
+	run := &workerRun{
+		stdout: ioutil.LimitWriter(&bytes.Buffer{}, stdStreamLimit),
+		stderr: ioutil.LimitWriter(&bytes.Buffer{}, stdStreamLimit),
+		logs:   NewLogRecorder(stdStreamLimit),
+		broker: broker,
+		result: make(chan RPCMessage, 1),
+	}
+	run.stdoutWriter = run.stdout
+	if opts.Stdout != nil {
+		run.stdoutWriter = &ioutil.TeeWriter{W: run.stdout, Tee: ioutil.LimitWriter(opts.Stdout, stdStreamLimit)}
+	}
+	run.stderrWriter = run.stderr
+	if opts.Stderr != nil {
+		run.stderrWriter = &ioutil.TeeWriter{W: run.stderr, Tee: ioutil.LimitWriter(opts.Stderr, stdStreamLimit)}
+	}
+
+	start := time.Now()
+	id, err := conn.start(run, RPCRunParams{
+		Script:      opts.TargetScript,
+		Input:       opts.Input,
+		Permissions: WorkerPermissions(s.runner.DenoVersion, StaticPermissionsOf(permissioner)),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var msg RPCMessage
+	select {
+	case msg = <-run.result:
+	case <-conn.done:
+		err = ErrSupervisorExited
+		// The worker that has run out of memory cannot be told from the others.
+		if isOutOfMemory(conn.err, conn.stderr.W.Bytes(), nil) {
+			err = fmt.Errorf("%w: %w", ErrOutOfMemory, err)
+		}
+	case <-ctx.Done():
+		// Terminate the worker.
+		_ = conn.send(RPCMessage{Method: RPCMethodCancel}, RPCCancelParams{ID: id})
+		err = ctx.Err()
+	}
+
+	// Remove the run from conn, so that it is no longer written.
+	conn.finish(id)
+	events := broker.Events()
+	// The CPU time and the memory of a worker cannot be told from those of the others.
+	usage := ResourceUsage{WallTime: time.Since(start)}
+
+	if err == nil && msg.Error != nil {
+		err = msg.Error
+	}
+	var result RPCRunResult
+	if err == nil {
+		err = json.Unmarshal(msg.Result, &result)
+	}
+	s.runner.logPermissionEvents(ctx, workerRunName(id), events)
+	s.runner.logResourceUsage(ctx, workerRunName(id), usage, err)
+	if err != nil {
+		return nil, &RunFileError{
+			Inner:            err,
+			Stdout:           run.stdout,
+			Stderr:           run.stderr,
+			Logs:             run.logs,
+			PermissionEvents: events,
+			ResourceUsage:    usage,
+		}
+	}
+
+	return &RunGoValueResult{
+		Output:           result.Output,
+		Stdout:           run.stdout,
+		Stderr:           run.stderr,
+		Logs:             run.logs,
+		PermissionEvents: events,
+		ResourceUsage:    usage,
+	}, nil
+}
+
+// startSupervisor starts deno with supervisor.ts, granting the static permissions of Permissioner.
+// The permissions of a worker can only be a subset of them.
+func (r *Runner) startSupervisor() (*supervisorConn, error) {
+	c := &supervisorConn{
+		stderr: ioutil.LimitWriter(&bytes.Buffer{}, r.stdStreamLimit()),
+		done:   make(chan struct{}),
+		runs:   make(map[int]*workerRun),
+	}
+	started := false
+	defer func() {
+		if !started {
+			c.close()
+		}
+	}()
+
+	var err error
+	c.dir, err = os.MkdirTemp("", "authgear-deno-supervisor.*")
+	if err != nil {
+		return nil, err
+	}
+	err = writeScripts(c.dir, map[string][]byte{
+		"supervisor.ts": supervisorScriptBytes,
+		"worker.ts":     workerScriptBytes,
+		"wrappers.ts":   wrappersScriptBytes,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// controlReader is read by us, controlWriter is written by supervisor.ts.
+	controlReader, controlWriter, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+	c.controlReader = controlReader
+	defer controlWriter.Close()
+	// replyReader is read by supervisor.ts, replyWriter is written by us.
+	replyReader, replyWriter, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+	c.replyWriter = replyWriter
+	defer replyReader.Close()
+
+	permissions := []PermissionDescriptor{
+		{Name: PermissionNameRead, Path: ControlChannelIn},
+		{Name: PermissionNameWrite, Path: ControlChannelOut},
+	}
+	permissions = append(permissions, StaticPermissionsOf(r.Permissioner)...)
+
+	args := []string{"run", "--quiet", "--no-prompt"}
+	// The limit applies to the heap of each worker.
+	if r.MemoryLimitBytes > 0 {
+		args = append(args, v8MemoryFlag(r.MemoryLimitBytes))
+	}
+	if r.DenoVersion != (DenoVersion{}) && r.DenoVersion.Less(DenoVersion1_38) {
+		args = append(args, "--unstable")
+	} else {
+		args = append(args, "--unstable-worker-options")
+	}
+	args = append(args, PermissionFlags(r.DenoVersion, permissions)...)
+	args = append(args, filepath.Join(c.dir, "supervisor.ts"))
+	c.cmd = exec.Command("deno", args...) //nolint:gosec
+	c.cmd.Env = r.environ(c.cmd, r.HTTPProxy)
+	c.cmd.Stderr = c.stderr
+	// The control channel is fd 3 and fd 4 in deno.
+	c.cmd.ExtraFiles = []*os.File{controlWriter, replyReader}
+
+	err = c.cmd.Start()
+	if err != nil {
+		return nil, err
+	}
+
+	started = true
+	go c.serve(r.stdStreamLimit())
+	return c, nil
+}
+
+// serve reads the messages of supervisor.ts until it exits.
+func (c *supervisorConn) serve(stdStreamLimit int64) {
+	scanner := bufio.NewScanner(c.controlReader)
+	// A stdout or stderr notification can be as large as the stream limit.
+	scanner.Buffer(make([]byte, 0, 64*1024), int(stdStreamLimit)+64*1024)
+	for scanner.Scan() {
+		var msg RPCMessage
+		err := json.Unmarshal(scanner.Bytes(), &msg)
+		if err != nil {
+			break
+		}
+		if msg.ID != nil {
+			c.mutex.Lock()
+			run, ok := c.runs[*msg.ID]
+			c.mutex.Unlock()
+			if ok {
+				run.result <- msg
+			}
+			continue
+		}
+
+		var params RPCNotificationParams
+		err = json.Unmarshal(msg.Params, &params)
+		if err != nil {
+			break
+		}
+		c.mutex.Lock()
+		run, ok := c.runs[params.ID]
+		if ok {
+			switch msg.Method {
+			case RPCMethodStdout:
+				_, _ = run.stdoutWriter.Write([]byte(params.Data))
+			case RPCMethodStderr:
+				_, _ = run.stderrWriter.Write([]byte(params.Data))
+			case RPCMethodPermission:
+				if params.Descriptor != nil {
+					run.broker.Record(*params.Descriptor, params.Granted)
+				}
+			case RPCMethodLog:
+				if params.Log != nil {
+					run.logs.Record(*params.Log)
+				}
+			}
+		}
+		c.mutex.Unlock()
+	}
+
+	// supervisor.ts does not write anything we understand, so it is of no use.
+	c.kill()
+	c.err = c.cmd.Wait()
+	close(c.done)
+}
+
+// start sends the run request.
+func (c *supervisorConn) start(run *workerRun, params RPCRunParams) (int, error) {
+	c.mutex.Lock()
+	c.nextID++
+	id := c.nextID
+	c.runs[id] = run
+	c.mutex.Unlock()
+
+	err := c.send(RPCMessage{ID: &id, Method: RPCMethodRun}, params)
+	if err != nil {
+		c.finish(id)
+		return 0, err
+	}
+	return id, nil
+}
+
+// finish stops delivering the messages of the run.
+func (c *supervisorConn) finish(id int) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	delete(c.runs, id)
+}
+
+func (c *supervisorConn) send(msg RPCMessage, params interface{}) error {
+	b, err := json.Marshal(params)
+	if err != nil {
+		return err
+	}
+	msg.JSONRPC = "2.0"
+	msg.Params = b
+	b, err = json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+
+	c.writeMutex.Lock()
+	defer c.writeMutex.Unlock()
+	_, err = c.replyWriter.Write(append(b, '\n'))
+	return err
+}
+
+func (c *supervisorConn) kill() {
+	if c.cmd != nil && c.cmd.Process != nil {
+		_ = c.cmd.Process.Kill()
+	}
+}
+
+func (c *supervisorConn) close() {
+	if c.controlReader != nil {
+		c.controlReader.Close()
+	}
+	if c.replyWriter != nil {
+		c.replyWriter.Close()
+	}
+	if c.dir != "" {
+		os.RemoveAll(c.dir)
+	}
+}
+
+// workerRunName is the name of the run in the logs, as there is no script file.
+func workerRunName(id int) string {
+	return "worker:" + strconv.Itoa(id)
+}
@@ -0,0 +1,150 @@
+// supervisor.ts runs each target script in its own Web Worker, with the permissions of the run.
+// It talks JSON-RPC 2.0 with the Go process, one message per line.
+// The requests are read from ControlChannelIn, and the responses and the notifications
+// are written to ControlChannelOut. See supervisor.go for the methods.
+const controlChannelOut = "/dev/fd/3";
+const controlChannelIn = "/dev/fd/4";
+
+const controlOut = Deno.openSync(controlChannelOut, { write: true });
+const controlIn = Deno.openSync(controlChannelIn, { read: true });
+Deno.permissions.revokeSync({ name: "write", path: controlChannelOut });
+Deno.permissions.revokeSync({ name: "read", path: controlChannelIn });
+
+// The error codes are in the range reserved for implementation-defined server errors.
+const errorCodeScript = -32000;
+const errorCodeWorker = -32001;
+
+const encoder = new TextEncoder();
+
+function send(message: Record<string, unknown>) {
+  const bytes = encoder.encode(
+    JSON.stringify({ jsonrpc: "2.0", ...message }) + "\n",
+  );
+  let written = 0;
+  while (written < bytes.length) {
+    written += controlOut.writeSync(bytes.subarray(written));
+  }
+}
+
+function notify(method: string, params: Record<string, unknown>) {
+  send({ method, params });
+}
+
+type RunParams = {
+  script: string;
+  input: unknown;
+  permissions: Record<string, unknown>;
+};
+
+// port is where the worker sends its messages, see worker.ts.
+type Run = { worker: Worker; port: MessagePort };
+
+const runs = new Map<number, Run>();
+
+function stop(id: number): boolean {
+  const run = runs.get(id);
+  if (run == null) {
+    return false;
+  }
+  runs.delete(id);
+  run.worker.terminate();
+  run.port.close();
+  return true;
+}
+
+function finish(id: number, message: Record<string, unknown>) {
+  if (stop(id)) {
+    send({ id, ...message });
+  }
+}
+
+function run(id: number, params: RunParams) {
+  let worker: Worker;
+  try {
+    worker = new Worker(new URL("./worker.ts", import.meta.url), {
+      type: "module",
+      // deno-lint-ignore no-explicit-any
+      deno: { permissions: params.permissions } as any,
+    });
+  } catch (err) {
+    send({ id, error: { code: errorCodeWorker, message: String(err) } });
+    return;
+  }
+  // The target script can call self.postMessage in the worker,
+  // so the messages of the worker are only read from a port that worker.ts keeps to itself.
+  // The messages posted on the worker itself are ignored.
+  const channel = new MessageChannel();
+  runs.set(id, { worker, port: channel.port1 });
+
+  channel.port1.onmessage = (e: MessageEvent) => {
+    const m = e.data;
+    switch (m.type) {
+      case "stdout":
+      case "stderr":
+        notify(m.type, { id, data: m.data });
+        break;
+      case "log":
+        notify("log", { id, log: m.log });
+        break;
+      case "permission":
+        notify("permission", {
+          id,
+          descriptor: m.descriptor,
+          granted: m.granted,
+        });
+        break;
+      case "result":
+        finish(id, { result: { output: m.output } });
+        break;
+      case "error":
+        finish(id, {
+          error: { code: errorCodeScript, message: m.message, data: m.error },
+        });
+        break;
+    }
+  };
+  worker.onerror = (e: ErrorEvent) => {
+    e.preventDefault();
+    finish(id, { error: { code: errorCodeWorker, message: e.message } });
+  };
+  worker.postMessage(
+    { script: params.script, input: params.input, port: channel.port2 },
+    [channel.port2],
+  );
+}
+
+function cancel(id: number) {
+  // The Go process has stopped waiting for the response.
+  stop(id);
+}
+
+const decoder = new TextDecoder();
+let buffer = "";
+const chunk = new Uint8Array(64 * 1024);
+for (;;) {
+  const n = await controlIn.read(chunk);
+  if (n === null) {
+    break;
+  }
+  buffer += decoder.decode(chunk.subarray(0, n), { stream: true });
+  for (;;) {
+    const i = buffer.indexOf("\n");
+    if (i < 0) {
+      break;
+    }
+    const line = buffer.slice(0, i);
+    buffer = buffer.slice(i + 1);
+    const message = JSON.parse(line);
+    switch (message.method) {
+      case "run":
+        run(message.id, message.params);
+        break;
+      case "cancel":
+        cancel(message.params.id);
+        break;
+    }
+  }
+}
+
+// The Go process has closed the channel.
+Deno.exit(0);
@@ -1,10 +1,14 @@
 package deno_test
 
 import (
+	"context"
+	"encoding/binary"
 	"io"
+	"net"
 	"os"
 	"path"
 	"strings"
+	"sync/atomic"
 
 	. "github.com/smartystreets/goconvey/convey"
 )
@@ -40,3 +44,181 @@ func shouldEqualContent(actual interface{}, expected ...interface{}) string {
 
 	return ShouldResemble(string(content1), string(content2))
 }
+
+// startDNSServer starts a DNS server on a local UDP port that answers A and AAAA queries with records.
+// records is called for every query, so that it can return different answers to simulate DNS rebinding.
+// It returns a resolver that sends every query to the server, and the address of the server.
+func startDNSServer(records func(name string) []net.IP, ttl uint32) (*net.Resolver, string, func()) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		panic(err)
+	}
+
+	go func() {
+		buf := make([]byte, 512)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			resp, ok := dnsAnswer(buf[:n], records, ttl)
+			if ok {
+				_, _ = conn.WriteTo(resp, addr)
+			}
+		}
+	}()
+
+	resolver := &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, "udp", conn.LocalAddr().String())
+		},
+	}
+	return resolver, conn.LocalAddr().String(), func() { conn.Close() }
+}
+
+// startTruncatingDNSServer is like startDNSServer,
+// except that the answers over UDP are truncated, and the full answers are sent over TCP on the same port.
+// It returns the address of the server, and the number of queries over TCP.
+func startTruncatingDNSServer(records func(name string) []net.IP, ttl uint32) (string, *atomic.Int64, func()) {
+	var conn net.PacketConn
+	var listener net.Listener
+	for {
+		var err error
+		listener, err = net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			panic(err)
+		}
+		conn, err = net.ListenPacket("udp", listener.Addr().String())
+		if err == nil {
+			break
+		}
+		// The port is taken for UDP. Try another one.
+		listener.Close()
+	}
+
+	go func() {
+		buf := make([]byte, 512)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			resp, ok := dnsAnswer(buf[:n], func(string) []net.IP { return nil }, ttl)
+			if ok {
+				// TC, and no answers.
+				resp[2] |= 0x02
+				resp[3] &^= 0x0f
+				_, _ = conn.WriteTo(resp, addr)
+			}
+		}
+	}()
+
+	var tcpQueries atomic.Int64
+	go func() {
+		for {
+			c, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				var length [2]byte
+				if _, err := io.ReadFull(c, length[:]); err != nil {
+					return
+				}
+				query := make([]byte, binary.BigEndian.Uint16(length[:]))
+				if _, err := io.ReadFull(c, query); err != nil {
+					return
+				}
+				tcpQueries.Add(1)
+				resp, ok := dnsAnswer(query, records, ttl)
+				if ok {
+					_, _ = c.Write(append(binary.BigEndian.AppendUint16(nil, uint16(len(resp))), resp...))
+				}
+			}()
+		}
+	}()
+
+	return conn.LocalAddr().String(), &tcpQueries, func() {
+		conn.Close()
+		listener.Close()
+	}
+}
+
+func dnsAnswer(query []byte, records func(name string) []net.IP, ttl uint32) ([]byte, bool) {
+	const (
+		typeA    = 1
+		typeAAAA = 28
+	)
+
+	if len(query) < 12 {
+		return nil, false
+	}
+
+	// Parse the question.
+	var labels []string
+	i := 12
+	for {
+		if i >= len(query) {
+			return nil, false
+		}
+		l := int(query[i])
+		i++
+		if l == 0 {
+			break
+		}
+		if i+l > len(query) {
+			return nil, false
+		}
+		labels = append(labels, string(query[i:i+l]))
+		i += l
+	}
+	if i+4 > len(query) {
+		return nil, false
+	}
+	qtype := binary.BigEndian.Uint16(query[i : i+2])
+	question := query[12 : i+4]
+	name := strings.ToLower(strings.Join(labels, "."))
+
+	var answers [][]byte
+	ips := records(name)
+	for _, ip := range ips {
+		var rdata []byte
+		var rtype uint16
+		if v4 := ip.To4(); v4 != nil && qtype == typeA {
+			rdata, rtype = v4, typeA
+		} else if v4 == nil && qtype == typeAAAA {
+			rdata, rtype = ip.To16(), typeAAAA
+		} else {
+			continue
+		}
+		// Name is a pointer to the question.
+		rr := []byte{0xc0, 0x0c}
+		rr = binary.BigEndian.AppendUint16(rr, rtype)
+		rr = binary.BigEndian.AppendUint16(rr, 1)
+		rr = binary.BigEndian.AppendUint32(rr, ttl)
+		rr = binary.BigEndian.AppendUint16(rr, uint16(len(rdata)))
+		rr = append(rr, rdata...)
+		answers = append(answers, rr)
+	}
+
+	// QR, RD, RA, and NXDOMAIN if the name is unknown.
+	flags := uint16(0x8180)
+	if len(ips) == 0 {
+		flags |= 3
+	}
+
+	resp := append([]byte{}, query[0:2]...)
+	resp = binary.BigEndian.AppendUint16(resp, flags)
+	resp = binary.BigEndian.AppendUint16(resp, 1)
+	resp = binary.BigEndian.AppendUint16(resp, uint16(len(answers)))
+	resp = binary.BigEndian.AppendUint16(resp, 0)
+	resp = binary.BigEndian.AppendUint16(resp, 0)
+	resp = append(resp, question...)
+	for _, rr := range answers {
+		resp = append(resp, rr...)
+	}
+	return resp, true
+}
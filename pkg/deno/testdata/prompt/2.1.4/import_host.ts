@@ -0,0 +1 @@
+Deno.permissions.request({ name: "import", host: "example.com" });
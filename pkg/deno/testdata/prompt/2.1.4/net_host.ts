@@ -0,0 +1 @@
+Deno.permissions.request({ name: "net", host: "[::1]:8080" });
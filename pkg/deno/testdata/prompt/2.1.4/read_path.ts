@@ -0,0 +1 @@
+Deno.permissions.request({ name: "read", path: "/etc/passwd" });
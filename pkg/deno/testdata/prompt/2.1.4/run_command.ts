@@ -0,0 +1 @@
+Deno.permissions.request({ name: "run", command: "sh" });
@@ -0,0 +1 @@
+Deno.permissions.request({ name: "sys", kind: "hostname" });
@@ -0,0 +1,41 @@
+package deno
+
+import (
+	"log/slog"
+	"os"
+	"time"
+)
+
+// ResourceUsage is what a run has used, from the rusage of deno.
+type ResourceUsage struct {
+	// WallTime is from the start of the run to the exit of deno.
+	WallTime time.Duration
+	// UserTime and SystemTime are the CPU time of deno.
+	// The CPU time of a process of the pool includes the startup of deno.
+	// They are zero in WorkerMode, where the workers share a process.
+	UserTime   time.Duration
+	SystemTime time.Duration
+	// MaxRSSBytes is the peak resident set size of deno. It is zero if it is not available.
+	MaxRSSBytes int64
+}
+
+func newResourceUsage(wallTime time.Duration, state *os.ProcessState) ResourceUsage {
+	usage := ResourceUsage{
+		WallTime: wallTime,
+	}
+	if state != nil {
+		usage.UserTime = state.UserTime()
+		usage.SystemTime = state.SystemTime()
+		usage.MaxRSSBytes = maxRSSBytes(state)
+	}
+	return usage
+}
+
+func (u *ResourceUsage) LogAttrs() []slog.Attr {
+	return []slog.Attr{
+		slog.Duration("wall_time", u.WallTime),
+		slog.Duration("user_time", u.UserTime),
+		slog.Duration("system_time", u.SystemTime),
+		slog.Int64("max_rss_bytes", u.MaxRSSBytes),
+	}
+}
@@ -0,0 +1,102 @@
+package deno
+
+import (
+	"context"
+	"fmt"
+	"os/exec"
+	"regexp"
+	"strconv"
+)
+
+type ErrorInvalidDenoVersion struct {
+	Value string
+}
+
+func (e *ErrorInvalidDenoVersion) Error() string {
+	return fmt.Sprintf("invalid deno version: %v", e.Value)
+}
+
+type ErrorUnsupportedDenoVersion struct {
+	Version DenoVersion
+}
+
+func (e *ErrorUnsupportedDenoVersion) Error() string {
+	return fmt.Sprintf("unsupported deno version: %v", e.Version)
+}
+
+// DenoVersion is the version of deno.
+// The permission prompts of deno are worded differently across versions.
+type DenoVersion struct {
+	Major int
+	Minor int
+	Patch int
+}
+
+var (
+	// DenoVersion1_30 is the oldest version whose permission prompts are tested.
+	DenoVersion1_30 = DenoVersion{1, 30, 0}
+	// DenoVersion1_31 changed the layout of the permission prompt.
+	DenoVersion1_31 = DenoVersion{1, 31, 0}
+	// DenoVersion1_38 added --unstable-worker-options, which replaces --unstable for the permissions of a Web Worker.
+	DenoVersion1_38 = DenoVersion{1, 38, 0}
+	// DenoVersion2_0 removed the hrtime permission and added "Learn more at" to the permission prompt.
+	DenoVersion2_0 = DenoVersion{2, 0, 0}
+	// DenoVersion2_1 added the import permission.
+	DenoVersion2_1 = DenoVersion{2, 1, 0}
+	// DenoVersion3_0 is the first version that is not supported.
+	DenoVersion3_0 = DenoVersion{3, 0, 0}
+)
+
+var denoVersionRegexp = regexp.MustCompile(`(?:^|deno )v?(\d+)\.(\d+)\.(\d+)`)
+
+// ParseDenoVersion parses either a version like 1.41.3, or the output of `deno --version`.
+func ParseDenoVersion(s string) (DenoVersion, error) {
+	matches := denoVersionRegexp.FindStringSubmatch(s)
+	if len(matches) != 4 {
+		return DenoVersion{}, &ErrorInvalidDenoVersion{Value: s}
+	}
+
+	var parts [3]int
+	for i := range parts {
+		n, err := strconv.Atoi(matches[i+1])
+		if err != nil {
+			return DenoVersion{}, &ErrorInvalidDenoVersion{Value: s}
+		}
+		parts[i] = n
+	}
+
+	return DenoVersion{
+		Major: parts[0],
+		Minor: parts[1],
+		Patch: parts[2],
+	}, nil
+}
+
+// DetectDenoVersion runs `deno --version`.
+func DetectDenoVersion(ctx context.Context) (DenoVersion, error) {
+	out, err := exec.CommandContext(ctx, "deno", "--version").Output()
+	if err != nil {
+		return DenoVersion{}, err
+	}
+	return ParseDenoVersion(string(out))
+}
+
+func (v DenoVersion) String() string {
+	return fmt.Sprintf("%v.%v.%v", v.Major, v.Minor, v.Patch)
+}
+
+// Less reports whether v is older than w.
+func (v DenoVersion) Less(w DenoVersion) bool {
+	if v.Major != w.Major {
+		return v.Major < w.Major
+	}
+	if v.Minor != w.Minor {
+		return v.Minor < w.Minor
+	}
+	return v.Patch < w.Patch
+}
+
+// Supported reports whether the permission prompts of v are known.
+func (v DenoVersion) Supported() bool {
+	return !v.Less(DenoVersion1_30) && v.Less(DenoVersion3_0)
+}
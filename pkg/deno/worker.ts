@@ -0,0 +1,102 @@
+// worker.ts runs one target script in a Web Worker of supervisor.ts.
+// deno decides the permissions by the permissions of the worker, without prompting,
+// so the permission requests are only reported to the supervisor to be recorded.
+import {
+  format,
+  installConsoleWrappers,
+  installPermissionWrappers,
+  serializeError,
+} from "./wrappers.ts";
+
+// deno-lint-ignore no-explicit-any
+const worker = self as any;
+
+// The messages to the supervisor are sent on the port that comes with the job,
+// as the target script can call self.postMessage too.
+// The port and its postMessage are kept here before the target script is imported,
+// so the target script can neither reach the port nor replace its postMessage.
+let postToSupervisor: ((message: Record<string, unknown>) => void) | null =
+  null;
+
+function post(message: Record<string, unknown>) {
+  postToSupervisor?.(message);
+}
+
+// The workers share the stdout and the stderr of the supervisor,
+// so what the target script writes is sent to the supervisor instead.
+function writer(type: "stdout" | "stderr") {
+  const decoder = new TextDecoder();
+  return {
+    line: (...args: unknown[]) => post({ type, data: format(args) + "\n" }),
+    write: (p: Uint8Array) => {
+      post({ type, data: decoder.decode(p) });
+      return Promise.resolve(p.length);
+    },
+    writeSync: (p: Uint8Array) => {
+      post({ type, data: decoder.decode(p) });
+      return p.length;
+    },
+  };
+}
+
+const stdout = writer("stdout");
+const stderr = writer("stderr");
+console.log = stdout.line;
+console.info = stdout.line;
+console.debug = stdout.line;
+console.error = stderr.line;
+console.warn = stderr.line;
+Deno.stdout.write = stdout.write;
+Deno.stdout.writeSync = stdout.writeSync;
+Deno.stderr.write = stderr.write;
+Deno.stderr.writeSync = stderr.writeSync;
+installConsoleWrappers((log) => post({ type: "log", log }));
+
+const permissions = Deno.permissions;
+const querySync = permissions.querySync.bind(permissions);
+
+installPermissionWrappers((descriptor: Deno.PermissionDescriptor) => {
+  const status = querySync(descriptor);
+  const granted = status.state === "granted";
+  post({ type: "permission", descriptor, granted });
+  return status;
+});
+
+type Job = { script: string; input: unknown; port: MessagePort };
+
+worker.onmessage = async (e: MessageEvent<Job>) => {
+  // Only the first job is from the supervisor. The target script can dispatch the others.
+  if (postToSupervisor != null) {
+    return;
+  }
+  postToSupervisor = MessagePort.prototype.postMessage.bind(e.data.port);
+  const url = "data:application/typescript," +
+    encodeURIComponent(e.data.script);
+  try {
+    const m = await import(url);
+    if (typeof m.default !== "function") {
+      const message =
+        "The hook must export a default function. Check that you have `export default async function(...) { ... }` in your script.";
+      console.error(message);
+      post({ type: "error", message });
+      return;
+    }
+    const output = await Promise.resolve(m.default(e.data.input));
+    let content = JSON.stringify(output);
+    if (content === undefined) {
+      content = "null";
+    }
+    post({ type: "result", output: JSON.parse(content) });
+  } catch (err) {
+    const message = err instanceof Error
+      ? (err.stack ?? err.message)
+      : String(err);
+    console.error(message);
+    // The URL of the target script is the whole script, so it is replaced by FILE.
+    const error = serializeError(err, {
+      [url]: "FILE",
+      [new URL(".", import.meta.url).href]: "",
+    });
+    post({ type: "error", message, error });
+  }
+};
@@ -0,0 +1,241 @@
+// The wrappers request the permission before the API is called,
+// so that the request is known before deno decides it.
+// They are shared by runner.ts and worker.ts.
+
+export type RequestPermission = (
+  descriptor: Deno.PermissionDescriptor,
+) => Deno.PermissionStatus;
+
+export function format(args: unknown[]): string {
+  return args.map((a) => typeof a === "string" ? a : Deno.inspect(a)).join(
+    " ",
+  );
+}
+
+// LogRecord is LogRecord in log.go.
+export type LogRecord = {
+  level: string;
+  timestamp: string;
+  message: string;
+  args: unknown[];
+};
+
+function serialize(a: unknown): unknown {
+  try {
+    const json = JSON.stringify(a);
+    if (json !== undefined) {
+      return JSON.parse(json);
+    }
+  } catch {
+    // Like a circular object, or a bigint.
+  }
+  return Deno.inspect(a);
+}
+
+// installConsoleWrappers emits a LogRecord for every call of a console method,
+// before the call writes to stdout or stderr as usual.
+export function installConsoleWrappers(emit: (record: LogRecord) => void) {
+  for (const level of ["debug", "info", "log", "warn", "error"] as const) {
+    const original = console[level].bind(console);
+    console[level] = (...args: unknown[]) => {
+      emit({
+        level,
+        timestamp: new Date().toISOString(),
+        message: format(args),
+        args: args.map(serialize),
+      });
+      original(...args);
+    };
+  }
+}
+
+// ScriptError is ErrorScript in scripterror.go.
+export type ScriptError = {
+  name?: string;
+  message: string;
+  stack?: string;
+  cause?: ScriptError;
+};
+
+// A cause can refer to the error itself.
+const maxCauseDepth = 8;
+
+// serializeError serializes what the target script has thrown.
+// Every key of replacements in the message and the stack is replaced by its value,
+// so that the temporary paths are not reported.
+export function serializeError(
+  err: unknown,
+  replacements: Record<string, string>,
+  depth = 0,
+): ScriptError {
+  const replace = (s: string) =>
+    Object.entries(replacements).reduce(
+      (acc, [from, to]) => acc.replaceAll(from, to),
+      s,
+    );
+  if (!(err instanceof Error)) {
+    const message = typeof err === "string" ? err : Deno.inspect(err);
+    return { message: replace(message) };
+  }
+  const e: ScriptError = { name: err.name, message: replace(err.message) };
+  if (err.stack !== undefined) {
+    e.stack = replace(err.stack);
+  }
+  if (err.cause !== undefined && depth < maxCauseDepth) {
+    e.cause = serializeError(err.cause, replacements, depth + 1);
+  }
+  return e;
+}
+
+export function installPermissionWrappers(
+  requestPermission: RequestPermission,
+) {
+  const permissions = Deno.permissions;
+  permissions.requestSync = requestPermission;
+  permissions.request = (descriptor: Deno.PermissionDescriptor) =>
+    Promise.resolve(requestPermission(descriptor));
+
+  const defaultPorts: Record<string, string> = {
+    "http:": "80",
+    "https:": "443",
+    "ws:": "80",
+    "wss:": "443",
+  };
+
+  function requestURLPermission(url: string | URL) {
+    const u = new URL(url);
+    const port = u.port || defaultPorts[u.protocol];
+    if (port == null) {
+      return;
+    }
+    requestPermission({ name: "net", host: `${u.hostname}:${port}` });
+  }
+
+  // deno would prompt for the location of a redirect by itself, and such a prompt is denied.
+  // So the redirects are followed here, requesting the permission of each location like that of the request.
+  const maxRedirects = 20;
+  const redirectStatuses = [301, 302, 303, 307, 308];
+  const originalFetch = globalThis.fetch;
+  globalThis.fetch = async (
+    input: string | URL | Request,
+    init?: RequestInit,
+  ) => {
+    const request = new Request(input, init);
+    requestURLPermission(request.url);
+    if (request.redirect !== "follow") {
+      return originalFetch(request);
+    }
+
+    // The body is sent again on a redirect that keeps the method.
+    const body = request.body === null ? null : await request.arrayBuffer();
+    let url = request.url;
+    let method = request.method;
+    const headers = new Headers(request.headers);
+    for (let redirects = 0;; redirects++) {
+      const response = await originalFetch(url, {
+        method,
+        headers,
+        body: method === "GET" || method === "HEAD" ? null : body,
+        signal: request.signal,
+        redirect: "manual",
+      });
+      const location = response.headers.get("location");
+      if (!redirectStatuses.includes(response.status) || location === null) {
+        Object.defineProperties(response, {
+          url: { value: url },
+          redirected: { value: redirects > 0 },
+        });
+        return response;
+      }
+      await response.body?.cancel();
+      if (redirects >= maxRedirects) {
+        throw new TypeError("too many redirects");
+      }
+
+      const next = new URL(location, url);
+      if (next.origin !== new URL(url).origin) {
+        headers.delete("authorization");
+      }
+      if (
+        (response.status === 303 && method !== "HEAD") ||
+        ((response.status === 301 || response.status === 302) &&
+          method === "POST")
+      ) {
+        method = "GET";
+        for (
+          const name of [
+            "content-type",
+            "content-length",
+            "content-encoding",
+            "content-language",
+            "content-location",
+          ]
+        ) {
+          headers.delete(name);
+        }
+      }
+      url = next.href;
+      requestURLPermission(url);
+    }
+  };
+
+  const OriginalWebSocket = globalThis.WebSocket;
+  globalThis.WebSocket = class extends OriginalWebSocket {
+    constructor(url: string | URL, protocols?: string | string[]) {
+      requestURLPermission(url);
+      super(url, protocols);
+    }
+  };
+
+  const originalConnect = Deno.connect;
+  // deno-lint-ignore no-explicit-any
+  Deno.connect = ((options: any) => {
+    if (options.transport == null || options.transport === "tcp") {
+      const hostname = options.hostname ?? "127.0.0.1";
+      requestPermission({ name: "net", host: `${hostname}:${options.port}` });
+    }
+    return originalConnect(options);
+  }) as typeof Deno.connect;
+
+  const originalConnectTls = Deno.connectTls;
+  Deno.connectTls = (options: Deno.ConnectTlsOptions) => {
+    const hostname = options.hostname ?? "127.0.0.1";
+    requestPermission({ name: "net", host: `${hostname}:${options.port}` });
+    return originalConnectTls(options);
+  };
+
+  const env = Deno.env;
+  for (const method of ["get", "set", "delete", "has"] as const) {
+    const original = env[method].bind(env);
+    // deno-lint-ignore no-explicit-any
+    (env as any)[method] = (key: string, ...rest: any[]) => {
+      requestPermission({ name: "env", variable: key });
+      // deno-lint-ignore no-explicit-any
+      return (original as any)(key, ...rest);
+    };
+  }
+  const originalToObject = env.toObject.bind(env);
+  env.toObject = () => {
+    requestPermission({ name: "env" });
+    return originalToObject();
+  };
+
+  const sysKinds = {
+    hostname: "hostname",
+    loadavg: "loadavg",
+    systemMemoryInfo: "systemMemoryInfo",
+    networkInterfaces: "networkInterfaces",
+    osRelease: "osRelease",
+    uid: "uid",
+    gid: "gid",
+  } as const;
+  for (const [method, kind] of Object.entries(sysKinds)) {
+    // deno-lint-ignore no-explicit-any
+    const original = (Deno as any)[method];
+    // deno-lint-ignore no-explicit-any
+    (Deno as any)[method] = (...args: any[]) => {
+      requestPermission({ name: "sys", kind });
+      return original(...args);
+    };
+  }
+}
@@ -0,0 +1,81 @@
+package handler
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/authgear/authgear-deno/pkg/deno"
+)
+
+// EvaluateMaxDescriptors limits the number of permissions in one request,
+// as each of them may resolve a host.
+const EvaluateMaxDescriptors = 100
+
+type EvaluateRequest struct {
+	Descriptors []deno.PermissionDescriptor `json:"descriptors"`
+	// Policy is the policy of the run to evaluate with. See RunRequest.Policy.
+	Policy *Policy `json:"policy,omitempty"`
+}
+
+type EvaluateResponse struct {
+	Error            string                 `json:"error,omitempty"`
+	PermissionEvents []deno.PermissionEvent `json:"permission_events,omitempty"`
+}
+
+// Evaluator decides permissions with the policy of Runner, without starting deno.
+type Evaluator struct {
+	Runner *Runner
+}
+
+func (t *Evaluator) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+	events, err := t.handle(w, r)
+	if err != nil {
+		t.writeError(w, r, err)
+		return
+	}
+	t.writeResult(w, r, events)
+}
+
+func (t *Evaluator) handle(_ http.ResponseWriter, r *http.Request) ([]deno.PermissionEvent, error) {
+	var evaluateRequest EvaluateRequest
+	err := json.NewDecoder(r.Body).Decode(&evaluateRequest)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(evaluateRequest.Descriptors) <= 0 {
+		return nil, errors.New("descriptors are required")
+	}
+	if len(evaluateRequest.Descriptors) > EvaluateMaxDescriptors {
+		return nil, fmt.Errorf("at most %v descriptors are allowed", EvaluateMaxDescriptors)
+	}
+
+	var permissioner deno.Permissioner
+	if evaluateRequest.Policy != nil {
+		permissioner, err = evaluateRequest.Policy.Permissioner(t.Runner.Resolver)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// Evaluate with the policy that a run would start with now.
+	return t.Runner.snapshot.Load().runner.EvaluatePermissions(r.Context(), deno.EvaluatePermissionsOptions{
+		Descriptors:  evaluateRequest.Descriptors,
+		Permissioner: permissioner,
+	})
+}
+
+func (t *Evaluator) writeError(w http.ResponseWriter, r *http.Request, err error) {
+	writeJSON(w, r, EvaluateResponse{
+		Error: err.Error(),
+	})
+}
+
+func (t *Evaluator) writeResult(w http.ResponseWriter, r *http.Request, events []deno.PermissionEvent) {
+	writeJSON(w, r, EvaluateResponse{
+		PermissionEvents: events,
+	})
+}
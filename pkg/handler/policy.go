@@ -0,0 +1,105 @@
+package handler
+
+import (
+	"github.com/authgear/authgear-deno/pkg/deno"
+)
+
+// Policy restricts the permissions of a run.
+// It is intersected with the policy of the server,
+// so it can only make the policy of the server stricter.
+type Policy struct {
+	// AllowHosts is the host rules that the host must match any of.
+	AllowHosts []string `json:"allow_hosts,omitempty"`
+	// DenyHosts is the host rules that the host must match none of.
+	DenyHosts []string `json:"deny_hosts,omitempty"`
+	// AllowCIDRs is the CIDRs that the resolved IPs must be in.
+	AllowCIDRs []string `json:"allow_cidrs,omitempty"`
+	// DenyCIDRs is the CIDRs that the resolved IPs must not be in.
+	DenyCIDRs []string `json:"deny_cidrs,omitempty"`
+	// AllowPorts is the ports or port ranges that the port must be in.
+	AllowPorts []string `json:"allow_ports,omitempty"`
+	// AllowEnvVariables is the environment variables that can be read.
+	// nil means the policy of the server, while an empty list means no environment variables.
+	AllowEnvVariables []string `json:"allow_env_variables,omitempty"`
+}
+
+// Permissioner returns the Permissioner of p.
+// resolver resolves the hosts for AllowCIDRs and DenyCIDRs. It can be nil.
+func (p *Policy) Permissioner(resolver deno.IPResolver) (deno.Permissioner, error) {
+	var net []deno.Permissioner
+
+	ports, err := p.PortRanges()
+	if err != nil {
+		return nil, err
+	}
+	if ports != nil {
+		// A permission without port is a permission to every port, so it is not allowed.
+		net = append(net, deno.PortPolicy(ports, false))
+	}
+
+	if len(p.AllowHosts) > 0 || len(p.DenyHosts) > 0 {
+		allow, err := deno.ParseHostRules(p.AllowHosts)
+		if err != nil {
+			return nil, err
+		}
+		deny, err := deno.ParseHostRules(p.DenyHosts)
+		if err != nil {
+			return nil, err
+		}
+		net = append(net, deno.HostPolicy(allow, deny))
+	}
+
+	ipPolicies, err := p.IPPolicies()
+	if err != nil {
+		return nil, err
+	}
+	if len(ipPolicies) > 0 {
+		ipPolicy := deno.DisallowIPPolicy(ipPolicies...)
+		if resolver != nil {
+			ipPolicy = ipPolicy.WithResolver(resolver)
+		}
+		net = append(net, ipPolicy)
+	}
+
+	var permissioners []deno.Permissioner
+	if len(net) > 0 {
+		permissioners = append(permissioners, deno.AllOf(net...))
+	}
+	if p.AllowEnvVariables != nil {
+		permissioners = append(permissioners, deno.AllowEnv(p.AllowEnvVariables...))
+	}
+	// The permissions not mentioned by the policy are left to the server.
+	permissioners = append(permissioners, deno.AllowAll())
+
+	return deno.FirstMatch(permissioners...), nil
+}
+
+// IPPolicies returns the IP policies of AllowCIDRs and DenyCIDRs.
+// They are checked again by the egress proxy when it dials, as a host can resolve again to another IP.
+func (p *Policy) IPPolicies() ([]deno.IPPolicy, error) {
+	var ipPolicies []deno.IPPolicy
+	if len(p.DenyCIDRs) > 0 {
+		deny, err := deno.ParseCIDRs(p.DenyCIDRs)
+		if err != nil {
+			return nil, err
+		}
+		ipPolicies = append(ipPolicies, deno.DisallowCIDRs(deny...))
+	}
+	if len(p.AllowCIDRs) > 0 {
+		allow, err := deno.ParseCIDRs(p.AllowCIDRs)
+		if err != nil {
+			return nil, err
+		}
+		ipPolicies = append(ipPolicies, deno.DisallowOutsideCIDRs(allow...))
+	}
+	return ipPolicies, nil
+}
+
+// PortRanges returns the port ranges of AllowPorts, or nil if AllowPorts is empty.
+// They are checked again by the egress proxy when it dials, as deno grants a permission without port to every port.
+func (p *Policy) PortRanges() ([]deno.PortRange, error) {
+	if len(p.AllowPorts) <= 0 {
+		return nil, nil
+	}
+	return deno.ParsePortRanges(p.AllowPorts)
+}
@@ -5,6 +5,8 @@ import (
 	"encoding/json"
 	"errors"
 	"net/http"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/authgear/authgear-deno/pkg/deno"
@@ -13,6 +15,7 @@ import (
 type RunRequest struct {
 	Script string      `json:"script"`
 	Input  interface{} `json:"input"`
+	Policy *Policy     `json:"policy,omitempty"`
 }
 
 type Stream struct {
@@ -27,49 +30,104 @@ func NewStream(stdStream deno.StdStream) *Stream {
 	}
 }
 
+// ResourceUsage is deno.ResourceUsage in milliseconds.
+type ResourceUsage struct {
+	WallTimeMs   int64 `json:"wall_time_ms"`
+	UserTimeMs   int64 `json:"user_time_ms"`
+	SystemTimeMs int64 `json:"system_time_ms"`
+	MaxRSSBytes  int64 `json:"max_rss_bytes"`
+}
+
+func NewResourceUsage(usage deno.ResourceUsage) *ResourceUsage {
+	return &ResourceUsage{
+		WallTimeMs:   usage.WallTime.Milliseconds(),
+		UserTimeMs:   usage.UserTime.Milliseconds(),
+		SystemTimeMs: usage.SystemTime.Milliseconds(),
+		MaxRSSBytes:  usage.MaxRSSBytes,
+	}
+}
+
 type ErrorCode string
 
 const (
-	ErrorCodeRunTimout ErrorCode = "run_timeout"
-	ErrorCodeUnknown   ErrorCode = "unknown"
+	ErrorCodeRunTimout                ErrorCode = "run_timeout"
+	ErrorCodeRunOutOfMemory           ErrorCode = "run_out_of_memory"
+	ErrorCodeRunResourceLimitExceeded ErrorCode = "run_resource_limit_exceeded"
+	ErrorCodeScriptError              ErrorCode = "script_error"
+	ErrorCodeUnknown                  ErrorCode = "unknown"
 )
 
 type RunResponse struct {
-	Error     string      `json:"error,omitempty"`
-	ErrorCode ErrorCode   `json:"error_code,omitempty"`
-	Output    interface{} `json:"output,omitempty"`
-	Stderr    *Stream     `json:"stderr,omitempty"`
-	Stdout    *Stream     `json:"stdout,omitempty"`
+	Error            string                 `json:"error,omitempty"`
+	ErrorCode        ErrorCode              `json:"error_code,omitempty"`
+	ResourceLimit    deno.ResourceLimit     `json:"resource_limit,omitempty"`
+	ScriptError      *deno.ErrorScript      `json:"script_error,omitempty"`
+	Output           interface{}            `json:"output,omitempty"`
+	Stderr           *Stream                `json:"stderr,omitempty"`
+	Stdout           *Stream                `json:"stdout,omitempty"`
+	Logs             []deno.LogRecord       `json:"logs,omitempty"`
+	LogsTruncated    bool                   `json:"logs_truncated,omitempty"`
+	PermissionEvents []deno.PermissionEvent `json:"permission_events,omitempty"`
+	ResourceUsage    *ResourceUsage         `json:"resource_usage,omitempty"`
 }
 
 type Runner struct {
-	Runner         *deno.Runner
-	sema           chan struct{}
-	timeoutSeconds int
+	// Resolver resolves the hosts for the policy of each request.
+	Resolver deno.IPResolver
+
+	snapshot atomic.Pointer[runnerSnapshot]
+}
+
+type runnerSnapshot struct {
+	runner  *deno.Runner
+	sema    chan struct{}
+	timeout time.Duration
+
+	mutex   sync.Mutex
+	retired bool
+	// runs counts the requests that have begun with the snapshot, including those waiting for a slot.
+	runs sync.WaitGroup
 }
 
 func NewRunner(runner *deno.Runner, maxConcurrency int, timeoutSeconds int) *Runner {
-	return &Runner{
-		Runner:         runner,
-		sema:           make(chan struct{}, maxConcurrency),
-		timeoutSeconds: timeoutSeconds,
-	}
+	t := &Runner{}
+	t.Update(runner, maxConcurrency, timeoutSeconds)
+	return t
+}
+
+// Update replaces the runner and its settings for the requests to come.
+// The requests in flight keep the runner and the settings they started with,
+// and they are not counted towards the new maxConcurrency.
+// The returned channel is closed when the requests with the previous runner have ended,
+// so that the previous runner can be closed then.
+func (t *Runner) Update(runner *deno.Runner, maxConcurrency int, timeoutSeconds int) <-chan struct{} {
+	previous := t.snapshot.Swap(&runnerSnapshot{
+		runner:  runner,
+		sema:    make(chan struct{}, maxConcurrency),
+		timeout: time.Duration(timeoutSeconds) * time.Second,
+	})
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		if previous != nil {
+			previous.retire()
+		}
+	}()
+	return done
 }
 
 func (t *Runner) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	defer r.Body.Close()
 
-	// Wait for a slot to be available or for the request context to be done.
-	select {
-	case t.sema <- struct{}{}:
-		// Acquired a slot; ensure release after handling.
-		defer func() { <-t.sema }()
-	case <-r.Context().Done():
+	snapshot, ok := t.acquire(r.Context())
+	if !ok {
 		http.Error(w, "request canceled", http.StatusRequestTimeout)
 		return
 	}
+	defer snapshot.release()
 
-	result, err := t.handle(w, r)
+	result, err := t.handle(w, r, snapshot)
 	if err != nil {
 		t.writeError(w, r, err)
 		return
@@ -77,19 +135,87 @@ func (t *Runner) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	t.writeResult(w, r, result)
 }
 
-func (t *Runner) handle(_ http.ResponseWriter, r *http.Request) (*deno.RunGoValueResult, error) {
+// acquire begins a request with the current snapshot, and waits for a slot of it to be available or for ctx to be done.
+// The snapshot is not retired until the slot is released.
+func (t *Runner) acquire(ctx context.Context) (*runnerSnapshot, bool) {
+	snapshot := t.snapshot.Load()
+	// The snapshot is retired once it is replaced, so the one loaded after it is the current one.
+	for !snapshot.begin() {
+		snapshot = t.snapshot.Load()
+	}
+
+	select {
+	case snapshot.sema <- struct{}{}:
+		return snapshot, true
+	case <-ctx.Done():
+		snapshot.runs.Done()
+		return nil, false
+	}
+}
+
+// begin counts a request towards the snapshot, unless the snapshot has been retired.
+func (s *runnerSnapshot) begin() bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.retired {
+		return false
+	}
+	s.runs.Add(1)
+	return true
+}
+
+func (s *runnerSnapshot) release() {
+	<-s.sema
+	s.runs.Done()
+}
+
+// retire stops the snapshot from beginning requests, and waits for the requests that have begun to end.
+func (s *runnerSnapshot) retire() {
+	s.mutex.Lock()
+	s.retired = true
+	s.mutex.Unlock()
+	s.runs.Wait()
+}
+
+func (t *Runner) handle(_ http.ResponseWriter, r *http.Request, snapshot *runnerSnapshot) (*deno.RunGoValueResult, error) {
 	var runRequest RunRequest
 	err := json.NewDecoder(r.Body).Decode(&runRequest)
 	if err != nil {
 		return nil, err
 	}
-	ctx, cancel := context.WithTimeout(r.Context(), time.Duration(t.timeoutSeconds)*time.Second)
+	return t.run(r.Context(), snapshot, runRequest, deno.RunGoValueOptions{})
+}
+
+// run runs runRequest with snapshot. opts gives the options that are not in runRequest.
+func (t *Runner) run(ctx context.Context, snapshot *runnerSnapshot, runRequest RunRequest, opts deno.RunGoValueOptions) (*deno.RunGoValueResult, error) {
+	var permissioner deno.Permissioner
+	var ipPolicies []deno.IPPolicy
+	var allowPorts []deno.PortRange
+	var err error
+	if runRequest.Policy != nil {
+		permissioner, err = runRequest.Policy.Permissioner(t.Resolver)
+		if err != nil {
+			return nil, err
+		}
+		ipPolicies, err = runRequest.Policy.IPPolicies()
+		if err != nil {
+			return nil, err
+		}
+		allowPorts, err = runRequest.Policy.PortRanges()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, snapshot.timeout)
 	defer cancel()
 
-	result, err := t.Runner.RunGoValue(ctx, deno.RunGoValueOptions{
-		TargetScript: runRequest.Script,
-		Input:        runRequest.Input,
-	})
+	opts.TargetScript = runRequest.Script
+	opts.Input = runRequest.Input
+	opts.Permissioner = permissioner
+	opts.IPPolicies = ipPolicies
+	opts.AllowPorts = allowPorts
+	result, err := snapshot.runner.RunGoValue(ctx, opts)
 	if err != nil {
 		return nil, errors.Join(err, ctx.Err())
 	}
@@ -98,6 +224,14 @@ func (t *Runner) handle(_ http.ResponseWriter, r *http.Request) (*deno.RunGoValu
 }
 
 func (t *Runner) writeError(w http.ResponseWriter, r *http.Request, err error) {
+	writeJSON(w, r, newErrorRunResponse(err))
+}
+
+func (t *Runner) writeResult(w http.ResponseWriter, r *http.Request, result *deno.RunGoValueResult) {
+	writeJSON(w, r, newRunResponse(result))
+}
+
+func newErrorRunResponse(err error) RunResponse {
 	runResponse := RunResponse{
 		Error: err.Error(),
 	}
@@ -106,23 +240,47 @@ func (t *Runner) writeError(w http.ResponseWriter, r *http.Request, err error) {
 	if errors.As(err, &runFileError) {
 		runResponse.Stderr = NewStream(runFileError.Stderr)
 		runResponse.Stdout = NewStream(runFileError.Stdout)
+		runResponse.setLogs(runFileError.Logs)
+		runResponse.PermissionEvents = runFileError.PermissionEvents
+		runResponse.ResourceUsage = NewResourceUsage(runFileError.ResourceUsage)
 	}
-	if errors.Is(err, context.DeadlineExceeded) {
+	var limitError *deno.ErrorResourceLimitExceeded
+	var scriptError *deno.ErrorScript
+	switch {
+	case errors.Is(err, deno.ErrOutOfMemory):
+		runResponse.ErrorCode = ErrorCodeRunOutOfMemory
+	case errors.As(err, &limitError):
+		runResponse.ErrorCode = ErrorCodeRunResourceLimitExceeded
+		runResponse.ResourceLimit = limitError.Limit
+	case errors.As(err, &scriptError):
+		runResponse.ErrorCode = ErrorCodeScriptError
+		runResponse.ScriptError = scriptError
+	case errors.Is(err, context.DeadlineExceeded):
 		runResponse.ErrorCode = ErrorCodeRunTimout
-	} else {
+	default:
 		runResponse.ErrorCode = ErrorCodeUnknown
 	}
-
-	writeJSON(w, r, runResponse)
+	return runResponse
 }
 
-func (t *Runner) writeResult(w http.ResponseWriter, r *http.Request, result *deno.RunGoValueResult) {
+func newRunResponse(result *deno.RunGoValueResult) RunResponse {
 	runResponse := RunResponse{
-		Output: result.Output,
-		Stderr: NewStream(result.Stderr),
-		Stdout: NewStream(result.Stdout),
+		Output:           result.Output,
+		Stderr:           NewStream(result.Stderr),
+		Stdout:           NewStream(result.Stdout),
+		PermissionEvents: result.PermissionEvents,
+		ResourceUsage:    NewResourceUsage(result.ResourceUsage),
+	}
+	runResponse.setLogs(result.Logs)
+	return runResponse
+}
+
+func (r *RunResponse) setLogs(logs *deno.LogRecorder) {
+	if logs == nil {
+		return
 	}
-	writeJSON(w, r, runResponse)
+	r.Logs = logs.Records()
+	r.LogsTruncated = logs.Exceeded()
 }
 
 func writeJSON(w http.ResponseWriter, _ *http.Request, jsonValue interface{}) {
@@ -0,0 +1,220 @@
+package handler
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strings"
+	"sync"
+	"unicode/utf8"
+
+	"github.com/authgear/authgear-deno/pkg/deno"
+)
+
+type StreamEventType string
+
+const (
+	StreamEventTypeStdout     StreamEventType = "stdout"
+	StreamEventTypeStderr     StreamEventType = "stderr"
+	StreamEventTypePermission StreamEventType = "permission"
+	StreamEventTypeResult     StreamEventType = "result"
+)
+
+// StreamEvent is what happens in a run. The result is always the last event.
+type StreamEvent struct {
+	Type StreamEventType `json:"type"`
+	// stdout, stderr
+	Data string `json:"data,omitempty"`
+	// permission
+	PermissionEvent *deno.PermissionEvent `json:"permission_event,omitempty"`
+	// result
+	Result *RunResponse `json:"result,omitempty"`
+}
+
+// StreamRunner runs like Runner, but writes the events of the run as they happen.
+// They are Server-Sent Events if the request accepts text/event-stream, and NDJSON otherwise.
+// It shares the concurrency limit and the policy of Runner.
+type StreamRunner struct {
+	Runner *Runner
+}
+
+func (t *StreamRunner) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+
+	snapshot, ok := t.Runner.acquire(r.Context())
+	if !ok {
+		http.Error(w, "request canceled", http.StatusRequestTimeout)
+		return
+	}
+	defer snapshot.release()
+
+	// The body is decoded before the status is written, so that a bad request is told by the status.
+	var runRequest RunRequest
+	err := json.NewDecoder(r.Body).Decode(&runRequest)
+	if err != nil {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		//nolint:errchkjson
+		_ = json.NewEncoder(w).Encode(newErrorRunResponse(err))
+		return
+	}
+
+	sse := acceptsEventStream(r)
+	if sse {
+		w.Header().Set("Content-Type", "text/event-stream")
+	} else {
+		w.Header().Set("Content-Type", "application/x-ndjson")
+	}
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+
+	queue := newStreamEventQueue()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		result, err := t.run(r, snapshot, runRequest, queue)
+		var runResponse RunResponse
+		if err != nil {
+			runResponse = newErrorRunResponse(err)
+		} else {
+			runResponse = newRunResponse(result)
+		}
+		queue.push(StreamEvent{Type: StreamEventTypeResult, Result: &runResponse})
+	}()
+
+	// The events are written here, so that a slow client never blocks the run.
+	controller := http.NewResponseController(w)
+	for {
+		var finished bool
+		select {
+		case <-queue.ready:
+		case <-done:
+			finished = true
+		}
+		for _, event := range queue.pop() {
+			// The run goes on until it is canceled with the request, even if the client has gone.
+			_ = writeStreamEvent(w, sse, event)
+		}
+		_ = controller.Flush()
+		if finished {
+			return
+		}
+	}
+}
+
+// run runs runRequest, pushing its events to queue, except the result.
+func (t *StreamRunner) run(r *http.Request, snapshot *runnerSnapshot, runRequest RunRequest, queue *streamEventQueue) (*deno.RunGoValueResult, error) {
+	stdout := &streamWriter{queue: queue, typ: StreamEventTypeStdout}
+	stderr := &streamWriter{queue: queue, typ: StreamEventTypeStderr}
+	// What is left of stdout and stderr comes before the result.
+	defer stderr.flush()
+	defer stdout.flush()
+	return t.Runner.run(r.Context(), snapshot, runRequest, deno.RunGoValueOptions{
+		Stdout: stdout,
+		Stderr: stderr,
+		OnPermissionEvent: func(e deno.PermissionEvent) {
+			queue.push(StreamEvent{Type: StreamEventTypePermission, PermissionEvent: &e})
+		},
+	})
+}
+
+func acceptsEventStream(r *http.Request) bool {
+	for _, v := range r.Header.Values("Accept") {
+		for _, part := range strings.Split(v, ",") {
+			mediaType, _, err := mime.ParseMediaType(part)
+			if err == nil && mediaType == "text/event-stream" {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func writeStreamEvent(w io.Writer, sse bool, event StreamEvent) error {
+	b, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	if sse {
+		_, err = fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event.Type, b)
+	} else {
+		_, err = fmt.Fprintf(w, "%s\n", b)
+	}
+	return err
+}
+
+// streamEventQueue never blocks on push. Its size is bounded by the limits of stdout and stderr.
+type streamEventQueue struct {
+	mutex  sync.Mutex
+	events []StreamEvent
+	// ready has a value if events is not empty.
+	ready chan struct{}
+}
+
+func newStreamEventQueue() *streamEventQueue {
+	return &streamEventQueue{
+		ready: make(chan struct{}, 1),
+	}
+}
+
+func (q *streamEventQueue) push(event StreamEvent) {
+	q.mutex.Lock()
+	q.events = append(q.events, event)
+	q.mutex.Unlock()
+	select {
+	case q.ready <- struct{}{}:
+	default:
+	}
+}
+
+func (q *streamEventQueue) pop() []StreamEvent {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	events := q.events
+	q.events = nil
+	return events
+}
+
+// streamWriter pushes what is written as events.
+// An incomplete UTF-8 sequence at the end is kept until the rest of it is written.
+type streamWriter struct {
+	queue   *streamEventQueue
+	typ     StreamEventType
+	mutex   sync.Mutex
+	pending []byte
+}
+
+func (w *streamWriter) Write(p []byte) (int, error) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	b := append(w.pending, p...)
+	end := len(b)
+	// A rune is at most utf8.UTFMax bytes, so only the last few bytes can be incomplete.
+	for i := len(b) - 1; i >= 0 && i >= len(b)-utf8.UTFMax; i-- {
+		if utf8.RuneStart(b[i]) {
+			if !utf8.FullRune(b[i:]) {
+				end = i
+			}
+			break
+		}
+	}
+	w.pending = append([]byte(nil), b[end:]...)
+	if end > 0 {
+		w.queue.push(StreamEvent{Type: w.typ, Data: string(b[:end])})
+	}
+	return len(p), nil
+}
+
+// flush pushes the incomplete UTF-8 sequence that is kept, as nothing more is written.
+func (w *streamWriter) flush() {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	if len(w.pending) > 0 {
+		w.queue.push(StreamEvent{Type: w.typ, Data: string(w.pending)})
+		w.pending = nil
+	}
+}
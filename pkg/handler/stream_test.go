@@ -0,0 +1,118 @@
+package handler_test
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/authgear/authgear-deno/pkg/deno"
+	"github.com/authgear/authgear-deno/pkg/handler"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestStreamRunner(t *testing.T) {
+	Convey("StreamRunner", t, func() {
+		runner := handler.NewRunner(&deno.Runner{Permissioner: deno.AllowAll()}, 1, 10)
+		server := httptest.NewServer(&handler.StreamRunner{Runner: runner})
+		defer server.Close()
+
+		post := func(body string) (*http.Response, []handler.StreamEvent) {
+			resp, err := http.Post(server.URL, "application/json", strings.NewReader(body))
+			So(err, ShouldBeNil)
+			defer resp.Body.Close()
+
+			var events []handler.StreamEvent
+			scanner := bufio.NewScanner(resp.Body)
+			for scanner.Scan() {
+				var event handler.StreamEvent
+				err := json.Unmarshal(scanner.Bytes(), &event)
+				So(err, ShouldBeNil)
+				events = append(events, event)
+			}
+			So(scanner.Err(), ShouldBeNil)
+			return resp, events
+		}
+
+		Convey("tell a bad request by the status", func() {
+			resp, _ := post("{")
+			So(resp.StatusCode, ShouldEqual, http.StatusBadRequest)
+			So(resp.Header.Get("Content-Type"), ShouldEqual, "application/json")
+		})
+
+		Convey("keep the previous runner until the requests with it have ended", func() {
+			reading := make(chan struct{})
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				// The body is read after the request has a slot.
+				r.Body = &signalReader{ReadCloser: r.Body, reading: reading}
+				(&handler.StreamRunner{Runner: runner}).ServeHTTP(w, r)
+			}))
+			defer server.Close()
+
+			body, bodyWriter := io.Pipe()
+			respCh := make(chan *http.Response)
+			go func() {
+				resp, err := http.Post(server.URL, "application/json", body)
+				if err == nil {
+					resp.Body.Close()
+				}
+				respCh <- resp
+			}()
+			<-reading
+
+			drained := runner.Update(&deno.Runner{Permissioner: deno.AllowAll()}, 1, 10)
+			select {
+			case <-drained:
+				So("drained before the request ended", ShouldBeEmpty)
+			case <-time.After(100 * time.Millisecond):
+			}
+
+			_, err := bodyWriter.Write([]byte("{"))
+			So(err, ShouldBeNil)
+			bodyWriter.Close()
+			resp := <-respCh
+			So(resp, ShouldNotBeNil)
+			So(resp.StatusCode, ShouldEqual, http.StatusBadRequest)
+			select {
+			case <-drained:
+			case <-time.After(5 * time.Second):
+				So("not drained after the request ended", ShouldBeEmpty)
+			}
+		})
+
+		Convey("write what is left of an incomplete UTF-8 sequence before the result", func() {
+			resp, events := post(`{"script": "export default function () { Deno.stdout.writeSync(new Uint8Array([0x61, 0xe2, 0x82])); return 1; }"}`)
+			So(resp.StatusCode, ShouldEqual, http.StatusOK)
+			So(len(events), ShouldBeGreaterThan, 1)
+
+			var stdout string
+			for _, event := range events[:len(events)-1] {
+				So(event.Type, ShouldEqual, handler.StreamEventTypeStdout)
+				stdout += event.Data
+			}
+			So(stdout, ShouldEqual, "a\uFFFD\uFFFD")
+
+			result := events[len(events)-1]
+			So(result.Type, ShouldEqual, handler.StreamEventTypeResult)
+			So(result.Result.Output, ShouldEqual, float64(1))
+		})
+	})
+}
+
+// signalReader closes reading on the first Read.
+type signalReader struct {
+	io.ReadCloser
+	reading chan struct{}
+	once    sync.Once
+}
+
+func (r *signalReader) Read(p []byte) (int, error) {
+	r.once.Do(func() { close(r.reading) })
+	return r.ReadCloser.Read(p)
+}
@@ -0,0 +1,43 @@
+package ioutil
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"os"
+	"time"
+)
+
+// WatchFile calls onChange whenever the content of filename changes, until ctx is done.
+// The file is polled every interval instead of watched with inotify,
+// so that a file replaced by rename, like a mounted Kubernetes ConfigMap, is also noticed.
+// A file that cannot be read is considered unchanged.
+func WatchFile(ctx context.Context, filename string, interval time.Duration, onChange func()) {
+	last, _ := hashFile(filename)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			current, err := hashFile(filename)
+			if err != nil || bytes.Equal(current, last) {
+				continue
+			}
+			last = current
+			onChange()
+		}
+	}
+}
+
+func hashFile(filename string) ([]byte, error) {
+	b, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	sum := sha256.Sum256(b)
+	return sum[:], nil
+}
@@ -0,0 +1,64 @@
+package ioutil_test
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/authgear/authgear-deno/pkg/ioutil"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestWatchFile(t *testing.T) {
+	Convey("WatchFile", t, func() {
+		filename := filepath.Join(t.TempDir(), "policy.yaml")
+		err := os.WriteFile(filename, []byte("a"), 0o600)
+		So(err, ShouldBeNil)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		changed := make(chan struct{}, 10)
+		go ioutil.WatchFile(ctx, filename, 10*time.Millisecond, func() {
+			changed <- struct{}{}
+		})
+
+		expectChange := func(expected bool) {
+			select {
+			case <-changed:
+				So(expected, ShouldBeTrue)
+			case <-time.After(100 * time.Millisecond):
+				So(expected, ShouldBeFalse)
+			}
+		}
+
+		// Unchanged.
+		expectChange(false)
+
+		// Changed in place.
+		err = os.WriteFile(filename, []byte("b"), 0o600)
+		So(err, ShouldBeNil)
+		expectChange(true)
+
+		// Rewritten with the same content.
+		err = os.WriteFile(filename, []byte("b"), 0o600)
+		So(err, ShouldBeNil)
+		expectChange(false)
+
+		// Removed.
+		err = os.Remove(filename)
+		So(err, ShouldBeNil)
+		expectChange(false)
+
+		// Replaced by rename.
+		tmp := filename + ".tmp"
+		err = os.WriteFile(tmp, []byte("c"), 0o600)
+		So(err, ShouldBeNil)
+		err = os.Rename(tmp, filename)
+		So(err, ShouldBeNil)
+		expectChange(true)
+	})
+}
@@ -2,6 +2,7 @@ package ioutil
 
 import (
 	"io"
+	"sync"
 )
 
 // LimitedWriter stops writing to the underlying W when
@@ -31,3 +32,30 @@ func (w *LimitedWriter[T]) Write(p []byte) (n int, err error) {
 	}
 	return
 }
+
+// SyncWriter serializes writes to the underlying W.
+type SyncWriter struct {
+	W     io.Writer
+	mutex sync.Mutex
+}
+
+func (w *SyncWriter) Write(p []byte) (n int, err error) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	return w.W.Write(p)
+}
+
+// TeeWriter writes to W, and then writes what W has written to Tee.
+// The errors of Tee are ignored, so that Tee cannot fail the writes to W.
+type TeeWriter struct {
+	W   io.Writer
+	Tee io.Writer
+}
+
+func (w *TeeWriter) Write(p []byte) (n int, err error) {
+	n, err = w.W.Write(p)
+	if n > 0 {
+		_, _ = w.Tee.Write(p[:n])
+	}
+	return
+}
@@ -2,7 +2,9 @@ package ioutil_test
 
 import (
 	"bytes"
+	"errors"
 	"io"
+	"sync"
 	"testing"
 
 	"github.com/authgear/authgear-deno/pkg/ioutil"
@@ -34,3 +36,49 @@ func TestLimitedWriter(t *testing.T) {
 		}
 	})
 }
+
+func TestSyncWriter(t *testing.T) {
+	Convey("SyncWriter", t, func() {
+		var buf bytes.Buffer
+		w := &ioutil.SyncWriter{W: &buf}
+
+		var wg sync.WaitGroup
+		for i := 0; i < 10; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				_, _ = w.Write([]byte("a"))
+			}()
+		}
+		wg.Wait()
+
+		So(buf.String(), ShouldEqual, "aaaaaaaaaa")
+	})
+}
+
+type errorWriter struct{}
+
+func (errorWriter) Write(p []byte) (int, error) {
+	return 0, errors.New("error")
+}
+
+func TestTeeWriter(t *testing.T) {
+	Convey("TeeWriter", t, func() {
+		Convey("write to both", func() {
+			var w, tee bytes.Buffer
+			n, err := (&ioutil.TeeWriter{W: &w, Tee: &tee}).Write([]byte("a"))
+			So(err, ShouldBeNil)
+			So(n, ShouldEqual, 1)
+			So(w.String(), ShouldEqual, "a")
+			So(tee.String(), ShouldEqual, "a")
+		})
+
+		Convey("ignore the errors of Tee", func() {
+			var w bytes.Buffer
+			n, err := (&ioutil.TeeWriter{W: &w, Tee: errorWriter{}}).Write([]byte("a"))
+			So(err, ShouldBeNil)
+			So(n, ShouldEqual, 1)
+			So(w.String(), ShouldEqual, "a")
+		})
+	})
+}